@@ -16,24 +16,56 @@ package main
 
 import (
 	"os"
+	"sync"
 	"utils"
 	"parser"
 	"errors"
+	"time"
+	"strings"
+	"net/url"
+	"io/ioutil"
 	"path/filepath"
+	"encoding/json"
 )
 
 /*
   $CACHED_DIR/$FILENAME/manifest.mpd
+  $CACHED_DIR/$FILENAME/tracks.json
+  $CACHED_DIR/$FILENAME/recording.json
   $CACHED_DIR/$FILENAME/chunk1.mp4
 */
 
+/* Name of the file describing a recording, it is added to the availables again on startup */
+const RECORDING_DESCRIPTION = "recording.json"
+
 type Available struct {
-	Proto     string
-	Path      string
-	Name      string
-	IsLive    bool
-	Generated bool
-	State     string
+	Proto             string
+	Path              string
+	Name              string
+	IsLive            bool
+	Generated         bool
+	State             string
+	Error             string
+	JustInTime        bool
+	CacheSegments     bool
+	OnDemand          bool
+	SubtitleFormat    string
+	ThumbnailInterval int
+	Ladder            string
+	LadderAudio       int
+	Encryption        *parser.EncryptionKey
+	LicenseUrl        string
+	DecryptionKeys    map[string]string
+	Record            bool
+	LiveWindow        float64
+	UpdatePeriod      float64
+	PresentationDelay float64
+	InputOptions      map[string]string
+	ReadTimeout       float64
+	Headers           map[string]string
+	Username          string
+	Password          string
+	Tracks            []parser.TrackDescription
 }
 
 func (a Available) checkProto() bool {
@@ -54,6 +86,25 @@ type CacheManager struct {
 	cached     []string
 	converter  DASHConverter
 	converting map[string]bool
+	ingesting  map[string]bool
+	defaults   Available
+	keys       map[string]*parser.EncryptionKey
+	playlists  []Playlist
+	/* Guards availables, cached, converting, ingesting and playlists */
+	mutex      sync.Mutex
+	/* Serialises the rebuilds of just in time indexes */
+	indexMutex sync.Mutex
+}
+
+/* Build an available for a file of the video directory using default options */
+func (c *CacheManager) fileAvailable(path string) Available {
+	av := c.defaults
+	av.Proto = "file"
+	av.Name = utils.RemoveExtension(filepath.Base(path))
+	av.Path = path
+	av.IsLive = false
+	av.Encryption = c.keys[av.Name]
+	return av
 }
 
 /* Create internal buffer of files that can be converted */
@@ -65,11 +116,7 @@ func (c *CacheManager) BuildAvailables() {
 	fileInfos, err := dir.Readdir(-1)
 	if err != nil { return }
 	for _, fi := range fileInfos {
-		c.availables = append(c.availables, Available{
-			Proto : "file",
-			Name : utils.RemoveExtension(fi.Name()),
-			Path : filepath.Join(c.videoDir, fi.Name()),
-		})
+		c.availables = append(c.availables, c.fileAvailable(filepath.Join(c.videoDir, fi.Name())))
 	}
 }
 
@@ -84,20 +131,52 @@ func (c *CacheManager) BuildCached() {
 	for _, fi := range fileInfos {
 		filename := utils.RemoveExtension(fi.Name())
 		c.cached = append(c.cached, filename)
+		found := false
 		for i := 0; i < len(c.availables); i++ {
 			if c.availables[i].Name == filename {
 				c.availables[i].Generated = true
+				found = true
 			}
 		}
+		if !found {
+			c.loadRecording(filename)
+			c.loadPlaylist(filename)
+		}
 	}
 }
 
-/* Initialise a CacheManager structure */
-func (c *CacheManager) Initialise(videoDir string, cachedDir string) {
+/* Add a recording kept in the cache directory to the availables */
+func (c *CacheManager) loadRecording(filename string) {
+	var av Available
+	data, err := ioutil.ReadFile(filepath.Join(c.cachedDir, filename, RECORDING_DESCRIPTION))
+	if err != nil { return }
+	if json.Unmarshal(data, &av) != nil || av.Name != filename { return }
+	av.Generated = true
+	c.availables = append(c.availables, av)
+}
+
+/* Load content keys of the assets, a JSON object mapping asset names to their key */
+func LoadEncryptionKeys(path string) (map[string]*parser.EncryptionKey, error) {
+	var keys map[string]*parser.EncryptionKey
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil { return nil, err }
+	err = json.Unmarshal(data, &keys)
+	if err != nil { return nil, err }
+	return keys, nil
+}
+
+/* Initialise a CacheManager structure, defaults are used for files of the video directory */
+func (c *CacheManager) Initialise(videoDir string, cachedDir string, defaults Available, keys map[string]*parser.EncryptionKey) {
 	c.videoDir = videoDir
+	c.defaults = defaults
+	c.keys = keys
 	c.BuildAvailables()
 	c.cachedDir = cachedDir
 	c.converting = make(map[string]bool)
+	c.ingesting = make(map[string]bool)
 	if (utils.FileExist(cachedDir)) {
 		c.BuildCached()
 	} else {
@@ -106,9 +185,26 @@ func (c *CacheManager) Initialise(videoDir string, cachedDir string) {
 	c.converter.Initialise(videoDir, cachedDir)
 }
 
-/* Return list of files that can be converted */
+/* Load description of the tracks of a generated element, nil if not generated */
+func (c *CacheManager) loadTracksDescription(filename string) []parser.TrackDescription {
+	var tracks []parser.TrackDescription
+	data, err := ioutil.ReadFile(filepath.Join(c.cachedDir, filename, TRACKS_DESCRIPTION))
+	if err != nil { return nil }
+	if json.Unmarshal(data, &tracks) != nil { return nil }
+	return tracks
+}
+
+/*
+ Return list of files that can be converted, content keys and credentials (username,
+ password, header and input option values, user information and query of the path)
+ are not exposed.
+ */
 func (c *CacheManager) GetAvailables() []Available {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	res := make([]Available, len(c.availables))
 	for i := 0; i < len(c.availables); i++ {
+		c.availables[i].Tracks = c.loadTracksDescription(c.availables[i].Name)
 		if c.availables[i].Generated {
 			c.availables[i].State = "generated"
 		} else if c.converting[c.availables[i].Name] {
@@ -116,12 +212,65 @@ func (c *CacheManager) GetAvailables() []Available {
 		} else {
 			c.availables[i].State = "not generated"
 		}
+		/* A live network stream may have stopped receiving data */
+		c.availables[i].Error = ""
+		if err := c.converter.LiveError(c.availables[i].Name); err != nil {
+			c.availables[i].State = "failed"
+			c.availables[i].Error = err.Error()
+		}
+		res[i] = c.availables[i]
+		if res[i].Encryption != nil {
+			key := *res[i].Encryption
+			key.Key = ""
+			res[i].Encryption = &key
+		}
+		res[i].Path = redactPath(res[i].Proto, res[i].Path)
+		res[i].Username = ""
+		res[i].Password = ""
+		if res[i].Headers != nil {
+			res[i].Headers = make(map[string]string)
+			for name := range c.availables[i].Headers {
+				res[i].Headers[name] = ""
+			}
+		}
+		if res[i].InputOptions != nil {
+			res[i].InputOptions = make(map[string]string)
+			for name := range c.availables[i].InputOptions {
+				res[i].InputOptions[name] = ""
+			}
+		}
+		if res[i].DecryptionKeys != nil {
+			res[i].DecryptionKeys = make(map[string]string)
+			for keyId := range c.availables[i].DecryptionKeys {
+				res[i].DecryptionKeys[keyId] = ""
+			}
+		}
+	}
+	return res
+}
 
+/* Return content key (hexadecimal) of a key id, from the keys file or the availables */
+func (c *CacheManager) GetContentKey(keyId string) (string, error) {
+	normalize := func (value string) string {
+		return strings.ToLower(strings.Replace(value, "-", "", -1))
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, key := range c.keys {
+		if key != nil && normalize(key.KeyId) == normalize(keyId) {
+			return key.Key, nil
+		}
 	}
-	return c.availables
+	for i := 0; i < len(c.availables); i++ {
+		key := c.availables[i].Encryption
+		if key != nil && normalize(key.KeyId) == normalize(keyId) {
+			return key.Key, nil
+		}
+	}
+	return "", errors.New("No content key for key id '" + keyId + "'")
 }
 
-/* Retrieve path to file according to stored filename */
+/* Retrieve path to file according to stored filename, c.mutex must be held */
 func (c *CacheManager) getPathFromFilename(filename string) string {
 	var i int
 	/* Retrieve corresponding available */
@@ -132,10 +281,11 @@ func (c *CacheManager) getPathFromFilename(filename string) string {
 	return c.availables[i].Proto + "://" + c.availables[i].Path
 }
 
-/* Build DASH version of file if necessary */
+/* Build DASH version of file if necessary, c.mutex is not held during the build */
 func (c *CacheManager) buildIfNeeded(filename string) error {
 	var i int
-	var err error
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	if c.converting[filename] {
 		return errors.New("File '" + filename + "' is being generated")
 	}
@@ -158,15 +308,24 @@ func (c *CacheManager) buildIfNeeded(filename string) error {
 	if i == len(c.availables) {
 		return errors.New("File '" + filename + "' does not exist")
 	}
-	/* Try to build file */
-	c.converting[filename] = true
+	av := c.availables[i]
 	/* Get path to file */
 	inPath := c.getPathFromFilename(filename)
 	if inPath == "" { return errors.New("Can't find file for building !") }
-	err = c.converter.Build(inPath, filename, c.availables[i].IsLive)
+	/* Try to build file */
+	c.converting[filename] = true
+	c.mutex.Unlock()
+	err := c.converter.Build(inPath, av)
+	c.mutex.Lock()
 	delete(c.converting, filename)
 	if err != nil { return err }
-	c.availables[i].Generated = true
+	/* Availables may have changed during the build */
+	for i = 0; i < len(c.availables); i++ {
+		if c.availables[i].Name == filename {
+			c.availables[i].Generated = true
+			break
+		}
+	}
 	c.cached = append(c.cached, filename)
 	return nil
 }
@@ -176,9 +335,78 @@ func (c *CacheManager) Build(filename string) error {
 	return c.buildIfNeeded(filename)
 }
 
-/* Stop a demuxer for a live stream */
+/*
+ Remove credentials from the path of a network source (URL without its scheme) : user
+ information and query values (e.g. SRT passphrase). Paths of files are kept.
+ */
+func redactPath(proto string, path string) string {
+	if proto == "file" { return path }
+	u, err := url.Parse("//" + path)
+	if err != nil { return "" }
+	if u.User == nil && u.RawQuery == "" { return path }
+	u.User = nil
+	query := u.Query()
+	for name := range query {
+		query[name] = []string{""}
+	}
+	u.RawQuery = query.Encode()
+	return strings.TrimPrefix(u.String(), "//")
+}
+
+/*
+ Add the recording of a stopped live stream as a generated available, its directory
+ is renamed with the stop time so that the stream can be generated again. The
+ available is described in the directory, without the source credentials, input
+ options and content key : a recording encrypted with a key given on /add can no
+ longer be licensed after a restart.
+ */
+func (c *CacheManager) addRecording(filename string) error {
+	var av Available
+	name := filename + "_" + time.Now().Format("20060102150405")
+	err := os.Rename(filepath.Join(c.cachedDir, filename), filepath.Join(c.cachedDir, name))
+	if err != nil { return err }
+	for i := 0; i < len(c.availables); i++ {
+		if c.availables[i].Name == filename {
+			av = c.availables[i]
+			break
+		}
+	}
+	av.Name = name
+	av.IsLive = false
+	av.Record = false
+	av.Generated = true
+	av.Headers = nil
+	av.Username = ""
+	av.Password = ""
+	av.DecryptionKeys = nil
+	av.Tracks = nil
+	c.availables = append(c.availables, av)
+	c.cached = append(c.cached, name)
+	av.Path = redactPath(av.Proto, av.Path)
+	av.InputOptions = nil
+	if av.Encryption != nil {
+		key := *av.Encryption
+		key.Key = ""
+		av.Encryption = &key
+	}
+	data, err := json.Marshal(av)
+	if err != nil { return err }
+	return writeStringToFile(filepath.Join(c.cachedDir, name, RECORDING_DESCRIPTION), string(data))
+}
+
+/* Stop a demuxer for a live stream, a recorded stream is kept as a new available */
 func (c *CacheManager) Stop(filename string) error {
-	err := c.converter.Stop(filename)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.stop(filename)
+}
+
+/* Stop a live generation, c.mutex must be held */
+func (c *CacheManager) stop(filename string) error {
+	recorded, err := c.converter.Stop(filename)
+	if recorded {
+		err = c.addRecording(filename)
+	}
 	/* Remove directory */
 	os.RemoveAll(filepath.Join(c.cachedDir, filename))
 	/* Update available */
@@ -199,32 +427,222 @@ func (c *CacheManager) Stop(filename string) error {
 
 /* Return element for a file */
 func (c *CacheManager) GetElement(filename string, element string) (string, error) {
+	/* Descriptions of recordings and playlists are internal */
+	if name := filepath.Base(element); name == RECORDING_DESCRIPTION || name == PLAYLIST_DESCRIPTION {
+		return "", errors.New("Element '" + element + "' of '" + filename + "' is not served")
+	}
 	return filepath.Join(c.cachedDir, filename, element), nil
 }
 
+/*
+ Package a chunk on request for a just in time generated file. Return nil data if the
+ element is not a just in time chunk and must be served from disk.
+ */
+func (c *CacheManager) PackageElement(filename string, element string) ([]byte, error) {
+	var i int
+	if utils.FileExist(filepath.Join(c.cachedDir, filename, element)) {
+		return nil, nil
+	}
+	c.mutex.Lock()
+	for i = 0; i < len(c.availables) && c.availables[i].Name != filename; i++ {}
+	if i == len(c.availables) || !c.availables[i].JustInTime || c.availables[i].IsLive {
+		c.mutex.Unlock()
+		return nil, nil
+	}
+	av := c.availables[i]
+	inPath := c.getPathFromFilename(filename)
+	c.mutex.Unlock()
+	c.indexMutex.Lock()
+	/* Index is lost (restart), build it again */
+	if !c.converter.IsBuilding(filename) {
+		err := c.converter.Build(inPath, av)
+		if err != nil {
+			c.indexMutex.Unlock()
+			return nil, err
+		}
+	}
+	c.indexMutex.Unlock()
+	return c.converter.BuildJustInTimeChunk(filename, element)
+}
+
+/* Return a Smooth fragment (moof and mdat) from the DASH chunk it maps to */
+func (c *CacheManager) GetSmoothFragment(filename string, quality string, fragment string) ([]byte, error) {
+	manifestPath, err := c.GetElement(filename, SMOOTH_MANIFEST)
+	if err != nil { return nil, err }
+	chunk, err := smoothChunkName(manifestPath, quality, fragment)
+	if err != nil { return nil, err }
+	data, err := c.PackageElement(filename, chunk)
+	if err != nil { return nil, err }
+	if data == nil {
+		path, err := c.GetElement(filename, chunk)
+		if err != nil { return nil, err }
+		data, err = ioutil.ReadFile(path)
+		if err != nil { return nil, err }
+	}
+	c.mutex.Lock()
+	isLive := false
+	for i := 0; i < len(c.availables); i++ {
+		if c.availables[i].Name == filename {
+			isLive = c.availables[i].IsLive
+			break
+		}
+	}
+	c.mutex.Unlock()
+	return smoothFragment(data, isLive)
+}
+
 /* Add an available to the list for building */
 func (c *CacheManager) AddAvailable(av Available) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.addAvailable(av)
+}
+
+/* Add an available to the list, c.mutex must be held */
+func (c *CacheManager) addAvailable(av Available) error {
 	if !(av.checkProto()) {
 		return errors.New("Incorrect protocol '" + av.Proto + "' !")
 	}
+	if av.Encryption == nil {
+		av.Encryption = c.keys[av.Name]
+	}
+	/* Network streams and ingests are always live */
+	if parser.IsStreamProtocol(av.Proto) || av.Proto == parser.INGEST_PROTOCOL {
+		av.IsLive = true
+	}
 	c.availables = append(c.availables, av)
 	return nil
 }
 
+/*
+ Add a segment pushed by a live encoder to an ingest. The ingest is added to the
+ availables on its first push, return true if its generation must be started
+ (first push, or previous generation failed).
+ */
+func (c *CacheManager) Ingest(filename string, track string, data []byte) (bool, error) {
+	var i int
+	if filename == "" || strings.ContainsAny(filename, "/.") || strings.ContainsAny(track, "/.") {
+		return false, errors.New("Invalid ingest name '" + filename + "/" + track + "'")
+	}
+	err := parser.PushIngest(filename, track, data)
+	if err != nil { return false, err }
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.ingesting[filename] {
+		return false, nil
+	}
+	for i = 0; i < len(c.availables) && c.availables[i].Name != filename; i++ {}
+	if i == len(c.availables) {
+		av := Available{
+			Proto: parser.INGEST_PROTOCOL,
+			Path: filename,
+			Name: filename,
+			LicenseUrl: c.defaults.LicenseUrl,
+		}
+		err = c.addAvailable(av)
+		if err != nil { return false, err }
+	} else if c.availables[i].Proto != parser.INGEST_PROTOCOL {
+		return false, errors.New("File '" + filename + "' is not an ingest")
+	}
+	if c.converter.IsBuilding(filename) && c.converter.LiveError(filename) == nil {
+		return false, nil
+	}
+	/* Clean a failed generation, or one cached before a restart */
+	c.stop(filename)
+	c.ingesting[filename] = true
+	return true, nil
+}
+
+/* Start generation of an ingest, Ingest must have returned true */
+func (c *CacheManager) BuildIngest(filename string) error {
+	err := c.Build(filename)
+	c.mutex.Lock()
+	delete(c.ingesting, filename)
+	c.mutex.Unlock()
+	return err
+}
+
+/* Build the manifest of a playlist, generating its assets if necessary */
+func (c *CacheManager) AddPlaylist(playlist Playlist) error {
+	if playlist.Name == "" || strings.ContainsAny(playlist.Name, "/.") {
+		return errors.New("Invalid playlist name '" + playlist.Name + "' !")
+	}
+	c.mutex.Lock()
+	for i := 0; i < len(c.availables); i++ {
+		if c.availables[i].Name == playlist.Name {
+			c.mutex.Unlock()
+			return errors.New("Playlist name '" + playlist.Name + "' is already used by a file !")
+		}
+		/* A live generation would be started and never stopped */
+		for _, item := range playlist.Items {
+			if c.availables[i].Name == item.Name && c.availables[i].IsLive {
+				c.mutex.Unlock()
+				return errors.New("Live '" + item.Name + "' can't be used in a playlist")
+			}
+		}
+	}
+	c.mutex.Unlock()
+	for _, item := range playlist.Items {
+		err := c.buildIfNeeded(item.Name)
+		if err != nil { return err }
+	}
+	manifest, err := buildPlaylistManifest(playlist, c.cachedDir)
+	if err != nil { return err }
+	description, err := json.Marshal(playlist)
+	if err != nil { return err }
+	outPath := filepath.Join(c.cachedDir, playlist.Name)
+	err = os.MkdirAll(outPath, os.ModeDir|os.ModePerm)
+	if err != nil { return err }
+	err = writeStringToFile(filepath.Join(outPath, "manifest.mpd"), manifest)
+	if err != nil { return err }
+	err = writeStringToFile(filepath.Join(outPath, PLAYLIST_DESCRIPTION), string(description))
+	if err != nil { return err }
+	c.setPlaylist(playlist)
+	return nil
+}
+
+/* Add a playlist to the list, replacing its previous version */
+func (c *CacheManager) setPlaylist(playlist Playlist) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i := 0; i < len(c.playlists); i++ {
+		if c.playlists[i].Name == playlist.Name {
+			c.playlists[i] = playlist
+			return
+		}
+	}
+	c.playlists = append(c.playlists, playlist)
+}
+
+/* Add a playlist kept in the cache directory to the list */
+func (c *CacheManager) loadPlaylist(filename string) {
+	var playlist Playlist
+	data, err := ioutil.ReadFile(filepath.Join(c.cachedDir, filename, PLAYLIST_DESCRIPTION))
+	if err != nil { return }
+	if json.Unmarshal(data, &playlist) != nil || playlist.Name != filename { return }
+	c.setPlaylist(playlist)
+}
+
+/* Return list of playlists */
+func (c *CacheManager) GetPlaylists() []Playlist {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]Playlist{}, c.playlists...)
+}
+
 /* Add a file to the list of available file for building */
 func (c *CacheManager) AddFile(path string) error {
-	c.availables = append(c.availables, Available{
-		Proto : "file",
-		Name : utils.RemoveExtension(filepath.Base(path)),
-		Path : path,
-		IsLive : false,
-	})
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.availables = append(c.availables, c.fileAvailable(path))
 	return nil
 }
 
 /* Remove file from cache (if it has been generated) and from availables */
 func (c *CacheManager) RemoveFile(path string) error {
 	filename := utils.RemoveExtension(filepath.Base(path))
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	/* If filename in cached remove directory and remove from list */
 	for i := 0; i < len(c.cached); i++ {
 		if c.cached[i] == filename {
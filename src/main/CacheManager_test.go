@@ -0,0 +1,87 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+  "strings"
+  "testing"
+)
+
+func TestRedactPath(t *testing.T) {
+  cases := []struct {
+    proto, path, want string
+  }{
+    {"file", "/videos/movie?.mp4", "/videos/movie?.mp4"},
+    {"dash", "example.com/live/manifest.mpd", "example.com/live/manifest.mpd"},
+    {"udp", "user:pw@239.0.0.1:1234", "239.0.0.1:1234"},
+    {"srt", "example.com:9000?mode=caller&passphrase=secret", "example.com:9000?mode=&passphrase="},
+  }
+  for _, c := range cases {
+    if got := redactPath(c.proto, c.path); got != c.want {
+      t.Errorf("bad redacted path for %q. want %q, got %q", c.path, c.want, got)
+    }
+  }
+}
+
+func TestGetElementDescriptions(t *testing.T) {
+  cache := CacheManager{cachedDir: "/cache"}
+  for _, element := range []string{RECORDING_DESCRIPTION, PLAYLIST_DESCRIPTION} {
+    if _, err := cache.GetElement("live_20260101000000", element); err == nil {
+      t.Errorf("%s should not be served", element)
+    }
+  }
+  path, err := cache.GetElement("live_20260101000000", "manifest.mpd")
+  if err != nil || path != "/cache/live_20260101000000/manifest.mpd" {
+    t.Errorf("bad element path. got %q (%v)", path, err)
+  }
+}
+
+func TestGetAvailablesCredentials(t *testing.T) {
+  cache := CacheManager{
+    availables: []Available{{
+      Proto: "srt",
+      Path: "user:pw@example.com:9000?passphrase=secret",
+      Name: "feed",
+      InputOptions: map[string]string{"passphrase": "secret"},
+      Headers: map[string]string{"X-Token": "abc"},
+      Password: "pw",
+    }},
+    converting: make(map[string]bool),
+  }
+  av := cache.GetAvailables()[0]
+  if av.InputOptions["passphrase"] != "" || av.Headers["X-Token"] != "" || av.Password != "" {
+    t.Errorf("credentials returned. got %v %v %q", av.InputOptions, av.Headers, av.Password)
+  }
+  if av.Path != "example.com:9000?passphrase=" {
+    t.Errorf("bad returned path. got %q", av.Path)
+  }
+  if _, ok := av.InputOptions["passphrase"]; !ok {
+    t.Errorf("input option names should be kept")
+  }
+  if cache.availables[0].InputOptions["passphrase"] != "secret" {
+    t.Errorf("input options of the available should not be modified")
+  }
+}
+
+func TestAddPlaylistLive(t *testing.T) {
+  cache := CacheManager{
+    availables: []Available{{Proto: "udp", Path: "239.0.0.1:1234", Name: "feed", IsLive: true}},
+    converting: make(map[string]bool),
+  }
+  err := cache.AddPlaylist(Playlist{Name: "list", Items: []PlaylistItem{{Name: "feed"}}})
+  if err == nil || !strings.Contains(err.Error(), "Live 'feed'") {
+    t.Errorf("live file should be rejected before its generation. got %v", err)
+  }
+}
@@ -16,19 +16,27 @@ package main
 
 import (
 	"os"
+	"sync"
 	"time"
 	"math"
+	"utils"
 	"errors"
 	"parser"
 	"runtime"
 	"strconv"
 	"path/filepath"
+	"encoding/json"
 	"runtime/debug"
 )
 
+/* Default interval in seconds between two updates of live manifests */
+const DEFAULT_UPDATE_PERIOD = 2
+
+/* Name of the file describing tracks of a generated element */
+const TRACKS_DESCRIPTION = "tracks.json"
+
 /* Structure to hold manifest info to avoid recomputing */
 type ManifestInfos struct {
-	bufferDepth float64
 	duration float64
 	maxChunkDuration float64
 	minBufferTime float64
@@ -47,6 +55,19 @@ type DASHBuilder struct {
 	manifestInfos *ManifestInfos
 	demuxer       *parser.Demuxer
 	stop          bool
+	record        bool
+	liveWindow    float64
+	updatePeriod  float64
+	liveDelay     float64
+	done          chan bool
+	err           error
+	outPath       string
+	justInTime    bool
+	cacheSegments bool
+	onDemand      bool
+	thumbnails    *parser.Thumbnails
+	transcoders   []*parser.Transcoder
+	mutex         sync.Mutex
 }
 
 /* Structure used to store building specific information */
@@ -54,6 +75,7 @@ type DASHConverter struct {
 	videoDir  string
 	cachedDir string
 	builders  map[string]*DASHBuilder
+	mutex     sync.Mutex
 }
 
 /* Initialise a DASHConverter structure */
@@ -64,10 +86,24 @@ func (b *DASHConverter) Initialise(videoDir string, cachedDir string) {
 	parser.InitialiseDemuxers()
 }
 
+/* Return the running generation of a file, builders are shared between requests */
+func (c *DASHConverter) getBuilder(filename string) (*DASHBuilder, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	builder, exists := c.builders[filename]
+	return builder, exists
+}
+
+/* Register the running generation of a file */
+func (c *DASHConverter) setBuilder(filename string, builder *DASHBuilder) {
+	c.mutex.Lock()
+	c.builders[filename] = builder
+	c.mutex.Unlock()
+}
+
 /* Compute manifest informations */
 func (b *DASHBuilder) computeManifestInfos() *ManifestInfos {
 	var res ManifestInfos
-	res.bufferDepth = math.MaxFloat64
 	res.duration = math.MaxFloat64
 	res.maxChunkDuration = float64(0)
 	res.minBufferTime = float64(0)
@@ -81,8 +117,9 @@ func (b *DASHBuilder) computeManifestInfos() *ManifestInfos {
 	res.maxHeight = 0
 	for i := 0; i < len(b.tracks); i++ {
 		b.tracks[i].ComputePrivateInfos()
-		if b.tracks[i].BufferDepth() < res.bufferDepth {
-			res.bufferDepth = b.tracks[i].BufferDepth()
+		/* Text and trick mode tracks follow the timeline of the other tracks */
+		if b.tracks[i].IsText() || b.tracks[i].IsTrickMode() {
+			continue
 		}
 		if b.tracks[i].Duration() < res.duration {
 			res.duration = b.tracks[i].Duration()
@@ -133,15 +170,30 @@ func (b *DASHBuilder) buildManifest(isLive bool) (string, error) {
 <MPD
   xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"
   xmlns="urn:mpeg:dash:schema:mpd:2011"
+  xmlns:cenc="urn:mpeg:cenc:2013"
+  xmlns:mspr="urn:microsoft:playready"
+  xmlns:clearkey="http://dashif.org/guidelines/clearKey"
+  xmlns:dashif="https://dashif.org/CPS"
   xsi:schemaLocation="urn:mpeg:dash:schema:mpd:2011 http://standards.iso.org/ittf/PubliclyAvailableStandards/MPEG-DASH_schema_files/DASH-MPD.xsd"`
 	if isLive {
 		manifest += `
   type="dynamic"
-  minimumUpdatePeriod="PT2S"
-  timeShiftBufferDepth="PT` + strconv.FormatFloat(b.manifestInfos.bufferDepth, 'f', -1, 64) + `S"
+  minimumUpdatePeriod="PT` + strconv.FormatFloat(b.updatePeriod, 'f', -1, 64) + `S"
+  timeShiftBufferDepth="PT` + strconv.FormatFloat(b.liveWindow, 'f', -1, 64) + `S"`
+		if b.liveDelay > 0 {
+			manifest += `
+  suggestedPresentationDelay="PT` + strconv.FormatFloat(b.liveDelay, 'f', -1, 64) + `S"`
+		}
+		manifest += `
   maxSegmentDuration="PT` + strconv.FormatFloat(b.manifestInfos.maxChunkDuration, 'f', -1, 64) + `S"
   minBufferTime="PT` + strconv.FormatFloat(b.manifestInfos.minBufferTime, 'f', -1, 64) + `S"
   profiles="urn:mpeg:dash:profile:isoff-live:2011,urn:com:dashif:dash264,urn:hbbtv:dash:profile:isoff-live:2012">`
+	} else if b.onDemand {
+		manifest += `
+  type="static"
+  mediaPresentationDuration="PT` + strconv.FormatFloat(b.manifestInfos.duration, 'f', -1, 64) + `S"
+  minBufferTime="PT` + strconv.FormatFloat(b.manifestInfos.maxChunkDuration, 'f', -1, 64) + `S"
+  profiles="urn:mpeg:dash:profile:isoff-on-demand:2011">`
 	} else {
 		manifest += `
   type="static"
@@ -152,9 +204,19 @@ func (b *DASHBuilder) buildManifest(isLive bool) (string, error) {
 	manifest += `
   <Period>
     <AdaptationSet
+      id="1"
       group="1"
-      mimeType="video/mp4"
-      par="16:9"`
+      mimeType="video/mp4"`
+	/* Picture aspect ratio of the first video track, representations share it */
+	for i := 0; i < len(b.tracks); i++ {
+		if !b.tracks[i].IsAudio() && !b.tracks[i].IsText() {
+			if b.tracks[i].PictureAspectRatio() != "" {
+				manifest += `
+      par="` + b.tracks[i].PictureAspectRatio() + `"`
+			}
+			break
+		}
+	}
 	if (b.manifestInfos.minVideoBandwidth != b.manifestInfos.maxVideoBandwidth) {
 		manifest += `
       minBandwidth="` + strconv.Itoa(b.manifestInfos.minVideoBandwidth) + `"
@@ -170,9 +232,16 @@ func (b *DASHBuilder) buildManifest(isLive bool) (string, error) {
       maxHeight="` + strconv.Itoa(b.manifestInfos.maxHeight) + `"
       segmentAlignment="true"
       startWithSAP="1">`
+	/* Representations of a set share the same key */
+	for i := 0; i < len(b.tracks); i++ {
+		if !b.tracks[i].IsAudio() && !b.tracks[i].IsText() && !b.tracks[i].IsTrickMode() {
+			manifest += b.tracks[i].BuildContentProtection()
+			break
+		}
+	}
 	adaptationDone := false
 	for i := 0; i < len(b.tracks); i++ {
-		if !b.tracks[i].IsAudio(){
+		if !b.tracks[i].IsAudio() && !b.tracks[i].IsText() && !b.tracks[i].IsTrickMode() {
 			if !adaptationDone {
 				manifest += b.tracks[i].BuildAdaptationSet()
 				adaptationDone = true
@@ -181,65 +250,308 @@ func (b *DASHBuilder) buildManifest(isLive bool) (string, error) {
 		}
 	}
 	manifest += `
-    </AdaptationSet>
-    <AdaptationSet
-      group="2"
-      mimeType="audio/mp4"`
-	if (b.manifestInfos.minAudioBandwidth != b.manifestInfos.maxAudioBandwidth) {
-		manifest += `
-      minBandwidth="` + strconv.Itoa(b.manifestInfos.minAudioBandwidth) + `"
-      maxBandwidth="` + strconv.Itoa(b.manifestInfos.maxAudioBandwidth) + `"`
-	} else {
-		manifest += `
-      bandwidth="` + strconv.Itoa(b.manifestInfos.minAudioBandwidth) + `"`
+    </AdaptationSet>`
+	manifest += b.buildTrickModeAdaptationSet()
+	if b.thumbnails != nil {
+		manifest += b.thumbnails.BuildAdaptationSet()
 	}
-	manifest += `
-      segmentAlignment="true">`
-	adaptationDone = false
+	manifest += b.buildAudioAdaptationSets()
+	/* Each text track has its own adaptation set */
 	for i := 0; i < len(b.tracks); i++ {
-		if b.tracks[i].IsAudio() {
-			if !adaptationDone {
-				manifest += b.tracks[i].BuildAdaptationSet()
-				adaptationDone = true
-			}
-			manifest += b.tracks[i].BuildRepresentation()
+		if b.tracks[i].IsText() {
+			manifest += b.buildTextAdaptationSet(b.tracks[i])
 		}
 	}
 	manifest += `
-    </AdaptationSet>`
-	manifest += `
   </Period>
 </MPD>`
 	return manifest, nil
 }
 
-/* Routine launched for live streams */
+/* Build Label and Role elements of an adaptation set */
+func buildLabelAndRole(label string, role string) string {
+	res := ""
+	if label != "" {
+		res += `
+      <Label>` + utils.XMLEscape(label) + `</Label>`
+	}
+	return res + `
+      <Role schemeIdUri="urn:mpeg:dash:role:2011" value="` + role + `" />`
+}
+
+/* Build adaptation set of the key frame only tracks, used for scrubbing and fast forward */
+func (b *DASHBuilder) buildTrickModeAdaptationSet() string {
+	res := ""
+	for i := 0; i < len(b.tracks); i++ {
+		if !b.tracks[i].IsTrickMode() {
+			continue
+		}
+		if res == "" {
+			res += `
+    <AdaptationSet
+      id="2"
+      mimeType="video/mp4"
+      segmentAlignment="true"
+      startWithSAP="1">`
+			res += b.tracks[i].BuildContentProtection()
+			res += `
+      <EssentialProperty schemeIdUri="http://dashif.org/guidelines/trickmode" value="1" />`
+			res += b.tracks[i].BuildAdaptationSet()
+		}
+		res += b.tracks[i].BuildRepresentation()
+	}
+	if res == "" {
+		return res
+	}
+	return res + `
+    </AdaptationSet>`
+}
+
+/* Audio track information used to group adaptation sets */
+type dashAudioTrack interface {
+	IsAudio() bool
+	Language() string
+	Codec() string
+	Role() string
+}
+
+/* Group indexes of audio tracks sharing the same language, codec and role */
+func dashAudioSets(tracks []dashAudioTrack) [][]int {
+	var sets [][]int
+	for i := 0; i < len(tracks); i++ {
+		if !tracks[i].IsAudio() {
+			continue
+		}
+		j := 0
+		for ; j < len(sets); j++ {
+			first := tracks[sets[j][0]]
+			if first.Language() == tracks[i].Language() &&
+				first.Codec() == tracks[i].Codec() &&
+				first.Role() == tracks[i].Role() {
+				break
+			}
+		}
+		if j < len(sets) {
+			sets[j] = append(sets[j], i)
+		} else {
+			sets = append(sets, []int{i})
+		}
+	}
+	return sets
+}
+
+/* Group audio tracks sharing the same language, codec and role */
+func (b *DASHBuilder) audioSets() [][]*parser.Track {
+	tracks := make([]dashAudioTrack, len(b.tracks))
+	for i := 0; i < len(b.tracks); i++ {
+		tracks[i] = b.tracks[i]
+	}
+	var sets [][]*parser.Track
+	for _, indexes := range dashAudioSets(tracks) {
+		set := make([]*parser.Track, len(indexes))
+		for i, index := range indexes {
+			set[i] = b.tracks[index]
+		}
+		sets = append(sets, set)
+	}
+	return sets
+}
+
+/* Build one audio adaptation set per language, codec and role */
+func (b *DASHBuilder) buildAudioAdaptationSets() string {
+	res := ""
+	sets := b.audioSets()
+	/* Without role from the source, first set is the main one */
+	mainDone := false
+	for _, set := range sets {
+		if set[0].Role() == "main" {
+			mainDone = true
+		}
+	}
+	for _, set := range sets {
+		role := set[0].Role()
+		if role == "" && !mainDone {
+			role = "main"
+			mainDone = true
+		} else if role == "" {
+			role = "alternate"
+		}
+		minBandwidth := int(^uint(0) >> 1)
+		maxBandwidth := 0
+		for _, track := range set {
+			if track.Bandwidth() < minBandwidth {
+				minBandwidth = track.Bandwidth()
+			}
+			if track.Bandwidth() > maxBandwidth {
+				maxBandwidth = track.Bandwidth()
+			}
+		}
+		res += `
+    <AdaptationSet
+      group="2"
+      mimeType="audio/mp4"`
+		if set[0].Language() != "" {
+			res += `
+      lang="` + utils.XMLEscape(set[0].Language()) + `"`
+		}
+		if minBandwidth != maxBandwidth {
+			res += `
+      minBandwidth="` + strconv.Itoa(minBandwidth) + `"
+      maxBandwidth="` + strconv.Itoa(maxBandwidth) + `"`
+		} else {
+			res += `
+      bandwidth="` + strconv.Itoa(minBandwidth) + `"`
+		}
+		res += `
+      segmentAlignment="true">`
+		res += set[0].BuildContentProtection()
+		res += buildLabelAndRole(set[0].Label(), role)
+		res += set[0].BuildAdaptationSet()
+		for _, track := range set {
+			res += track.BuildRepresentation()
+		}
+		res += `
+    </AdaptationSet>`
+	}
+	return res
+}
+
+/* Build adaptation set of a text track */
+func (b *DASHBuilder) buildTextAdaptationSet(track *parser.Track) string {
+	res := `
+    <AdaptationSet
+      contentType="text"
+      mimeType="application/mp4"`
+	if track.Language() != "" {
+		res += `
+      lang="` + utils.XMLEscape(track.Language()) + `"`
+	}
+	res += `
+      segmentAlignment="true">`
+	res += buildLabelAndRole(track.Label(), "subtitle")
+	res += track.BuildAdaptationSet()
+	res += track.BuildRepresentation()
+	return res + `
+    </AdaptationSet>`
+}
+
+/* Write a string to a file, replacing its previous content */
+func writeStringToFile(path string, content string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(content)
+	return err
+}
+
+/* Write description of the tracks, used in the files listing */
+func (b *DASHBuilder) writeTracksDescription(outPath string) error {
+	var tracks []parser.TrackDescription
+	for i := 0; i < len(b.tracks); i++ {
+		tracks = append(tracks, b.tracks[i].Describe())
+	}
+	data, err := json.Marshal(tracks)
+	if err != nil { return err }
+	return writeStringToFile(filepath.Join(outPath, TRACKS_DESCRIPTION), string(data))
+}
+
+/* Build DASH manifest, Smooth manifest and HLS playlists and write them in output directory */
+func (b *DASHBuilder) writeManifests(outPath string, isLive bool) error {
+	manifest, err := b.buildManifest(isLive)
+	if err != nil { return err }
+	err = writeStringToFile(filepath.Join(outPath, "manifest.mpd"), manifest)
+	if err != nil { return err }
+	err = b.writeTracksDescription(outPath)
+	if err != nil { return err }
+	/* Smooth fragments are served from chunk files, not available on-demand */
+	if !b.onDemand {
+		err = b.writeSmoothManifest(outPath, isLive)
+		if err != nil { return err }
+	}
+	return b.writeHLSPlaylists(outPath, isLive)
+}
+
+/*
+ Routine launched for live streams. When the source ends (static DASH manifest, HLS
+ playlist with an ENDLIST tag, end of a stream), chunks left are described by static
+ manifests.
+ */
 func liveWorker(demuxer *parser.Demuxer, b *DASHBuilder, outPath string, filename string, cachedDir string) {
-	for !b.stop {
+	ended := false
+	for !b.stop && !ended {
 		/* Extract and build chunk for each track */
-		(*demuxer).ExtractChunk(&b.tracks, true)
-		duration := b.buildChunks(outPath)
+		ended = !(*demuxer).ExtractChunk(&b.tracks, true)
+		/* A dead network stream or a failing source stops the generation, its error is reported */
+		if failing, ok := (*demuxer).(parser.FailingDemuxer); ok && failing.Err() != nil {
+			var logger Logger
+			b.err = failing.Err()
+			logger.Error("Live generation of %q stopped : %s", filename, b.err.Error())
+			break
+		}
+		duration, err := b.buildChunks(outPath)
+		if err != nil {
+			var logger Logger
+			b.err = err
+			logger.Error("Live generation of %q stopped : %s", filename, b.err.Error())
+			break
+		}
 		/* If we succeeded, update manifest */
 		if duration > 0 && duration < math.MaxFloat64 {
 			for i := 0; i < len(b.tracks); i++ {
 				b.tracks[i].CleanForLive()
 				b.tracks[i].CleanDirectory(filepath.Join(cachedDir, filename))
 			}
-			/* Build manifest */
-			manifest, _ := b.buildManifest(true)
-			/* Write it to file */
-			f, _ := os.OpenFile(filepath.Join(cachedDir, filename, "manifest.mpd"), os.O_WRONLY|os.O_TRUNC, os.ModePerm)
-			/* Write generated manifest */
-			f.WriteString(manifest)
-			f.Close()
+			/* Publish the sheet being filled with the new chunk, recordings keep every sheet */
+			if b.thumbnails != nil {
+				b.thumbnails.WritePartial()
+				if !b.record {
+					b.thumbnails.CleanForLive()
+				}
+			}
+			/* Update manifest and playlists */
+			b.writeManifests(outPath, true)
 			/* Sleep until next chunk */
-			time.Sleep(time.Duration(int64(duration * 1000000)) * time.Microsecond)
-		} else {
+			if !ended {
+				time.Sleep(time.Duration(int64(duration * 1000000)) * time.Microsecond)
+			}
+		} else if !ended {
 			time.Sleep(500 * time.Millisecond)
 		}
 	}
-	(*demuxer).Close()
+	if b.record || (ended && b.err == nil) {
+		b.finishRecording(outPath)
+	}
+	b.release(*demuxer)
+	close(b.done)
+}
+
+/* Release demuxer, encoders and tracks used by a generation */
+func (b *DASHBuilder) release(demuxer parser.Demuxer) {
+	if b.thumbnails != nil {
+		b.thumbnails.Close()
+	}
+	for i := 0; i < len(b.transcoders); i++ {
+		b.transcoders[i].Close()
+	}
 	b.cleanTracks()
+	demuxer.Close()
+}
+
+/*
+ Describe every chunk kept during a live generation in static manifests. Without
+ recording, those are the chunks left in the live window of an ended source.
+ */
+func (b *DASHBuilder) finishRecording(outPath string) error {
+	for i := 0; i < len(b.tracks); i++ {
+		if !b.record {
+			b.tracks[i].SetRecording(true)
+		}
+		b.tracks[i].FinishRecording()
+	}
+	b.manifestInfos = nil
+	return b.writeManifests(outPath, false)
 }
 
 /* Clean builder private structures for GC */
@@ -251,13 +563,55 @@ func (b *DASHBuilder) cleanTracks() {
 	b.tracks = b.tracks[:0]
 }
 
-/* Build one chunk for each track in the builder */
-func (b *DASHBuilder) buildChunks(outPath string) float64 {
+/* Build samples of text tracks on the timeline of the first other track having samples */
+func (b *DASHBuilder) buildTextSamples() {
+	var reference *parser.Track
+	var start, duration int64
+	for i := 0; i < len(b.tracks) && reference == nil; i++ {
+		if b.tracks[i].IsText() {
+			continue
+		}
+		if s, d, ok := b.tracks[i].ChunkSpan(); ok {
+			reference = b.tracks[i]
+			start, duration = s, d
+		}
+	}
+	if reference == nil {
+		return
+	}
+	for i := 0; i < len(b.tracks); i++ {
+		if b.tracks[i].IsText() {
+			b.tracks[i].BuildTextSamples(
+				int64(parser.TimebaseRescale(int(start), reference.Timescale(), b.tracks[i].Timescale())),
+				int64(parser.TimebaseRescale(int(duration), reference.Timescale(), b.tracks[i].Timescale())))
+		}
+	}
+}
+
+/* Build one chunk for each track in the builder, return the shortest chunk duration */
+func (b *DASHBuilder) buildChunks(outPath string) (float64, error) {
 	duration := math.MaxFloat64
+	b.buildTextSamples()
+	/* Thumbnails are decoded before the source chunk is built */
+	if b.thumbnails != nil {
+		err := b.thumbnails.Update()
+		if err != nil { return 0, err }
+	}
+	/* Renditions are encoded from their source before it is cleaned */
+	for i := 0; i < len(b.transcoders); i++ {
+		err := b.transcoders[i].Update()
+		if err != nil { return 0, err }
+	}
+	/* Trick mode samples are copied from their source before it is cleaned */
+	for i := 0; i < len(b.tracks); i++ {
+		if b.tracks[i].IsTrickMode() {
+			b.tracks[i].BuildTrickModeSamples()
+		}
+	}
 	/* Call each track generation function */
 	for i := 0; i < len(b.tracks); i++ {
 		tmp, _ := b.tracks[i].BuildChunk(outPath)
-		if duration > tmp {
+		if duration > tmp && !b.tracks[i].IsText() {
 			duration = tmp
 		}
 		b.tracks[i].Clean()
@@ -269,76 +623,326 @@ func (b *DASHBuilder) buildChunks(outPath string) float64 {
 	   samples, their GO part has not be freed by GC.
         */
 	debug.FreeOSMemory()
-	return duration
+	return duration, nil
+}
+
+/* Set window, update period and presentation delay of live manifests, in seconds */
+func (b *DASHBuilder) setLiveParameters(av Available) {
+	b.liveWindow = parser.DEFAULT_LIVE_WINDOW
+	if av.LiveWindow > 0 {
+		b.liveWindow = av.LiveWindow
+	}
+	b.updatePeriod = DEFAULT_UPDATE_PERIOD
+	if av.UpdatePeriod > 0 {
+		b.updatePeriod = av.UpdatePeriod
+	}
+	b.liveDelay = av.PresentationDelay
+}
+
+/* Give keys of an encrypted source to its demuxer, tracks are then extracted clear */
+func setDecryptionKeys(demuxer parser.Demuxer, inPath string, keys map[string]string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	decrypting, ok := demuxer.(parser.DecryptingDemuxer)
+	if !ok {
+		return errors.New("Decryption is not supported for '" + inPath + "'")
+	}
+	return decrypting.SetDecryptionKeys(keys)
+}
+
+/* Give input options and read timeout of a network stream to its demuxer */
+func setInputOptions(demuxer parser.Demuxer, inPath string, av Available) error {
+	stream, ok := demuxer.(parser.StreamDemuxer)
+	if !ok && len(av.InputOptions) > 0 {
+		return errors.New("Input options are not supported for '" + inPath + "'")
+	} else if ok {
+		stream.SetInputOptions(av.InputOptions, av.ReadTimeout)
+	}
+	return nil
+}
+
+/* Give HTTP headers and credentials of a remote file to its demuxer */
+func setHeaders(demuxer parser.Demuxer, inPath string, av Available) error {
+	remote, ok := demuxer.(parser.RemoteDemuxer)
+	if !ok || !parser.IsRemoteProtocol(av.Proto) {
+		if len(av.Headers) > 0 || av.Username != "" || av.Password != "" {
+			return errors.New("HTTP headers are not supported for '" + inPath + "'")
+		}
+		return nil
+	}
+	remote.SetHeaders(av.Headers, av.Username, av.Password)
+	return nil
 }
 
 /* Build a DASH version of a file (manifest and chunks) */
-func (c *DASHConverter) Build(inPath string, filename string, isLive bool) error {
+func (c *DASHConverter) Build(inPath string, av Available) error {
 	var demuxer parser.Demuxer
 	var builder DASHBuilder
 	var err error
-	var manifest string
-	if _, exists := c.builders[filename]; exists {
+	filename := av.Name
+	isLive := av.IsLive
+	if av.OnDemand && isLive {
+		return errors.New("On-demand profile can't be used for live '" + filename + "'")
+	}
+	if av.JustInTime && !isLive && !av.OnDemand {
+		return c.buildJustInTime(inPath, av)
+	}
+	if _, exists := c.getBuilder(filename); exists {
 		return errors.New("File '" + filename + "' is already building !")
 	}
 	/* Get demuxer */
 	demuxer, err = parser.OpenDemuxer(inPath)
 	if err != nil { return err }
+	/* Everything is released when returning, unless a live generation goes on with it */
+	live := false
+	defer func() {
+		if !live {
+			builder.release(demuxer)
+		}
+	}()
+	err = setDecryptionKeys(demuxer, inPath, av.DecryptionKeys)
+	if err == nil {
+		err = setInputOptions(demuxer, inPath, av)
+	}
+	if err == nil {
+		err = setHeaders(demuxer, inPath, av)
+	}
+	if err != nil { return err }
 	/* Recover track from demuxer */
 	err = demuxer.GetTracks(&builder.tracks)
 	if err != nil { return err }
-	/* Defer demuxer close and track clean up if anything goes wrong */
-	if !isLive {
-		defer demuxer.Close()
-		defer builder.cleanTracks()
-	}
 	/* If we did not find any track, there is a problem */
 	if len(builder.tracks) <= 0 {
-		demuxer.Close()
 		return errors.New("No tracks found !")
 	}
+	/* Add a key frame only track for each video track */
+	for _, track := range builder.tracks {
+		if trick := track.NewTrickModeTrack(); trick != nil {
+			builder.tracks = append(builder.tracks, trick)
+		}
+	}
+	/* Add renditions of the ladder, encoded from the source tracks */
+	if av.Ladder != "" {
+		ladder, err := parser.ParseLadder(av.Ladder)
+		if err != nil { return err }
+		builder.transcoders, err = parser.NewTranscoders(builder.tracks, ladder, av.LadderAudio)
+		if err != nil { return err }
+		for _, transcoder := range builder.transcoders {
+			builder.tracks = append(builder.tracks, transcoder.Tracks()...)
+		}
+	}
 	outPath := filepath.Join(c.cachedDir, filename)
+	builder.onDemand = av.OnDemand
+	builder.setLiveParameters(av)
 	/* Initialise build for each track and build init chunk */
 	for i := 0; i < len(builder.tracks); i++ {
 		builder.tracks[i].InitialiseBuild(outPath)
-		builder.tracks[i].BuildInit(outPath)
+		builder.tracks[i].SetOnDemand(av.OnDemand)
+		builder.tracks[i].SetTextFormat(av.SubtitleFormat)
+		err = builder.tracks[i].SetEncryption(av.Encryption, i)
+		if err != nil { return err }
+		builder.tracks[i].SetClearKey(av.LicenseUrl)
+		builder.tracks[i].SetRecording(av.Record && isLive)
+		builder.tracks[i].SetLiveWindow(av.LiveWindow)
+		/* On-demand init atoms are written in the track file */
+		if !av.OnDemand {
+			builder.tracks[i].BuildInit(outPath)
+		}
+	}
+	/* Thumbnails are optional, file is generated without them if no video can be decoded */
+	if av.ThumbnailInterval > 0 {
+		builder.thumbnails, _ = parser.NewThumbnails(builder.tracks, av.ThumbnailInterval, outPath)
 	}
 	/* While we have sample build chunks for each tracks */
 	eof := false
 	for !eof {
 		eof = !demuxer.ExtractChunk(&builder.tracks, false)
-		builder.buildChunks(outPath)
+		if failing, ok := demuxer.(parser.FailingDemuxer); ok && failing.Err() != nil {
+			return failing.Err()
+		}
+		/* Samples buffered by the encoders belong to the last chunk */
+		if eof {
+			for _, transcoder := range builder.transcoders {
+				transcoder.EndOfStream()
+			}
+		}
+		_, err = builder.buildChunks(outPath)
+		if err != nil { return err }
 	}
 	/* If there is samples left in tracks */
-	builder.buildChunks(outPath)
-	/* Build manifest */
-	manifest, err = builder.buildManifest(isLive)
+	_, err = builder.buildChunks(outPath)
 	if err != nil { return err }
-	/* Write it to file */
-	f, err := os.OpenFile(filepath.Join(c.cachedDir, filename, "manifest.mpd"), os.O_WRONLY|os.O_CREATE, os.ModePerm)
-	if err != nil {
-		return err
+	if builder.thumbnails != nil {
+		builder.thumbnails.WritePartial()
+	}
+	/* Gather fragments of each track in one indexed file */
+	if av.OnDemand {
+		for i := 0; i < len(builder.tracks); i++ {
+			err = builder.tracks[i].BuildOnDemandFile(outPath)
+			if err != nil { return err }
+		}
 	}
-	/* Write generated manifest */
-	_, err = f.WriteString(manifest)
-	f.Close()
+	/* Build manifest and playlists */
+	err = builder.writeManifests(outPath, isLive)
 	if err == nil && isLive {
+		live = true
+		builder.record = av.Record
+		builder.done = make(chan bool)
 		go liveWorker(&demuxer, &builder, outPath, filename, c.cachedDir)
 		builder.demuxer = &demuxer
-		c.builders[filename] = &builder
+		c.setBuilder(filename, &builder)
 	}
 	/* Force GC pass and memory release */
 	debug.FreeOSMemory()
 	return err
 }
 
-/* Stop a live generation thread */
-func (c *DASHConverter) Stop(filename string) error {
+/*
+ Build only the index and the manifest of a file, chunks will be packaged when
+ requested. Demuxer is kept open until the generation is stopped. Renditions of a
+ ladder and thumbnails need the whole source to be decoded, they can't be generated
+ just in time.
+ */
+func (c *DASHConverter) buildJustInTime(inPath string, av Available) error {
+	var builder DASHBuilder
+	if av.Ladder != "" {
+		return errors.New("Ladder can't be generated just in time for '" + av.Name + "'")
+	}
+	if av.ThumbnailInterval > 0 {
+		return errors.New("Thumbnails can't be generated just in time for '" + av.Name + "'")
+	}
+	if _, exists := c.getBuilder(av.Name); exists {
+		return errors.New("File '" + av.Name + "' is already building !")
+	}
+	/* Get demuxer */
+	demuxer, err := parser.OpenDemuxer(inPath)
+	if err != nil { return err }
+	indexed, ok := demuxer.(parser.IndexedDemuxer)
+	if !ok {
+		demuxer.Close()
+		return errors.New("Just in time generation is not supported for '" + inPath + "'")
+	}
+	err = setInputOptions(demuxer, inPath, av)
+	if err == nil {
+		err = setHeaders(demuxer, inPath, av)
+	}
+	/* Recover track from demuxer */
+	if err == nil {
+		err = demuxer.GetTracks(&builder.tracks)
+	}
+	if err == nil && len(builder.tracks) <= 0 {
+		err = errors.New("No tracks found !")
+	}
+	if err != nil {
+		demuxer.Close()
+		builder.cleanTracks()
+		return err
+	}
+	/* Add a key frame only track for each video track, indexed with its source */
+	for _, track := range builder.tracks {
+		if trick := track.NewTrickModeTrack(); trick != nil {
+			builder.tracks = append(builder.tracks, trick)
+		}
+	}
+	outPath := filepath.Join(c.cachedDir, av.Name)
+	/* Initialise build for each track and build init chunk */
+	for i := 0; i < len(builder.tracks) && err == nil; i++ {
+		builder.tracks[i].InitialiseBuild(outPath)
+		builder.tracks[i].SetTextFormat(av.SubtitleFormat)
+		err = builder.tracks[i].SetEncryption(av.Encryption, i)
+		if err == nil {
+			builder.tracks[i].SetClearKey(av.LicenseUrl)
+			builder.tracks[i].BuildInit(outPath)
+		}
+	}
+	/* Compute chunks from source key frames */
+	if err == nil {
+		err = indexed.BuildIndex(&builder.tracks)
+	}
+	if err == nil {
+		err = builder.writeManifests(outPath, false)
+	}
+	if err != nil {
+		demuxer.Close()
+		builder.cleanTracks()
+		return err
+	}
+	builder.demuxer = &demuxer
+	builder.outPath = outPath
+	builder.justInTime = true
+	builder.cacheSegments = av.CacheSegments
+	c.setBuilder(av.Name, &builder)
+	return nil
+}
+
+/* Package one chunk of a just in time generated file */
+func (c *DASHConverter) BuildJustInTimeChunk(filename string, element string) ([]byte, error) {
+	builder, exists := c.getBuilder(filename)
+	if !exists || !builder.justInTime {
+		return nil, errors.New("File '" + filename + "' is not generated just in time !")
+	}
+	/* Demuxer and tracks are shared between requests */
+	builder.mutex.Lock()
+	defer builder.mutex.Unlock()
+	for i := 0; i < len(builder.tracks); i++ {
+		chunk := builder.tracks[i].FindChunk(element)
+		if chunk < 0 {
+			continue
+		}
+		err := (*builder.demuxer).(parser.IndexedDemuxer).ExtractIndexedChunk(builder.tracks[i], chunk)
+		if err != nil {
+			builder.tracks[i].Clean()
+			return nil, err
+		}
+		data, err := builder.tracks[i].BuildChunkData()
+		builder.tracks[i].Clean()
+		if err != nil { return nil, err }
+		/* Keep chunk on disk, it will be served directly next time */
+		if builder.cacheSegments {
+			err = writeStringToFile(filepath.Join(builder.outPath, element), string(data))
+		}
+		return data, err
+	}
+	return nil, errors.New("Chunk '" + element + "' does not exist for '" + filename + "'")
+}
+
+/* Return why the live generation of a file stopped by itself, nil if it is running or not live */
+func (c *DASHConverter) LiveError(filename string) error {
+	builder, exists := c.getBuilder(filename)
+	if !exists {
+		return nil
+	}
+	return builder.err
+}
+
+/* Return if a file has a running generation (live or just in time) */
+func (c *DASHConverter) IsBuilding(filename string) bool {
+	_, exists := c.getBuilder(filename)
+	return exists
+}
+
+/*
+ Stop a live generation thread. Return true if the generation was recorded, its
+ static manifests are then written when returning.
+ */
+func (c *DASHConverter) Stop(filename string) (bool, error) {
+	c.mutex.Lock()
 	builder, exists := c.builders[filename]
+	delete(c.builders, filename)
+	c.mutex.Unlock()
 	if !exists {
-		return errors.New("File '" + filename + "' is not building !")
+		return false, errors.New("File '" + filename + "' is not building !")
 	}
 	builder.stop = true
-	delete(c.builders, filename)
-	return nil
+	/* Just in time generation has no thread, release demuxer now */
+	if builder.justInTime {
+		builder.mutex.Lock()
+		(*builder.demuxer).Close()
+		builder.cleanTracks()
+		builder.mutex.Unlock()
+	} else if builder.record {
+		<- builder.done
+	}
+	return builder.record, nil
 }
@@ -0,0 +1,53 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+type testAudioTrack struct {
+  audio bool
+  language, codec, role string
+}
+
+func (t testAudioTrack) IsAudio() bool { return t.audio }
+func (t testAudioTrack) Language() string { return t.language }
+func (t testAudioTrack) Codec() string { return t.codec }
+func (t testAudioTrack) Role() string { return t.role }
+
+func TestDASHAudioSets(t *testing.T) {
+  tracks := []dashAudioTrack{
+    testAudioTrack{codec: "avc1.64001f"},
+    testAudioTrack{audio: true, language: "fra", codec: "mp4a.40.2"},
+    testAudioTrack{audio: true, language: "eng", codec: "mp4a.40.2"},
+    testAudioTrack{audio: true, language: "fra", codec: "ec-3"},
+    testAudioTrack{audio: true, language: "fra", codec: "mp4a.40.2"},
+    testAudioTrack{audio: true, language: "fra", codec: "mp4a.40.2", role: "description"},
+  }
+  want := [][]int{{1, 4}, {2}, {3}, {5}}
+  sets := dashAudioSets(tracks)
+  if len(sets) != len(want) {
+    t.Fatalf("bad set count. want %d, got %d: %v", len(want), len(sets), sets)
+  }
+  for i := range want {
+    if len(sets[i]) != len(want[i]) {
+      t.Fatalf("bad set %d. want %v, got %v", i, want[i], sets[i])
+    }
+    for j := range want[i] {
+      if sets[i][j] != want[i][j] {
+        t.Errorf("bad set %d. want %v, got %v", i, want[i], sets[i])
+      }
+    }
+  }
+}
@@ -17,12 +17,19 @@ package main
 import (
 	"os"
 	"io"
+	"io/ioutil"
 	"fmt"
 	"flag"
+	"time"
+	"bytes"
+	"errors"
+	"strings"
 	"runtime"
 	"net/http"
 	"path/filepath"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/base64"
 )
 
 const (
@@ -69,6 +76,91 @@ func filesAddRouteHandler(cache *CacheManager, serverChan chan error) RouteHandl
 	}
 }
 
+/* Structures of W3C ClearKey license request and response, key ids and keys are base64url */
+type clearKeyRequest struct {
+	Kids []string `json:"kids"`
+	Type string   `json:"type"`
+}
+
+type clearKeyKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	K   string `json:"k"`
+}
+
+type clearKeyResponse struct {
+	Keys []clearKeyKey `json:"keys"`
+	Type string        `json:"type"`
+}
+
+/* POST /license/clearkey handler, answers with the keys found in the key store */
+func clearKeyLicenseHandler(cache *CacheManager, serverChan chan error) RouteHandler {
+	return func (w http.ResponseWriter, r *http.Request, params map[string]string) {
+		var request clearKeyRequest
+		var response clearKeyResponse
+		err := json.NewDecoder(r.Body).Decode(&request)
+		for i := 0; err == nil && i < len(request.Kids); i++ {
+			var keyId []byte
+			var key []byte
+			var hexKey string
+			keyId, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(request.Kids[i], "="))
+			if err != nil { break }
+			hexKey, err = cache.GetContentKey(hex.EncodeToString(keyId))
+			if err != nil { break }
+			key, err = hex.DecodeString(hexKey)
+			if err != nil { break }
+			response.Keys = append(response.Keys, clearKeyKey{"oct", request.Kids[i], base64.RawURLEncoding.EncodeToString(key)})
+		}
+		if err == nil && len(response.Keys) == 0 {
+			err = errors.New("No key id in ClearKey license request")
+		}
+		if err != nil {
+			http.Error(w, "Invalid request !", http.StatusBadRequest)
+			serverChan <- err
+			return
+		}
+		response.Type = request.Type
+		if response.Type == "" {
+			response.Type = "temporary"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+/* GET /playlists handler */
+func playlistsRouteHandler(cache *CacheManager, serverChan chan error) RouteHandler {
+	return func (w http.ResponseWriter, r *http.Request, params map[string]string) {
+		str := "[]"
+		w.Header().Set("Content-Type", "application/json")
+		playlists := cache.GetPlaylists()
+		if playlists != nil {
+			if res, err := json.Marshal(playlists); err == nil {
+				str = string(res)
+			}
+		}
+		fmt.Fprint(w, str)
+	}
+}
+
+/* POST /playlists handler */
+func playlistsAddRouteHandler(cache *CacheManager, serverChan chan error) RouteHandler {
+	return func (w http.ResponseWriter, r *http.Request, params map[string]string) {
+		var playlist Playlist
+		decoder := json.NewDecoder(r.Body)
+		err := decoder.Decode(&playlist)
+		if err == nil {
+			err = cache.AddPlaylist(playlist)
+		}
+		if err != nil {
+			http.Error(w, "Invalid request !", http.StatusBadRequest)
+			serverChan <- err
+		} else {
+			fmt.Fprintf(w, "")
+		}
+	}
+}
+
 /* POST /files/upload handler */
 func filesUploadHandler(cache *CacheManager, serverChan chan error, videoDir string) RouteHandler {
 	return func (w http.ResponseWriter, r *http.Request, params map[string]string) {
@@ -99,16 +191,67 @@ func filesUploadHandler(cache *CacheManager, serverChan chan error, videoDir str
 	}
 }
 
+/* Serve an element from disk or package it if generated just in time */
+func serveElement(cache *CacheManager, serverChan chan error, w http.ResponseWriter, r *http.Request, params map[string]string) {
+	path, err := cache.GetElement(params["filename"], params["elm"])
+	if err != nil {
+		serverChan <- err
+		http.Error(w, "Invalid request !", http.StatusNotFound)
+		return
+	}
+	data, err := cache.PackageElement(params["filename"], params["elm"])
+	if err != nil {
+		serverChan <- err
+		http.Error(w, "Invalid request !", http.StatusNotFound)
+	} else if data != nil {
+		http.ServeContent(w, r, params["elm"], time.Now(), bytes.NewReader(data))
+	} else {
+		http.ServeFile(w, r, path)
+	}
+}
+
 /* GET /dash/<filename>/<elm> handler */
 func elementRouteHandler(cache *CacheManager, serverChan chan error) RouteHandler {
 	return func (w http.ResponseWriter, r *http.Request, params map[string]string) {
-		path, err := cache.GetElement(params["filename"], params["elm"])
+		serveElement(cache, serverChan, w, r, params)
+	}
+}
+
+/* GET /hls/<filename>/<elm> handler */
+func hlsElementRouteHandler(cache *CacheManager, serverChan chan error) RouteHandler {
+	return func (w http.ResponseWriter, r *http.Request, params map[string]string) {
+		if filepath.Ext(params["elm"]) == ".m3u8" {
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		}
+		serveElement(cache, serverChan, w, r, params)
+	}
+}
+
+/* GET /smooth/<filename>/Manifest handler */
+func smoothManifestRouteHandler(cache *CacheManager, serverChan chan error) RouteHandler {
+	return func (w http.ResponseWriter, r *http.Request, params map[string]string) {
+		path, err := cache.GetElement(params["filename"], SMOOTH_MANIFEST)
 		if err != nil {
 			serverChan <- err
 			http.Error(w, "Invalid request !", http.StatusNotFound)
-		} else {
-			http.ServeFile(w, r, path)
+			return
 		}
+		w.Header().Set("Content-Type", "text/xml")
+		http.ServeFile(w, r, path)
+	}
+}
+
+/* GET /smooth/<filename>/QualityLevels(<bitrate>)/Fragments(<type>=<time>) handler */
+func smoothFragmentRouteHandler(cache *CacheManager, serverChan chan error) RouteHandler {
+	return func (w http.ResponseWriter, r *http.Request, params map[string]string) {
+		data, err := cache.GetSmoothFragment(params["filename"], params["quality"], params["fragment"])
+		if err != nil {
+			serverChan <- err
+			http.Error(w, "Invalid request !", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp4")
+		http.ServeContent(w, r, "", time.Now(), bytes.NewReader(data))
 	}
 }
 
@@ -138,6 +281,32 @@ func liveStopHandler(cache *CacheManager, serverChan chan error) RouteHandler {
 	}
 }
 
+/* PUT/POST /ingest/<filename>/<track>/<segment> handler, segment name is ignored */
+func ingestHandler(cache *CacheManager, serverChan chan error) RouteHandler {
+	return func (w http.ResponseWriter, r *http.Request, params map[string]string) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			serverChan <- err
+			http.Error(w, "Invalid request !", http.StatusBadRequest)
+			return
+		}
+		start, err := cache.Ingest(params["filename"], params["track"], data)
+		if err != nil {
+			serverChan <- err
+			http.Error(w, "Invalid request !", http.StatusBadRequest)
+			return
+		}
+		if start {
+			go func() {
+				if err := cache.BuildIngest(params["filename"]); err != nil {
+					serverChan <- err
+				}
+			}()
+		}
+		fmt.Fprintf(w, "")
+	}
+}
+
 /* GET /* */
 func interfaceHandler(interfaceDir string, serverChan chan error) RouteHandler {
 	return func (w http.ResponseWriter, r *http.Request, params map[string]string) {
@@ -149,11 +318,20 @@ func interfaceHandler(interfaceDir string, serverChan chan error) RouteHandler {
 	}
 }
 
-func parseCommandLine(port *string, videoDir *string, cachedDir *string, interfaceDir *string) {
+func parseCommandLine(port *string, videoDir *string, cachedDir *string, interfaceDir *string, keysPath *string, defaults *Available) {
 	tmpPort := flag.String("port", DEFAULT_PORT, "TCP port used when starting the API")
 	tmpVideoDir := flag.String("video", DEFAULT_VIDEO_DIR, "Directory containing the videos")
 	tmpCachedDir := flag.String("cache", DEFAULT_CACHED_DIR, "Directory used for caching")
 	tmpInterfaceDir := flag.String("ui", DEFAULT_INTERFACE_DIR, "Directory containing the UI")
+	flag.BoolVar(&defaults.JustInTime, "jit", false, "Package chunks of video directory files on request")
+	flag.BoolVar(&defaults.CacheSegments, "jit-cache", false, "Keep chunks packaged on request in cache directory")
+	flag.BoolVar(&defaults.OnDemand, "ondemand", false, "Write one indexed file per track (on-demand profile) for video directory files")
+	flag.StringVar(&defaults.SubtitleFormat, "subtitles", "wvtt", "Format of subtitle tracks of video directory files (wvtt or stpp)")
+	flag.IntVar(&defaults.ThumbnailInterval, "thumbnails", 0, "Interval in seconds between thumbnails of video directory files (0 to disable)")
+	flag.StringVar(&defaults.Ladder, "ladder", "", "Renditions encoded from video directory files, as <height>:<kbit/s> (ex: 1080:5000,720:3000,480:1200)")
+	flag.IntVar(&defaults.LadderAudio, "ladder-audio", 128, "Bitrate in kbit/s of the AAC rendition encoded with the ladder (0 to disable)")
+	flag.StringVar(keysPath, "keys", "", "JSON file mapping asset names to the content key used to encrypt them")
+	flag.StringVar(&defaults.LicenseUrl, "license-url", "", "Absolute ClearKey license URL signalled for files encrypted at packaging time, served by /license/clearkey (empty to disable)")
 	flag.Parse()
 	if *tmpPort == "" {
 		*port = DEFAULT_PORT
@@ -186,18 +364,47 @@ func main() {
 	var videoDir     string
 	var cachedDir    string
 	var interfaceDir string
+	var keysPath     string
+	var defaults     Available
 	/* Parsing command line */
-	parseCommandLine(&port, &videoDir, &cachedDir, &interfaceDir)
+	parseCommandLine(&port, &videoDir, &cachedDir, &interfaceDir, &keysPath, &defaults)
+	keys, err := LoadEncryptionKeys(keysPath)
+	if err != nil {
+		logger.Error("Failed to load content keys : %q", err.Error())
+		return
+	}
+	/* Options that can't be generated just in time would make every file fail */
+	if defaults.JustInTime && !defaults.OnDemand && defaults.Ladder != "" {
+		logger.Error("Option %q can't be used with -jit", "-ladder")
+		return
+	}
+	if defaults.JustInTime && !defaults.OnDemand && defaults.ThumbnailInterval > 0 {
+		logger.Error("Option %q can't be used with -jit", "-thumbnails")
+		return
+	}
 	/* Initialising data structures */
-	cache.Initialise(videoDir, cachedDir)
+	cache.Initialise(videoDir, cachedDir, defaults, keys)
 	serverChan := make(chan error)
 	/* Initialise route handling */
 	server.addRoute("GET", "/files", filesRouteHandler(&cache, serverChan))
 	server.addRoute("POST", "/files", filesAddRouteHandler(&cache, serverChan))
 	server.addRoute("POST", "/files/upload", filesUploadHandler(&cache, serverChan, videoDir))
+	/* Keys are only given away when a license URL is signalled */
+	if defaults.LicenseUrl != "" {
+		server.addRoute("POST", "/license/clearkey", clearKeyLicenseHandler(&cache, serverChan))
+	}
+	server.addRoute("GET", "/playlists", playlistsRouteHandler(&cache, serverChan))
+	server.addRoute("POST", "/playlists", playlistsAddRouteHandler(&cache, serverChan))
 	server.addRoute("GET", "/dash/:filename/:elm", elementRouteHandler(&cache, serverChan))
 	server.addRoute("POST", "/dash/:filename/generate", generationHandler(&cache, serverChan))
 	server.addRoute("DELETE", "/dash/:filename/generate", liveStopHandler(&cache, serverChan))
+	server.addRoute("GET", "/hls/:filename/:elm", hlsElementRouteHandler(&cache, serverChan))
+	server.addRoute("GET", "/smooth/:filename/Manifest", smoothManifestRouteHandler(&cache, serverChan))
+	server.addRoute("GET", "/smooth/:filename/:quality/:fragment", smoothFragmentRouteHandler(&cache, serverChan))
+	server.addRoute("PUT", "/ingest/:filename/:track", ingestHandler(&cache, serverChan))
+	server.addRoute("POST", "/ingest/:filename/:track", ingestHandler(&cache, serverChan))
+	server.addRoute("PUT", "/ingest/:filename/:track/*segment", ingestHandler(&cache, serverChan))
+	server.addRoute("POST", "/ingest/:filename/:track/*segment", ingestHandler(&cache, serverChan))
 	server.addRoute("GET", "/*path", interfaceHandler(interfaceDir, serverChan))
 	/* Start file monitoring */
 	inotifyChan, err := StartInotify(&cache, videoDir)
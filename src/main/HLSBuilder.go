@@ -0,0 +1,179 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"parser"
+	"strconv"
+	"path/filepath"
+)
+
+/*
+  $CACHED_DIR/$FILENAME/master.m3u8
+  $CACHED_DIR/$FILENAME/video0.m3u8
+  $CACHED_DIR/$FILENAME/audio1.m3u8
+*/
+
+const HLS_MASTER_PLAYLIST = "master.m3u8"
+
+/* Track information declared in the HLS master playlist */
+type hlsTrack interface {
+	IsAudio() bool
+	IsText() bool
+	IsTrickMode() bool
+	Codec() string
+	Language() string
+	Bandwidth() int
+	Width() int
+	Height() int
+	RepresentationId() string
+}
+
+/* Audio renditions sharing a codec, each video track has a variant per group */
+type hlsAudioGroup struct {
+	id        string
+	codec     string
+	bandwidth int
+	tracks    []hlsTrack
+}
+
+/* Group audio tracks by codec, in the order of the tracks */
+func hlsAudioGroups(tracks []hlsTrack) []*hlsAudioGroup {
+	var groups []*hlsAudioGroup
+	for _, t := range tracks {
+		if !t.IsAudio() {
+			continue
+		}
+		var group *hlsAudioGroup
+		for _, g := range groups {
+			if g.codec == t.Codec() {
+				group = g
+			}
+		}
+		if group == nil {
+			group = &hlsAudioGroup{id: "audio-" + t.Codec(), codec: t.Codec()}
+			groups = append(groups, group)
+		}
+		group.tracks = append(group.tracks, t)
+		if t.Bandwidth() > group.bandwidth {
+			group.bandwidth = t.Bandwidth()
+		}
+	}
+	return groups
+}
+
+/* Build HLS master playlist referencing one media playlist per track */
+func buildHLSMasterPlaylist(tracks []hlsTrack) string {
+	playlist := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-INDEPENDENT-SEGMENTS`
+	/* Declare audio tracks as alternative renditions of the group of their codec */
+	groups := hlsAudioGroups(tracks)
+	for _, g := range groups {
+		for j, t := range g.tracks {
+			playlist += `
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="` + g.id + `",NAME="` + t.RepresentationId() + `",`
+			if t.Language() != "" {
+				playlist += `LANGUAGE="` + t.Language() + `",`
+			}
+			playlist += `AUTOSELECT=YES,`
+			if j == 0 {
+				playlist += `DEFAULT=YES,`
+			} else {
+				playlist += `DEFAULT=NO,`
+			}
+			playlist += `URI="` + t.RepresentationId() + `.m3u8"`
+		}
+	}
+	/* Declare TTML subtitles as alternative renditions, WebVTT in MP4 is not supported by HLS */
+	subtitlesCodec := ""
+	for _, t := range tracks {
+		if !t.IsText() || t.Codec() == parser.TEXT_FORMAT_WVTT {
+			continue
+		}
+		playlist += `
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="` + t.RepresentationId() + `",`
+		if t.Language() != "" {
+			playlist += `LANGUAGE="` + t.Language() + `",`
+		}
+		playlist += `AUTOSELECT=YES,DEFAULT=NO,URI="` + t.RepresentationId() + `.m3u8"`
+		subtitlesCodec = t.Codec()
+	}
+	/* Declare one variant per video track and audio group */
+	videoDone := false
+	for _, t := range tracks {
+		if t.IsAudio() || t.IsText() || t.IsTrickMode() {
+			continue
+		}
+		variants := groups
+		if len(variants) == 0 {
+			variants = []*hlsAudioGroup{nil}
+		}
+		for _, g := range variants {
+			codecs := t.Codec()
+			bandwidth := t.Bandwidth()
+			if g != nil {
+				codecs += "," + g.codec
+				bandwidth += g.bandwidth
+			}
+			if subtitlesCodec != "" {
+				codecs += "," + subtitlesCodec
+			}
+			playlist += `
+#EXT-X-STREAM-INF:BANDWIDTH=` + strconv.Itoa(bandwidth) + `,CODECS="` + codecs + `",RESOLUTION=` + strconv.Itoa(t.Width()) + `x` + strconv.Itoa(t.Height())
+			if g != nil {
+				playlist += `,AUDIO="` + g.id + `"`
+			}
+			if subtitlesCodec != "" {
+				playlist += `,SUBTITLES="subs"`
+			}
+			playlist += `
+` + t.RepresentationId() + `.m3u8`
+		}
+		videoDone = true
+	}
+	/* Key frame only tracks are declared as I-frame playlists */
+	for _, t := range tracks {
+		if t.IsTrickMode() {
+			playlist += `
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=` + strconv.Itoa(t.Bandwidth()) + `,CODECS="` + t.Codec() + `",RESOLUTION=` + strconv.Itoa(t.Width()) + `x` + strconv.Itoa(t.Height()) + `,URI="` + t.RepresentationId() + `.m3u8"`
+		}
+	}
+	/* Audio only content : audio tracks are the variants */
+	if !videoDone {
+		for _, t := range tracks {
+			if t.IsText() {
+				continue
+			}
+			playlist += `
+#EXT-X-STREAM-INF:BANDWIDTH=` + strconv.Itoa(t.Bandwidth()) + `,CODECS="` + t.Codec() + `"
+` + t.RepresentationId() + `.m3u8`
+		}
+	}
+	return playlist + "\n"
+}
+
+/* Write HLS master playlist and media playlists next to the DASH manifest */
+func (b *DASHBuilder) writeHLSPlaylists(outPath string, isLive bool) error {
+	for i := 0; i < len(b.tracks); i++ {
+		err := writeStringToFile(filepath.Join(outPath, b.tracks[i].RepresentationId() + ".m3u8"), b.tracks[i].BuildHLSPlaylist(isLive))
+		if err != nil { return err }
+	}
+	tracks := make([]hlsTrack, len(b.tracks))
+	for i := 0; i < len(b.tracks); i++ {
+		tracks[i] = b.tracks[i]
+	}
+	return writeStringToFile(filepath.Join(outPath, HLS_MASTER_PLAYLIST), buildHLSMasterPlaylist(tracks))
+}
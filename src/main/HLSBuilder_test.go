@@ -0,0 +1,78 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+  "strings"
+  "testing"
+)
+
+type testTrack struct {
+  id, kind, codec, language string
+  bandwidth, width, height int
+}
+
+func (t testTrack) IsAudio() bool { return t.kind == "audio" }
+func (t testTrack) IsText() bool { return t.kind == "text" }
+func (t testTrack) IsTrickMode() bool { return t.kind == "trick" }
+func (t testTrack) Codec() string { return t.codec }
+func (t testTrack) Language() string { return t.language }
+func (t testTrack) Bandwidth() int { return t.bandwidth }
+func (t testTrack) Width() int { return t.width }
+func (t testTrack) Height() int { return t.height }
+func (t testTrack) RepresentationId() string { return t.id }
+
+func TestHLSMasterPlaylistAudioGroups(t *testing.T) {
+  tracks := []hlsTrack{
+    testTrack{id: "video0", kind: "video", codec: "avc1.64001f", bandwidth: 3000000, width: 1280, height: 720},
+    testTrack{id: "audio1", kind: "audio", codec: "mp4a.40.2", language: "fra", bandwidth: 128000},
+    testTrack{id: "audio2", kind: "audio", codec: "ec-3", language: "fra", bandwidth: 384000},
+    testTrack{id: "audio3", kind: "audio", codec: "mp4a.40.2", language: "eng", bandwidth: 96000},
+    testTrack{id: "trick0", kind: "trick", codec: "avc1.64001f", bandwidth: 300000, width: 1280, height: 720},
+  }
+  playlist := buildHLSMasterPlaylist(tracks)
+  for _, want := range []string{
+    `#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio-mp4a.40.2",NAME="audio1",LANGUAGE="fra",AUTOSELECT=YES,DEFAULT=YES,URI="audio1.m3u8"`,
+    `#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio-mp4a.40.2",NAME="audio3",LANGUAGE="eng",AUTOSELECT=YES,DEFAULT=NO,URI="audio3.m3u8"`,
+    `#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio-ec-3",NAME="audio2",LANGUAGE="fra",AUTOSELECT=YES,DEFAULT=YES,URI="audio2.m3u8"`,
+    "#EXT-X-STREAM-INF:BANDWIDTH=3128000,CODECS=\"avc1.64001f,mp4a.40.2\",RESOLUTION=1280x720,AUDIO=\"audio-mp4a.40.2\"\nvideo0.m3u8",
+    "#EXT-X-STREAM-INF:BANDWIDTH=3384000,CODECS=\"avc1.64001f,ec-3\",RESOLUTION=1280x720,AUDIO=\"audio-ec-3\"\nvideo0.m3u8",
+    `#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=300000,CODECS="avc1.64001f",RESOLUTION=1280x720,URI="trick0.m3u8"`,
+  } {
+    if !strings.Contains(playlist, want) {
+      t.Errorf("missing %q in master playlist:\n%s", want, playlist)
+    }
+  }
+  if got := strings.Count(playlist, "#EXT-X-STREAM-INF"); got != 2 {
+    t.Errorf("bad variant count. want 2, got %d", got)
+  }
+}
+
+func TestHLSMasterPlaylistAudioOnly(t *testing.T) {
+  tracks := []hlsTrack{
+    testTrack{id: "audio0", kind: "audio", codec: "mp4a.40.2", bandwidth: 128000},
+    testTrack{id: "text1", kind: "text", codec: "stpp", language: "fra"},
+  }
+  playlist := buildHLSMasterPlaylist(tracks)
+  if !strings.Contains(playlist, "#EXT-X-STREAM-INF:BANDWIDTH=128000,CODECS=\"mp4a.40.2\"\naudio0.m3u8") {
+    t.Errorf("audio track should be a variant:\n%s", playlist)
+  }
+  if !strings.Contains(playlist, `#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="text1",LANGUAGE="fra"`) {
+    t.Errorf("missing subtitles rendition:\n%s", playlist)
+  }
+  if strings.Contains(playlist, "text1.m3u8\n#EXT-X-STREAM-INF") || strings.Count(playlist, "#EXT-X-STREAM-INF") != 1 {
+    t.Errorf("text track should not be a variant:\n%s", playlist)
+  }
+}
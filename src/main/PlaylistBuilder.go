@@ -0,0 +1,182 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"regexp"
+	"errors"
+	"strconv"
+	"strings"
+	"path/filepath"
+	"encoding/xml"
+)
+
+/*
+  $CACHED_DIR/$PLAYLIST/manifest.mpd
+  $CACHED_DIR/$PLAYLIST/playlist.json
+  One Period per asset, referencing its generated chunks :
+  <BaseURL>../$FILENAME/</BaseURL>
+*/
+
+/* Name of the file describing a playlist, it is listed again on startup */
+const PLAYLIST_DESCRIPTION = "playlist.json"
+
+/* One asset of a playlist, in and out points are in seconds (0 to play the whole asset) */
+type PlaylistItem struct {
+	Name string
+	In   float64
+	Out  float64
+}
+
+/* Ordered list of assets played as one presentation */
+type Playlist struct {
+	Name  string
+	Items []PlaylistItem
+}
+
+/* Structure used to retrieve the Period of a generated manifest */
+type manifestLookup struct {
+	XMLName            xml.Name `xml:"MPD"`
+	Type               string   `xml:"type,attr"`
+	Duration           string   `xml:"mediaPresentationDuration,attr"`
+	MaxSegmentDuration string   `xml:"maxSegmentDuration,attr"`
+	Profiles           string   `xml:"profiles,attr"`
+	Period             struct {
+		Content string `xml:",innerxml"`
+	} `xml:"Period"`
+}
+
+var segmentTimescaleRegexp = regexp.MustCompile(`<(SegmentTemplate|SegmentBase)\s+timescale="([0-9]+)"`)
+var segmentStartRegexp = regexp.MustCompile(`<S t="([0-9]+)"`)
+var presentationTimeOffsetRegexp = regexp.MustCompile(`\s+presentationTimeOffset="([0-9]+)"`)
+
+/* Parse a manifest duration as written by DASHBuilder (PT<seconds>S) */
+func parseManifestSeconds(duration string) float64 {
+	res, _ := strconv.ParseFloat(strings.TrimSuffix(strings.TrimPrefix(duration, "PT"), "S"), 64)
+	return res
+}
+
+/* Format seconds as a manifest duration */
+func formatManifestSeconds(seconds float64) string {
+	return "PT" + strconv.FormatFloat(seconds, 'f', -1, 64) + "S"
+}
+
+/* Read the manifest generated for an asset */
+func readManifestLookup(path string) (*manifestLookup, error) {
+	var manifest manifestLookup
+	f, err := os.Open(path)
+	if err != nil { return nil, err }
+	defer f.Close()
+	err = xml.NewDecoder(f).Decode(&manifest)
+	if err != nil { return nil, err }
+	return &manifest, nil
+}
+
+/*
+ Add presentationTimeOffset to every segment information of a Period content, so
+ that the Period starts at the in point of the asset. An offset already set (as in
+ recordings) is moved by the in point, templates without one start at their first
+ segment and on-demand tracks at 0.
+ */
+func applyPresentationTimeOffset(content string, in float64) string {
+	res := ""
+	last := 0
+	for _, m := range segmentTimescaleRegexp.FindAllStringSubmatchIndex(content, -1) {
+		timescale, _ := strconv.ParseInt(content[m[4]:m[5]], 10, 64)
+		/* Other attributes of the element */
+		end := m[1]
+		if i := strings.Index(content[m[1]:], ">"); i >= 0 {
+			end += i
+		}
+		attributes := content[m[1]:end]
+		start := int64(0)
+		if pto := presentationTimeOffsetRegexp.FindStringSubmatch(attributes); pto != nil {
+			start, _ = strconv.ParseInt(pto[1], 10, 64)
+			attributes = presentationTimeOffsetRegexp.ReplaceAllString(attributes, "")
+		} else if content[m[2]:m[3]] == "SegmentTemplate" {
+			if s := segmentStartRegexp.FindStringSubmatch(content[m[1]:]); s != nil {
+				start, _ = strconv.ParseInt(s[1], 10, 64)
+			}
+		}
+		offset := start + int64(in * float64(timescale))
+		res += content[last:m[1]] + `
+        presentationTimeOffset="` + strconv.FormatInt(offset, 10) + `"` + attributes
+		last = end
+	}
+	return res + content[last:]
+}
+
+/* Build a multi-Period manifest referencing the chunks of each asset of a playlist */
+func buildPlaylistManifest(playlist Playlist, cachedDir string) (string, error) {
+	var profiles []string
+	start := float64(0)
+	maxSegmentDuration := float64(0)
+	periods := ""
+	if len(playlist.Items) == 0 {
+		return "", errors.New("Playlist '" + playlist.Name + "' is empty")
+	}
+	for i, item := range playlist.Items {
+		manifest, err := readManifestLookup(filepath.Join(cachedDir, item.Name, "manifest.mpd"))
+		if err != nil { return "", err }
+		if manifest.Type == "dynamic" {
+			return "", errors.New("Live '" + item.Name + "' can't be used in a playlist")
+		}
+		/* Out point defaults to the end of the asset */
+		out := parseManifestSeconds(manifest.Duration)
+		if item.Out > 0 && item.Out < out {
+			out = item.Out
+		}
+		if item.In < 0 || item.In >= out {
+			return "", errors.New("Invalid in and out points for '" + item.Name + "'")
+		}
+		if d := parseManifestSeconds(manifest.MaxSegmentDuration); d > maxSegmentDuration {
+			maxSegmentDuration = d
+		}
+		for _, profile := range strings.Split(manifest.Profiles, ",") {
+			j := 0
+			for ; j < len(profiles) && profiles[j] != profile; j++ {}
+			if j == len(profiles) && profile != "" {
+				profiles = append(profiles, profile)
+			}
+		}
+		periods += `
+  <Period
+    id="` + strconv.Itoa(i) + `"
+    start="` + formatManifestSeconds(start) + `"
+    duration="` + formatManifestSeconds(out - item.In) + `">
+    <BaseURL>../` + item.Name + `/</BaseURL>` + applyPresentationTimeOffset(manifest.Period.Content, item.In) + `</Period>`
+		start += out - item.In
+	}
+	res := `<?xml version="1.0" encoding="utf-8"?>
+<MPD
+  xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"
+  xmlns="urn:mpeg:dash:schema:mpd:2011"
+  xmlns:cenc="urn:mpeg:cenc:2013"
+  xmlns:mspr="urn:microsoft:playready"
+  xmlns:clearkey="http://dashif.org/guidelines/clearKey"
+  xmlns:dashif="https://dashif.org/CPS"
+  xsi:schemaLocation="urn:mpeg:dash:schema:mpd:2011 http://standards.iso.org/ittf/PubliclyAvailableStandards/MPEG-DASH_schema_files/DASH-MPD.xsd"
+  type="static"
+  mediaPresentationDuration="` + formatManifestSeconds(start) + `"`
+	if maxSegmentDuration > 0 {
+		res += `
+  maxSegmentDuration="` + formatManifestSeconds(maxSegmentDuration) + `"`
+	}
+	res += `
+  profiles="` + strings.Join(profiles, ",") + `">` + periods + `
+</MPD>`
+	return res, nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+  "strings"
+  "testing"
+)
+
+func TestApplyPresentationTimeOffset(t *testing.T) {
+  template := `
+      <SegmentTemplate
+        timescale="1000"
+        initialization="init_$RepresentationID$.mp4"
+        media="chunk_$RepresentationID$_$Time$.mp4">
+        <SegmentTimeline>
+          <S t="5000" d="2000" />
+        </SegmentTimeline>
+      </SegmentTemplate>`
+  recording := `
+      <SegmentTemplate
+        timescale="1000"
+        presentationTimeOffset="3000"
+        media="chunk_$RepresentationID$_$Time$.mp4">
+        <SegmentTimeline>
+          <S t="8000" d="2000" />
+        </SegmentTimeline>
+      </SegmentTemplate>`
+  segmentBase := `
+        <SegmentBase
+          timescale="48000"
+          indexRange="700-800">
+          <Initialization range="0-699" />
+        </SegmentBase>`
+  cases := []struct {
+    name, content string
+    in float64
+    want string
+  }{
+    {"template", template, 0, `presentationTimeOffset="5000"`},
+    {"template with in point", template, 2, `presentationTimeOffset="7000"`},
+    {"recording", recording, 0, `presentationTimeOffset="3000"`},
+    {"recording with in point", recording, 1.5, `presentationTimeOffset="4500"`},
+    {"segment base", segmentBase, 0, `presentationTimeOffset="0"`},
+    {"segment base with in point", segmentBase, 2, `presentationTimeOffset="96000"`},
+  }
+  for _, c := range cases {
+    got := applyPresentationTimeOffset(c.content, c.in)
+    if !strings.Contains(got, c.want) || strings.Count(got, "presentationTimeOffset") != 1 {
+      t.Errorf("%s: want one %s, got\n%s", c.name, c.want, got)
+    }
+    /* Other attributes are kept */
+    if strings.Contains(c.content, "media=") != strings.Contains(got, `media="chunk_$RepresentationID$_$Time$.mp4">`) {
+      t.Errorf("%s: attributes lost, got\n%s", c.name, got)
+    }
+  }
+  /* Each track of a Period gets its own offset */
+  got := applyPresentationTimeOffset(template + segmentBase, 1)
+  if !strings.Contains(got, `presentationTimeOffset="6000"`) || !strings.Contains(got, `presentationTimeOffset="48000"`) {
+    t.Errorf("bad offsets of a Period with several tracks, got\n%s", got)
+  }
+}
@@ -0,0 +1,381 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"math"
+	"errors"
+	"utils"
+	"parser"
+	"regexp"
+	"strconv"
+	"path/filepath"
+	"encoding/xml"
+	"encoding/binary"
+)
+
+/*
+  $CACHED_DIR/$FILENAME/Manifest
+  Fragments are served from DASH chunks :
+  /smooth/$FILENAME/QualityLevels($BITRATE)/Fragments(video=$TIME) -> chunk_video0_$TIME.mp4
+*/
+
+const SMOOTH_MANIFEST = "Manifest"
+
+/* Smooth default timescale, used for presentation duration */
+const SMOOTH_TIMESCALE = 10000000
+
+var smoothQualityRegexp = regexp.MustCompile(`^QualityLevels\(([0-9]+)\)$`)
+var smoothFragmentRegexp = regexp.MustCompile(`^Fragments\(([a-z]+)=([0-9]+)\)$`)
+
+/* Structures used to find a track from a fragment request in a generated manifest */
+type smoothAttribute struct {
+	Name  string `xml:"Name,attr"`
+	Value string `xml:"Value,attr"`
+}
+
+type smoothQualityLookup struct {
+	Bitrate    int               `xml:"Bitrate,attr"`
+	Attributes []smoothAttribute `xml:"CustomAttributes>Attribute"`
+}
+
+type smoothStreamLookup struct {
+	Name      string                `xml:"Name,attr"`
+	Qualities []smoothQualityLookup `xml:"QualityLevel"`
+}
+
+type smoothManifestLookup struct {
+	XMLName xml.Name             `xml:"SmoothStreamingMedia"`
+	Streams []smoothStreamLookup `xml:"StreamIndex"`
+}
+
+/* Build one StreamIndex element for all tracks of a type */
+func (b *DASHBuilder) buildSmoothStreamIndex(tracks []*parser.Track, name string) string {
+	first := tracks[0]
+	res := `
+  <StreamIndex
+    Type="` + name + `"
+    Name="` + name + `"
+    Chunks="` + strconv.Itoa(first.ChunksCount()) + `"
+    QualityLevels="` + strconv.Itoa(len(tracks)) + `"
+    TimeScale="` + strconv.Itoa(first.Timescale()) + `"
+    Url="QualityLevels({bitrate})/Fragments(` + name + `={start time})"`
+	if !first.IsAudio() {
+		res += `
+    MaxWidth="` + strconv.Itoa(first.Width()) + `"
+    MaxHeight="` + strconv.Itoa(first.Height()) + `"
+    DisplayWidth="` + strconv.Itoa(first.Width()) + `"
+    DisplayHeight="` + strconv.Itoa(first.Height()) + `"`
+	}
+	res += `>`
+	for i := 0; i < len(tracks); i++ {
+		res += tracks[i].BuildSmoothQualityLevel(i)
+	}
+	/* Chunks are aligned between tracks of a same type */
+	res += first.BuildSmoothChunks()
+	return res + `
+  </StreamIndex>`
+}
+
+/* Build Smooth client manifest as a string */
+func (b *DASHBuilder) buildSmoothManifest(isLive bool) string {
+	var videos []*parser.Track
+	var audios []*parser.Track
+	if b.manifestInfos == nil {
+		b.manifestInfos = b.computeManifestInfos()
+	}
+	for i := 0; i < len(b.tracks); i++ {
+		/* Text and trick mode tracks are not available in Smooth output */
+		if b.tracks[i].IsText() || b.tracks[i].IsTrickMode() {
+			continue
+		} else if b.tracks[i].IsAudio() {
+			audios = append(audios, b.tracks[i])
+		} else {
+			videos = append(videos, b.tracks[i])
+		}
+	}
+	manifest := `<?xml version="1.0" encoding="utf-8"?>
+<SmoothStreamingMedia
+  MajorVersion="2"
+  MinorVersion="2"`
+	if isLive {
+		window := math.MaxFloat64
+		for i := 0; i < len(b.tracks); i++ {
+			if !b.tracks[i].IsText() && b.tracks[i].WindowDuration() < window {
+				window = b.tracks[i].WindowDuration()
+			}
+		}
+		manifest += `
+  Duration="0"
+  IsLive="TRUE"
+  LookaheadCount="0"
+  DVRWindowLength="` + strconv.FormatInt(int64(window * SMOOTH_TIMESCALE), 10) + `">`
+	} else {
+		manifest += `
+  Duration="` + strconv.FormatInt(int64(b.manifestInfos.duration * SMOOTH_TIMESCALE), 10) + `">`
+	}
+	if len(videos) > 0 {
+		manifest += b.buildSmoothStreamIndex(videos, "video")
+	}
+	if len(audios) > 0 {
+		manifest += b.buildSmoothStreamIndex(audios, "audio")
+	}
+	/* Tracks share the same protection, use first PlayReady header found */
+	for i := 0; i < len(b.tracks); i++ {
+		header := b.tracks[i].SmoothProtectionHeader()
+		if header != "" {
+			manifest += `
+  <Protection>
+    <ProtectionHeader SystemID="9A04F079-9840-4286-AB92-E65BE0885F95">` + header + `</ProtectionHeader>
+  </Protection>`
+			break
+		}
+	}
+	return manifest + `
+</SmoothStreamingMedia>
+`
+}
+
+/* Write Smooth client manifest next to the DASH manifest */
+func (b *DASHBuilder) writeSmoothManifest(outPath string, isLive bool) error {
+	return writeStringToFile(filepath.Join(outPath, SMOOTH_MANIFEST), b.buildSmoothManifest(isLive))
+}
+
+/* Return name of the DASH chunk matching a Smooth fragment request, using the generated manifest */
+func smoothChunkName(manifestPath string, quality string, fragment string) (string, error) {
+	var manifest smoothManifestLookup
+	qualityMatch := smoothQualityRegexp.FindStringSubmatch(quality)
+	fragmentMatch := smoothFragmentRegexp.FindStringSubmatch(fragment)
+	if qualityMatch == nil || fragmentMatch == nil {
+		return "", errors.New("Invalid Smooth fragment request '" + quality + "/" + fragment + "'")
+	}
+	bitrate, _ := strconv.Atoi(qualityMatch[1])
+	f, err := os.Open(manifestPath)
+	if err != nil { return "", err }
+	defer f.Close()
+	err = xml.NewDecoder(f).Decode(&manifest)
+	if err != nil { return "", err }
+	for i := 0; i < len(manifest.Streams); i++ {
+		if manifest.Streams[i].Name != fragmentMatch[1] {
+			continue
+		}
+		for _, q := range manifest.Streams[i].Qualities {
+			if q.Bitrate != bitrate {
+				continue
+			}
+			for _, attr := range q.Attributes {
+				if attr.Name == "RepresentationID" {
+					return "chunk_" + attr.Value + "_" + fragmentMatch[2] + ".mp4", nil
+				}
+			}
+		}
+	}
+	return "", errors.New("No Smooth fragment for '" + quality + "/" + fragment + "'")
+}
+
+/* PIFF extended types of the sample encryption and fragment time (tfxd) uuid atoms */
+var piffSampleEncryptionType = []byte{
+	0xa2, 0x39, 0x4f, 0x52, 0x5a, 0x9b, 0x4f, 0x14, 0xa2, 0x44, 0x6c, 0x42, 0x7c, 0x64, 0x8d, 0xf4,
+}
+var piffFragmentTimeType = []byte{
+	0x6d, 0x1d, 0x9b, 0x05, 0x42, 0xd5, 0x44, 0xe6, 0x80, 0xe2, 0x14, 0x1d, 0xaf, 0xf7, 0x57, 0xb2,
+}
+
+/* Split consecutive atoms, a truncated atom ends the list */
+func splitAtoms(data []byte) [][]byte {
+	var res [][]byte
+	offset := 0
+	for offset + 8 <= len(data) {
+		size := int(binary.BigEndian.Uint32(data[offset:offset + 4]))
+		if size < 8 || offset + size > len(data) {
+			break
+		}
+		res = append(res, data[offset:offset + size])
+		offset += size
+	}
+	return res
+}
+
+/* Return default sample duration of a tfhd atom, 0 if not given */
+func tfhdDefaultDuration(tfhd []byte) uint32 {
+	if len(tfhd) < 16 { return 0 }
+	flags := binary.BigEndian.Uint32(tfhd[8:12]) & 0xFFFFFF
+	offset := 16
+	if flags & 0x1 != 0 { offset += 8 }
+	if flags & 0x2 != 0 { offset += 4 }
+	if flags & 0x8 == 0 || offset + 4 > len(tfhd) { return 0 }
+	return binary.BigEndian.Uint32(tfhd[offset:offset + 4])
+}
+
+/* Return base media decode time of a tfdt atom */
+func tfdtTime(tfdt []byte) uint64 {
+	if len(tfdt) >= 20 && tfdt[8] == 1 {
+		return binary.BigEndian.Uint64(tfdt[12:20])
+	} else if len(tfdt) >= 16 {
+		return uint64(binary.BigEndian.Uint32(tfdt[12:16]))
+	}
+	return 0
+}
+
+/* Return duration of the samples of a trun atom */
+func trunDuration(trun []byte, defaultDuration uint32) uint64 {
+	var res uint64
+	if len(trun) < 16 { return 0 }
+	flags := binary.BigEndian.Uint32(trun[8:12]) & 0xFFFFFF
+	count := int(binary.BigEndian.Uint32(trun[12:16]))
+	if flags & 0x100 == 0 {
+		return uint64(count) * uint64(defaultDuration)
+	}
+	offset := 16
+	if flags & 0x1 != 0 { offset += 4 }
+	if flags & 0x4 != 0 { offset += 4 }
+	sampleSize := 0
+	for _, flag := range []uint32{0x100, 0x200, 0x400, 0x800} {
+		if flags & flag != 0 { sampleSize += 4 }
+	}
+	for i := 0; i < count && offset + 4 <= len(trun); i++ {
+		res += uint64(binary.BigEndian.Uint32(trun[offset:offset + 4]))
+		offset += sampleSize
+	}
+	return res
+}
+
+/* Move data offset of a trun atom */
+func moveTRUNOffset(trun []byte, delta int) {
+	if len(trun) < 20 || binary.BigEndian.Uint32(trun[8:12]) & 0x1 == 0 { return }
+	offset := int32(binary.BigEndian.Uint32(trun[16:20])) + int32(delta)
+	binary.BigEndian.PutUint32(trun[16:20], uint32(offset))
+}
+
+/* Move offsets of a saio atom */
+func moveSAIOOffsets(saio []byte, delta int) {
+	if len(saio) < 16 { return }
+	version := saio[8]
+	offset := 12
+	if binary.BigEndian.Uint32(saio[8:12]) & 0x1 != 0 { offset += 8 }
+	if offset + 4 > len(saio) { return }
+	count := int(binary.BigEndian.Uint32(saio[offset:offset + 4]))
+	offset += 4
+	for i := 0; i < count; i++ {
+		if version == 1 && offset + 8 <= len(saio) {
+			binary.BigEndian.PutUint64(saio[offset:offset + 8], binary.BigEndian.Uint64(saio[offset:offset + 8]) + uint64(delta))
+			offset += 8
+		} else if version == 0 && offset + 4 <= len(saio) {
+			binary.BigEndian.PutUint32(saio[offset:offset + 4], binary.BigEndian.Uint32(saio[offset:offset + 4]) + uint32(delta))
+			offset += 4
+		}
+	}
+}
+
+/*
+ Build PIFF atoms of a traf : a sample encryption atom (same content as senc) for
+ encrypted samples, the fragment time and duration (tfxd) for live streams.
+ */
+func buildPIFFAtoms(traf []byte, isLive bool) ([]byte, error) {
+	var res []byte
+	var time, duration uint64
+	var defaultDuration uint32
+	for _, atom := range splitAtoms(traf[8:]) {
+		switch string(atom[4:8]) {
+		case "tfhd":
+			defaultDuration = tfhdDefaultDuration(atom)
+		case "tfdt":
+			time = tfdtTime(atom)
+		case "trun":
+			duration += trunDuration(atom, defaultDuration)
+		case "senc":
+			b, err := utils.BuildAtom("uuid", append(append([]byte{}, piffSampleEncryptionType...), atom[8:]...))
+			if err != nil { return nil, err }
+			res = append(res, b...)
+		}
+	}
+	if isLive {
+		content := append(append([]byte{}, piffFragmentTimeType...), 0x1, 0x0, 0x0, 0x0)
+		content = append(content, make([]byte, 16)...)
+		binary.BigEndian.PutUint64(content[20:28], time)
+		binary.BigEndian.PutUint64(content[28:36], duration)
+		b, err := utils.BuildAtom("uuid", content)
+		if err != nil { return nil, err }
+		res = append(res, b...)
+	}
+	return res, nil
+}
+
+/*
+ Add PIFF atoms at the end of the trafs of a moof. Samples offsets (trun) follow the
+ moof and move by all the added bytes, sample auxiliary information offsets (saio)
+ by the bytes added in the previous trafs.
+ */
+func buildSmoothMOOF(moof []byte, isLive bool) ([]byte, error) {
+	var content []byte
+	var piff [][]byte
+	total := 0
+	children := splitAtoms(moof[8:])
+	for _, child := range children {
+		if string(child[4:8]) == "traf" {
+			b, err := buildPIFFAtoms(child, isLive)
+			if err != nil { return nil, err }
+			piff = append(piff, b)
+			total += len(b)
+		}
+	}
+	previous := 0
+	for _, child := range children {
+		if string(child[4:8]) != "traf" {
+			content = append(content, child...)
+			continue
+		}
+		var traf []byte
+		for _, atom := range splitAtoms(child[8:]) {
+			atom = append([]byte{}, atom...)
+			switch string(atom[4:8]) {
+			case "trun":
+				moveTRUNOffset(atom, total)
+			case "saio":
+				moveSAIOOffsets(atom, previous)
+			}
+			traf = append(traf, atom...)
+		}
+		added := piff[0]
+		piff = piff[1:]
+		b, err := utils.BuildAtom("traf", append(traf, added...))
+		if err != nil { return nil, err }
+		content = append(content, b...)
+		previous += len(added)
+	}
+	return utils.BuildAtom("moof", content)
+}
+
+/*
+ Build a Smooth fragment from a DASH chunk : styp, free and sidx atoms are removed,
+ fragments start with moof, and PIFF atoms are added to the moof.
+ */
+func smoothFragment(chunk []byte, isLive bool) ([]byte, error) {
+	offset := 0
+	for offset + 8 <= len(chunk) {
+		size := int(binary.BigEndian.Uint32(chunk[offset:offset + 4]))
+		if size < 8 || offset + size > len(chunk) {
+			break
+		}
+		if string(chunk[offset + 4:offset + 8]) == "moof" {
+			moof, err := buildSmoothMOOF(chunk[offset:offset + size], isLive)
+			if err != nil { return nil, err }
+			return append(moof, chunk[offset + size:]...), nil
+		}
+		offset += size
+	}
+	return nil, errors.New("No moof atom found in chunk")
+}
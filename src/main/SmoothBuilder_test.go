@@ -0,0 +1,104 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+  "bytes"
+  "utils"
+  "testing"
+  "encoding/binary"
+)
+
+func testAtom(t *testing.T, tag string, content ...[]byte) []byte {
+  b, err := utils.BuildAtom(tag, bytes.Join(content, nil))
+  if err != nil {
+    t.Fatalf("got error in BuildAtom %q", err)
+  }
+  return b
+}
+
+/* Return first atom of a path (ex: moof/traf/trun) */
+func findAtom(data []byte, path ...string) []byte {
+  for _, atom := range splitAtoms(data) {
+    if string(atom[4:8]) != path[0] {
+      continue
+    }
+    if len(path) == 1 {
+      return atom
+    }
+    return findAtom(atom[8:], path[1:]...)
+  }
+  return nil
+}
+
+func TestSmoothFragment(t *testing.T) {
+  sencContent := []byte{
+    0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x2,
+    0x1, 0x1, 0x1, 0x1, 0x1, 0x1, 0x1, 0x1,
+    0x2, 0x2, 0x2, 0x2, 0x2, 0x2, 0x2, 0x2,
+  }
+  moof := testAtom(t, "moof",
+    testAtom(t, "mfhd", []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1}),
+    testAtom(t, "traf",
+      testAtom(t, "tfhd", []byte{0x0, 0x2, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1}),
+      testAtom(t, "tfdt", []byte{0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0xe8}),
+      testAtom(t, "trun", []byte{
+        0x0, 0x0, 0x1, 0x1, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x0,
+        0x0, 0x0, 0x0, 0x64, 0x0, 0x0, 0x0, 0x32,
+      }),
+      testAtom(t, "senc", sencContent),
+      testAtom(t, "saio", []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x50}),
+    ),
+  )
+  /* Samples start after the moof header of the mdat */
+  binary.BigEndian.PutUint32(findAtom(moof, "moof", "traf", "trun")[16:20], uint32(len(moof) + 8))
+  mdat := testAtom(t, "mdat", []byte{0xa, 0xb, 0xc})
+  chunk := bytes.Join([][]byte{testAtom(t, "styp", []byte("msdh")), moof, mdat}, nil)
+
+  for _, isLive := range []bool{false, true} {
+    fragment, err := smoothFragment(chunk, isLive)
+    if err != nil {
+      t.Fatalf("got error in smoothFragment %q", err)
+    }
+    if string(fragment[4:8]) != "moof" || !bytes.HasSuffix(fragment, mdat) {
+      t.Fatalf("fragment should be the moof and the mdat")
+    }
+    out := findAtom(fragment, "moof")
+    var sampleEncryption, fragmentTime []byte
+    for _, atom := range splitAtoms(findAtom(out[8:], "traf")[8:]) {
+      if string(atom[4:8]) == "uuid" && bytes.Equal(atom[8:24], piffSampleEncryptionType) {
+        sampleEncryption = atom
+      } else if string(atom[4:8]) == "uuid" && bytes.Equal(atom[8:24], piffFragmentTimeType) {
+        fragmentTime = atom
+      }
+    }
+    if !bytes.Equal(sampleEncryption[24:], sencContent) {
+      t.Errorf("bad PIFF sample encryption. got %x", sampleEncryption)
+    }
+    if (fragmentTime != nil) != isLive {
+      t.Errorf("tfxd should only be written for live streams")
+    }
+    if isLive && (binary.BigEndian.Uint64(fragmentTime[28:36]) != 1000 || binary.BigEndian.Uint64(fragmentTime[36:44]) != 150) {
+      t.Errorf("bad tfxd time and duration. got %x", fragmentTime[24:])
+    }
+    dataOffset := binary.BigEndian.Uint32(findAtom(out, "moof", "traf", "trun")[16:20])
+    if int(dataOffset) != len(out) + 8 {
+      t.Errorf("bad trun data offset. want %d, got %d", len(out) + 8, dataOffset)
+    }
+    if saio := findAtom(out, "moof", "traf", "saio"); binary.BigEndian.Uint32(saio[16:20]) != 0x50 {
+      t.Errorf("saio offset of the first traf should not move. got %x", saio[16:20])
+    }
+  }
+}
@@ -15,6 +15,7 @@
 package parser
 
 import "utils"
+import "errors"
 import "encoding/hex"
 
 /* Function type used for atom generation */
@@ -54,7 +55,11 @@ func buildSTBL(t Track) ([]byte, error) {
 func buildMINF(t Track) ([]byte, error) {
 	var b []byte
 	var err error
-	if t.isAudio {
+	if t.isText && t.fourcc == TEXT_FORMAT_STPP {
+		b, err = t.buildAtoms("dinf", "stbl", "sthd")
+	} else if t.isText {
+		b, err = t.buildAtoms("dinf", "stbl", "nmhd")
+	} else if t.isAudio {
 		b, err = t.buildAtoms("dinf", "stbl", "smhd")
 	} else {
 		b, err = t.buildAtoms("dinf", "stbl", "vmhd")
@@ -81,19 +86,34 @@ func buildMVEX(t Track) ([]byte, error) {
 	return utils.BuildAtom("mvex", b)
 }
 
-func buildPSSH(systemId string, privateData []byte) ([]byte, error) {
-	b, err := hex.DecodeString(systemId)
+func buildPSSH(p pss) ([]byte, error) {
+	b, err := hex.DecodeString(p.systemId)
 	if err != nil { return nil, err }
-	size := len(privateData)
+	/* Version 1 lists the key ids */
+	version := byte(0)
+	if len(p.keyIds) > 0 {
+		version = 1
+		count := len(p.keyIds)
+		b = append(b, []byte{
+			byte((count >> 24) & 0xFF),
+			byte((count >> 16) & 0xFF),
+			byte((count >> 8) & 0xFF),
+			byte((count) & 0xFF),
+		}...)
+		for _, keyId := range p.keyIds {
+			b = append(b, keyId...)
+		}
+	}
+	size := len(p.privateData)
 	b = append(b, []byte{
 		byte((size >> 24) & 0xFF),
 		byte((size >> 16) & 0xFF),
 		byte((size >> 8) & 0xFF),
 		byte((size) & 0xFF),
 	}...)
-	b = append(b, privateData...)
+	b = append(b, p.privateData...)
 	return utils.BuildAtom("pssh", append([]byte{
-		0x0, 0x0, 0x0, 0x0,
+		version, 0x0, 0x0, 0x0,
 	}, b...))
 }
 
@@ -102,7 +122,7 @@ func buildMOOV(t Track) ([]byte, error) {
 	if err != nil { return nil, err }
 	if t.encryptInfos != nil {
 		for i := 0; i < len(t.encryptInfos.pssList); i++ {
-			pssh, err := buildPSSH(t.encryptInfos.pssList[i].systemId, t.encryptInfos.pssList[i].privateData)
+			pssh, err := buildPSSH(t.encryptInfos.pssList[i])
 			if err != nil { return nil, err }
 			b = append(b, pssh...)
 		}
@@ -220,6 +240,16 @@ func buildSAIO(t Track) ([]byte, error) {
 func buildTENC(t Track) ([]byte, error) {
 	b, err := hex.DecodeString(t.encryptInfos.keyId)
 	if err != nil { return nil, err }
+	/* Pattern encryption uses version 1, samples share a constant IV */
+	if t.encryptInfos.scheme == ENCRYPTION_SCHEME_CBCS {
+		b = append([]byte{
+			0x1, 0x0, 0x0, 0x0, 0x0,
+			byte((t.encryptInfos.cryptBlocks << 4) | t.encryptInfos.skipBlocks),
+			0x1, 0x0,
+		}, b...)
+		b = append(b, byte(len(t.encryptInfos.iv)))
+		return utils.BuildAtom("tenc", append(b, t.encryptInfos.iv...))
+	}
 	return utils.BuildAtom("tenc", append([]byte{
 		0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
 		0x1, 0x8,
@@ -233,19 +263,22 @@ func buildSCHI(t Track) ([]byte, error) {
 }
 
 func buildSCHM(t Track) ([]byte, error) {
-	return utils.BuildAtom("schm", []byte{
-		0x0, 0x0, 0x0, 0x0,
-		byte('c'), byte('e'), byte('n'), byte('c'),
+	scheme := t.encryptInfos.scheme
+	if scheme == "" {
+		scheme = ENCRYPTION_SCHEME_CENC
+	}
+	b := append([]byte{ 0x0, 0x0, 0x0, 0x0 }, []byte(scheme)...)
+	return utils.BuildAtom("schm", append(b, []byte{
 		0x0, 0x1, 0x0, 0x0,
-	})
+	}...))
 }
 
 func buildFRMA(t Track) ([]byte, error) {
 	var name string
 	if t.isAudio {
-		name = "mp4a"
+		name = t.audioFourCC()
 	} else {
-		name = "avc1"
+		name = t.videoFourCC()
 	}
 	return utils.BuildAtom("frma", []byte(name))
 }
@@ -260,17 +293,40 @@ func buildAVCC(t Track) ([]byte, error) {
 	return utils.BuildAtom("avcC", t.extradata)
 }
 
-func buildAVC1ENCV(t Track) ([]byte, error) {
+func buildHVCC(t Track) ([]byte, error) {
+	return utils.BuildAtom("hvcC", t.extradata)
+}
+
+func buildPASP(t Track) ([]byte, error) {
+	return utils.BuildAtom("pasp", []byte{
+		/* Horizontal spacing */
+		byte((t.sarNum >> 24) & 0xFF), byte((t.sarNum >> 16) & 0xFF),
+		byte((t.sarNum >> 8) & 0xFF), byte((t.sarNum) & 0xFF),
+		/* Vertical spacing */
+		byte((t.sarDen >> 24) & 0xFF), byte((t.sarDen >> 16) & 0xFF),
+		byte((t.sarDen >> 8) & 0xFF), byte((t.sarDen) & 0xFF),
+	})
+}
+
+func buildVisualSampleEntry(t Track) ([]byte, error) {
 	var b []byte
 	var err error
 	var name string
+	atoms := []string{"avcC"}
+	if t.isHEVC() {
+		atoms = []string{"hvcC"}
+	}
+	/* Non square pixels */
+	if t.sarNum > 0 && t.sarDen > 0 && t.sarNum != t.sarDen {
+		atoms = append(atoms, "pasp")
+	}
 	if t.encryptInfos == nil {
-		name = "avc1"
-		b, err = t.buildAtoms("avcC")
+		name = t.videoFourCC()
 	} else {
 		name = "encv"
-		b, err = t.buildAtoms("avcC", "sinf")
+		atoms = append(atoms, "sinf")
 	}
+	b, err = t.buildAtoms(atoms...)
 	if err != nil { return nil, err }
 	return utils.BuildAtom(name, append([]byte{
 		/* Reserved */
@@ -325,16 +381,35 @@ func buildESDS(t Track) ([]byte, error) {
 	return utils.BuildAtom("esds",  data)
 }
 
-func buildMP4AENCA(t Track) ([]byte, error) {
+func buildDAC3(t Track) ([]byte, error) {
+	return utils.BuildAtom("dac3", t.extradata)
+}
+
+func buildDEC3(t Track) ([]byte, error) {
+	return utils.BuildAtom("dec3", t.extradata)
+}
+
+func buildAudioSampleEntry(t Track) ([]byte, error) {
 	var b []byte
 	var err error
 	var name string
+	config := "esds"
+	if t.fourcc == "ac-3" {
+		config = "dac3"
+	} else if t.fourcc == "ec-3" {
+		config = "dec3"
+	}
+	/* Channel count is ignored for Dolby audio, channels are declared in dac3/dec3 */
+	channels := 2
+	if !t.isDolby() {
+		channels = t.channelCount()
+	}
 	if t.encryptInfos == nil {
-		name = "mp4a"
-		b, err = t.buildAtoms("esds")
+		name = t.audioFourCC()
+		b, err = t.buildAtoms(config)
 	} else {
 		name = "enca"
-		b, err = t.buildAtoms("esds", "sinf")
+		b, err = t.buildAtoms(config, "sinf")
 	}
 	if err != nil { return nil, err }
 	return utils.BuildAtom(name, append([]byte{
@@ -349,7 +424,7 @@ func buildMP4AENCA(t Track) ([]byte, error) {
 		/* Vendor */
 		0x0, 0x0, 0x0, 0x0,
 		/* channels */
-		0x0, 0x2,
+		byte((channels >> 8) & 0xFF), byte((channels) & 0xFF),
 		/* Sample size */
 		0x0, 0x10,
 		/* Compression ID */
@@ -366,11 +441,13 @@ func buildMP4AENCA(t Track) ([]byte, error) {
 func buildSTSD(t Track) ([]byte, error) {
 	var b []byte
 	var err error
-	if t.encryptInfos == nil {
+	if t.isText {
+		b, err = t.buildAtoms(t.fourcc)
+	} else if t.encryptInfos == nil {
 		if t.isAudio {
-			b, err = t.buildAtoms("mp4a")
+			b, err = t.buildAtoms(t.audioFourCC())
 		} else {
-			b, err = t.buildAtoms("avc1")
+			b, err = t.buildAtoms(t.videoFourCC())
 		}
 	} else {
 		if t.isAudio {
@@ -506,7 +583,7 @@ func buildTKHD(t Track) ([]byte, error) {
 		0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
 		0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x4, 0x0, 0x0, 0x0,
 		/* Width */
-		byte((t.width >> 8) & 0xFF), byte((t.width) & 0xFF), 0x0, 0x0,
+		byte((t.displayWidth() >> 8) & 0xFF), byte((t.displayWidth()) & 0xFF), 0x0, 0x0,
  		/* Height */
 		byte((t.height >> 8) & 0xFF), byte((t.height) & 0xFF), 0x0, 0x0,
 	})
@@ -537,21 +614,29 @@ func buildMDHD (t Track) ([]byte, error) {
 		byte((t.duration >> 8) & 0xFF),
 		byte((t.duration) & 0xFF),
 		/* Language */
-		0x55, 0xC4, 0x0, 0x0,
+		byte((t.packedLanguage() >> 8) & 0xFF),
+		byte((t.packedLanguage()) & 0xFF),
+		0x0, 0x0,
 	})
 }
 
 func buildHDLR (t Track) ([]byte, error) {
 	var handler uint32
 	var name string
-	if t.isAudio {
+	if t.isText && t.fourcc == TEXT_FORMAT_STPP {
+		handler = 0x73756274
+		name = "SubtitleHandler"
+	} else if t.isText {
+		handler = 0x74657874
+		name = "TextHandler"
+	} else if t.isAudio {
 		handler = 0x736f756e
 		name = "SoundHandler"
 	} else {
 		handler = 0x76696465
 		name = "VideoHandler"
 	}
-	return utils.BuildAtom("hdlr", []byte{
+	return utils.BuildAtom("hdlr", append([]byte{
 		/* Flags + version */
 		0x0, 0x0, 0x0, 0x0,
 		/* Predefined */
@@ -561,10 +646,8 @@ func buildHDLR (t Track) ([]byte, error) {
 		byte((handler >> 8) & 0xFF), byte((handler) & 0xFF),
 		/* Reserved */
 		0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
-		/* Name */
-		name[0], name[1], name[2], name[3], name[4], name[5], name[6],
-		name[7], name[8], name[9], name[10], name[11], 0x0,
-	})
+	/* Name */
+	}, append([]byte(name), 0x0)...))
 }
 
 func buildDREF(t Track) ([]byte, error) {
@@ -599,6 +682,49 @@ func buildSMHD(t Track) ([]byte, error) {
 	})
 }
 
+func buildNMHD(t Track) ([]byte, error) {
+	return utils.BuildAtom("nmhd", []byte{
+		/* Flags + version */
+		0x0, 0x0, 0x0, 0x0,
+	})
+}
+
+func buildSTHD(t Track) ([]byte, error) {
+	return utils.BuildAtom("sthd", []byte{
+		/* Flags + version */
+		0x0, 0x0, 0x0, 0x0,
+	})
+}
+
+func buildVTTC(t Track) ([]byte, error) {
+	return utils.BuildAtom("vttC", []byte("WEBVTT"))
+}
+
+func buildWVTT(t Track) ([]byte, error) {
+	b, err := t.buildAtoms("vttC")
+	if err != nil { return nil, err }
+	return utils.BuildAtom("wvtt", append([]byte{
+		/* Reserved */
+		0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
+		/* index */
+		0x0, 0x1,
+	}, b...))
+}
+
+func buildSTPP(t Track) ([]byte, error) {
+	b := []byte{
+		/* Reserved */
+		0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
+		/* index */
+		0x0, 0x1,
+	}
+	/* Namespace */
+	b = append(b, []byte("http://www.w3.org/ns/ttml")...)
+	/* Empty schema location and auxiliary mime types */
+	b = append(b, 0x0, 0x0, 0x0)
+	return utils.BuildAtom("stpp", b)
+}
+
 func buildMFHD(t Track) ([]byte, error) {
 	return utils.BuildAtom("mfhd", []byte{
 		/* Flags + version */
@@ -673,6 +799,62 @@ func buildSIDX(t Track) ([]byte, error) {
 	return res, err
 }
 
+func buildOnDemandSIDX(t Track) ([]byte, error) {
+	count := len(t.chunksSize)
+	if len(t.chunksDuration) < count {
+		count = len(t.chunksDuration)
+	}
+	if count > 0xFFFF {
+		return nil, errors.New("Too many fragments to index in one sidx")
+	}
+	b := []byte{
+		/* Flags + version */
+		0x1, 0x0, 0x0, 0x0,
+		/* Reference id */
+		0x0, 0x0, 0x0, 0x1,
+		/* Timescale */
+		byte((t.timescale >> 24) & 0xFF),
+		byte((t.timescale >> 16) & 0xFF),
+		byte((t.timescale >> 8) & 0xFF),
+		byte((t.timescale) & 0xFF),
+		/* Earliest presentation time */
+		byte((t.earliestTime >> 56) & 0xFF),
+		byte((t.earliestTime >> 48) & 0xFF),
+		byte((t.earliestTime >> 40) & 0xFF),
+		byte((t.earliestTime >> 32) & 0xFF),
+		byte((t.earliestTime >> 24) & 0xFF),
+		byte((t.earliestTime >> 16) & 0xFF),
+		byte((t.earliestTime >> 8) & 0xFF),
+		byte((t.earliestTime) & 0xFF),
+		/* First Offset : fragments follow the sidx */
+		0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
+		/* Reserved */
+		0x0, 0x0,
+		/* Reference count */
+		byte((count >> 8) & 0xFF),
+		byte((count) & 0xFF),
+	}
+	for i := 0; i < count; i++ {
+		size := t.chunksSize[i]
+		duration := t.chunksDuration[i]
+		b = append(b, []byte{
+			/* Reference type + reference size*/
+			byte((size >> 24) & 0x7F),
+			byte((size >> 16) & 0xFF),
+			byte((size >> 8) & 0xFF),
+			byte((size) & 0xFF),
+			/* Subsegment duration */
+			byte((duration >> 24) & 0xFF),
+			byte((duration >> 16) & 0xFF),
+			byte((duration >> 8) & 0xFF),
+			byte((duration) & 0xFF),
+			/* Starts with SAP + SAP type + SAP delta time  */
+			0x90, 0x0, 0x0, 0x0,
+		}...)
+	}
+	return utils.BuildAtom("sidx", b)
+}
+
 func buildTFHD(t Track) ([]byte, error) {
 	return utils.BuildAtom("tfhd", []byte{
 		/* Flags + version */
@@ -0,0 +1,53 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import "testing"
+
+func TestOnDemandSIDX(t *testing.T) {
+  track := Track{
+    timescale: 1000,
+    earliestTime: 40,
+    chunksSize: []int{1000, 2000},
+    chunksDuration: []int64{2000, 1500},
+  }
+
+  b, err := buildOnDemandSIDX(track)
+  if err != nil {
+    t.Fatalf("got error in buildOnDemandSIDX %q", err)
+  }
+  /* Header (8) + fixed fields (32) + 12 bytes per reference */
+  if len(b) != 8 + 32 + 2 * 12 {
+    t.Fatalf("bad sidx size. want %d, got %d", 8 + 32 + 2 * 12, len(b))
+  }
+  if b[39] != 2 {
+    t.Errorf("bad reference count. want 2, got %d", b[39])
+  }
+  cases := []struct {
+    offset, want int
+  }{
+    {27, 40},
+    {43, 1000 & 0xFF},
+    {42, 1000 >> 8},
+    {47, 2000 & 0xFF},
+    {55, 2000 & 0xFF},
+    {59, 1500 & 0xFF},
+  }
+  for _, c := range cases {
+    if int(b[c.offset]) != c.want {
+      t.Errorf("bad sidx byte %d. want %d, got %d", c.offset, c.want, b[c.offset])
+    }
+  }
+}
@@ -0,0 +1,795 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"fmt"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+/* HEVC NAL unit types stored in hvcC */
+const (
+	HEVC_NAL_VPS = 32
+	HEVC_NAL_SPS = 33
+	HEVC_NAL_PPS = 34
+)
+
+/* Structure used to read a RBSP bit by bit */
+type bitReader struct {
+	data   []byte
+	offset int
+}
+
+/* Read n bits (n <= 32) */
+func (r *bitReader) readBits(n int) (int, error) {
+	res := 0
+	for i := 0; i < n; i++ {
+		if r.offset >= len(r.data) * 8 {
+			return 0, errors.New("Not enough data in bitstream")
+		}
+		bit := (r.data[r.offset / 8] >> uint(7 - r.offset % 8)) & 0x1
+		res = (res << 1) | int(bit)
+		r.offset++
+	}
+	return res, nil
+}
+
+/* Skip n bits */
+func (r *bitReader) skipBits(n int) {
+	r.offset += n
+}
+
+/* Return number of bits not read yet */
+func (r *bitReader) bitsLeft() int {
+	return len(r.data) * 8 - r.offset
+}
+
+/* Read an unsigned exp-golomb code */
+func (r *bitReader) readUE() (int, error) {
+	zeros := 0
+	for {
+		bit, err := r.readBits(1)
+		if err != nil { return 0, err }
+		if bit == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, errors.New("Invalid exp-golomb code")
+		}
+	}
+	val, err := r.readBits(zeros)
+	if err != nil { return 0, err }
+	return (1 << uint(zeros)) - 1 + val, nil
+}
+
+/* Remove emulation prevention bytes from a NAL unit */
+func nalToRBSP(nal []byte) []byte {
+	var res []byte
+	zeros := 0
+	for i := 0; i < len(nal); i++ {
+		if zeros >= 2 && nal[i] == 0x3 {
+			zeros = 0
+			continue
+		}
+		if nal[i] == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		res = append(res, nal[i])
+	}
+	return res
+}
+
+/* Return if data starts with an Annex B start code */
+func isAnnexB(data []byte) bool {
+	return (len(data) > 3 && data[0] == 0 && data[1] == 0 && data[2] == 1) ||
+		(len(data) > 4 && data[0] == 0 && data[1] == 0 && data[2] == 0 && data[3] == 1)
+}
+
+/* Split an Annex B bitstream in NAL units */
+func splitAnnexB(data []byte) [][]byte {
+	var res [][]byte
+	start := -1
+	for i := 0; i + 2 < len(data); i++ {
+		if data[i] == 0 && data[i + 1] == 0 && data[i + 2] == 1 {
+			if start >= 0 {
+				end := i
+				/* Drop leading zero of a four bytes start code */
+				for end > start && data[end - 1] == 0 {
+					end--
+				}
+				res = append(res, data[start:end])
+			}
+			start = i + 3
+			i += 2
+		}
+	}
+	if start >= 0 && start < len(data) {
+		res = append(res, data[start:])
+	}
+	return res
+}
+
+/* HEVC specific helpers */
+
+/* Structure holding the HEVC SPS fields copied in hvcC */
+type hevcSPSInfos struct {
+	profileTierLevel  []byte
+	maxSubLayers      int
+	temporalIdNested  int
+	chromaFormat      int
+	bitDepthLuma      int
+	bitDepthChroma    int
+}
+
+/* Parse the parts of a HEVC SPS (with its NAL header) needed for hvcC */
+func parseHEVCSPS(nal []byte) (*hevcSPSInfos, error) {
+	var res hevcSPSInfos
+	rbsp := nalToRBSP(nal)
+	if len(rbsp) < 15 {
+		return nil, errors.New("HEVC SPS is too short")
+	}
+	/* Skip NAL header */
+	r := bitReader{rbsp, 16}
+	r.skipBits(4)
+	maxSubLayersMinus1, _ := r.readBits(3)
+	res.maxSubLayers = maxSubLayersMinus1 + 1
+	res.temporalIdNested, _ = r.readBits(1)
+	/* General profile, tier and level : 12 bytes starting on a byte boundary */
+	res.profileTierLevel = rbsp[3:15]
+	r.skipBits(96)
+	/* Sub layers profile and level */
+	profilePresent := make([]int, maxSubLayersMinus1)
+	levelPresent := make([]int, maxSubLayersMinus1)
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		profilePresent[i], _ = r.readBits(1)
+		levelPresent[i], _ = r.readBits(1)
+	}
+	if maxSubLayersMinus1 > 0 {
+		r.skipBits(2 * (8 - maxSubLayersMinus1))
+	}
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		if profilePresent[i] == 1 {
+			r.skipBits(88)
+		}
+		if levelPresent[i] == 1 {
+			r.skipBits(8)
+		}
+	}
+	/* sps_seq_parameter_set_id */
+	r.readUE()
+	var err error
+	res.chromaFormat, err = r.readUE()
+	if err != nil { return nil, err }
+	if res.chromaFormat == 3 {
+		r.skipBits(1)
+	}
+	/* Picture size */
+	r.readUE()
+	r.readUE()
+	conformanceWindow, _ := r.readBits(1)
+	if conformanceWindow == 1 {
+		for i := 0; i < 4; i++ {
+			r.readUE()
+		}
+	}
+	res.bitDepthLuma, _ = r.readUE()
+	res.bitDepthChroma, err = r.readUE()
+	if err != nil { return nil, err }
+	return &res, nil
+}
+
+/* Build hvcC content from VPS, SPS and PPS NAL units in Annex B format */
+func hevcAnnexBToHVCC(data []byte) ([]byte, error) {
+	var arrays [3][][]byte
+	var infos *hevcSPSInfos
+	var err error
+	for _, nal := range splitAnnexB(data) {
+		if len(nal) < 2 {
+			continue
+		}
+		nalType := int(nal[0] >> 1) & 0x3F
+		if nalType < HEVC_NAL_VPS || nalType > HEVC_NAL_PPS {
+			continue
+		}
+		if nalType == HEVC_NAL_SPS && infos == nil {
+			infos, err = parseHEVCSPS(nal)
+			if err != nil { return nil, err }
+		}
+		arrays[nalType - HEVC_NAL_VPS] = append(arrays[nalType - HEVC_NAL_VPS], nal)
+	}
+	if infos == nil {
+		return nil, errors.New("No SPS found in HEVC parameter sets")
+	}
+	res := []byte{ 0x1 }
+	res = append(res, infos.profileTierLevel...)
+	res = append(res, []byte{
+		/* Min spatial segmentation */
+		0xF0, 0x0,
+		/* Parallelism type */
+		0xFC,
+		/* Chroma format */
+		0xFC | byte(infos.chromaFormat & 0x3),
+		/* Bit depths */
+		0xF8 | byte(infos.bitDepthLuma & 0x7),
+		0xF8 | byte(infos.bitDepthChroma & 0x7),
+		/* Average frame rate */
+		0x0, 0x0,
+		/* Temporal layers + temporal id nested + NAL length size (4) */
+		byte(((infos.maxSubLayers & 0x7) << 3) | ((infos.temporalIdNested & 0x1) << 2) | 0x3),
+	}...)
+	count := 0
+	for i := 0; i < len(arrays); i++ {
+		if len(arrays[i]) > 0 {
+			count++
+		}
+	}
+	res = append(res, byte(count))
+	for i := 0; i < len(arrays); i++ {
+		if len(arrays[i]) == 0 {
+			continue
+		}
+		res = append(res, 0x80 | byte(HEVC_NAL_VPS + i), byte(len(arrays[i]) >> 8), byte(len(arrays[i]) & 0xFF))
+		for _, nal := range arrays[i] {
+			res = append(res, byte(len(nal) >> 8), byte(len(nal) & 0xFF))
+			res = append(res, nal...)
+		}
+	}
+	return res, nil
+}
+
+/* Convert hvcC content to parameter sets with Annex B start codes */
+func hvccToAnnexB(extradata []byte) []byte {
+	var res []byte
+	if len(extradata) < 23 {
+		return nil
+	}
+	offset := 23
+	for i := 0; i < int(extradata[22]) && offset + 3 <= len(extradata); i++ {
+		count := (int(extradata[offset + 1]) << 8) | int(extradata[offset + 2])
+		offset += 3
+		for j := 0; j < count && offset + 2 <= len(extradata); j++ {
+			size := (int(extradata[offset]) << 8) | int(extradata[offset + 1])
+			offset += 2
+			if offset + size > len(extradata) {
+				return res
+			}
+			res = append(res, 0x0, 0x0, 0x0, 0x1)
+			res = append(res, extradata[offset:offset + size]...)
+			offset += size
+		}
+	}
+	return res
+}
+
+/* Reverse bits of a 32 bits value */
+func reverseBits32(val uint32) uint32 {
+	res := uint32(0)
+	for i := 0; i < 32; i++ {
+		res = (res << 1) | (val & 0x1)
+		val >>= 1
+	}
+	return res
+}
+
+/* Build RFC 6381 codec string from hvcC content (ex: hvc1.1.6.L120.90) */
+func hevcCodecString(fourcc string, extradata []byte) string {
+	if len(extradata) < 13 {
+		return fourcc
+	}
+	res := fourcc + "."
+	/* Profile space and profile */
+	space := int(extradata[1] >> 6)
+	if space > 0 {
+		res += string('A' + rune(space - 1))
+	}
+	res += strconv.Itoa(int(extradata[1] & 0x1F))
+	/* Compatibility flags, in reverse bit order */
+	flags := uint32(extradata[2]) << 24 | uint32(extradata[3]) << 16 | uint32(extradata[4]) << 8 | uint32(extradata[5])
+	res += "." + strings.ToUpper(strconv.FormatUint(uint64(reverseBits32(flags)), 16))
+	/* Tier and level */
+	if extradata[1] & 0x20 != 0 {
+		res += ".H"
+	} else {
+		res += ".L"
+	}
+	res += strconv.Itoa(int(extradata[12]))
+	/* Constraint flags, trailing zero bytes omitted */
+	last := 11
+	for last >= 6 && extradata[last] == 0 {
+		last--
+	}
+	for i := 6; i <= last; i++ {
+		res += "." + strings.ToUpper(strconv.FormatUint(uint64(extradata[i]), 16))
+	}
+	return res
+}
+
+/* Dolby AC-3 / E-AC-3 specific helpers */
+
+/* Return AC-3 sample rate code */
+func ac3SampleRateCode(sampleRate int) int {
+	switch sampleRate {
+	case 44100:
+		return 1
+	case 32000:
+		return 2
+	}
+	return 0
+}
+
+/* Return AC-3 audio coding mode from the number of full bandwidth channels */
+func ac3CodingMode(channels int) int {
+	modes := []int{2, 1, 2, 3, 6, 7}
+	if channels < 1 || channels >= len(modes) {
+		return 7
+	}
+	return modes[channels]
+}
+
+/* Return AC-3 bit rate code from a bit rate in bits/s */
+func ac3BitRateCode(bitRate int) int {
+	rates := []int{32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 448, 512, 576, 640}
+	for i := 0; i < len(rates); i++ {
+		if rates[i] * 1000 >= bitRate {
+			return i
+		}
+	}
+	return len(rates) - 1
+}
+
+/* Build dac3 content from codec parameters, channels includes LFE */
+func buildAC3Config(sampleRate int, channels int, lfe bool, bitRate int) []byte {
+	lfeOn := 0
+	if lfe {
+		lfeOn = 1
+		channels -= 1
+	}
+	/* fscod(2) bsid(5) bsmod(3) acmod(3) lfeon(1) bit_rate_code(5) reserved(5) */
+	val := ac3SampleRateCode(sampleRate) << 22 |
+		8 << 17 |
+		ac3CodingMode(channels) << 11 |
+		lfeOn << 10 |
+		ac3BitRateCode(bitRate) << 5
+	return []byte{ byte(val >> 16), byte(val >> 8), byte(val) }
+}
+
+/* Build dec3 content with one independent substream from codec parameters, channels includes LFE */
+func buildEAC3Config(sampleRate int, channels int, lfe bool, bitRate int) []byte {
+	lfeOn := 0
+	if lfe {
+		lfeOn = 1
+		channels -= 1
+	}
+	/* data_rate(13) num_ind_sub(3) */
+	dataRate := (bitRate / 1000) & 0x1FFF
+	/* fscod(2) bsid(5) reserved(1) asvc(1) bsmod(3) acmod(3) lfeon(1) reserved(3) num_dep_sub(4) reserved(1) */
+	val := ac3SampleRateCode(sampleRate) << 22 |
+		16 << 17 |
+		ac3CodingMode(channels) << 9 |
+		lfeOn << 8
+	return []byte{
+		byte(dataRate >> 5), byte((dataRate & 0x1F) << 3),
+		byte(val >> 16), byte(val >> 8), byte(val),
+	}
+}
+
+/* Return audio coding mode and LFE presence from dac3 or dec3 content */
+func dolbyChannelInfos(fourcc string, extradata []byte) (int, bool) {
+	if fourcc == "ec-3" && len(extradata) >= 4 {
+		return int(extradata[3] >> 1) & 0x7, (extradata[3] & 0x1) != 0
+	} else if fourcc == "ac-3" && len(extradata) >= 2 {
+		return int(extradata[1] >> 3) & 0x7, ((extradata[1] >> 2) & 0x1) != 0
+	}
+	return 2, false
+}
+
+/* Return Dolby audio channel configuration (TS 102 366 channel mask, ex: F801 for 5.1) */
+func dolbyChannelMask(fourcc string, extradata []byte) string {
+	/* L R, C, L R, L C R, L R Cs, L C R Cs, L R Ls Rs, L C R Ls Rs */
+	masks := []int{0xA000, 0x4000, 0xA000, 0xE000, 0xA100, 0xE100, 0xB800, 0xF800}
+	acmod, lfe := dolbyChannelInfos(fourcc, extradata)
+	mask := masks[acmod]
+	if lfe {
+		mask |= 0x1
+	}
+	return fmt.Sprintf("%04X", mask)
+}
+
+/* H.264 specific helpers */
+
+/* Structure holding the H.264 SPS fields used in sample entries and manifests */
+type h264SPSInfos struct {
+	profile       int
+	constraints   int
+	level         int
+	width         int
+	height        int
+	sarNum        int
+	sarDen        int
+	frameRateNum  int
+	frameRateDen  int
+}
+
+/* Sample aspect ratios of aspect_ratio_idc 1 to 16 (H.264 table E-1) */
+var h264SampleAspectRatios = [][2]int{
+	{1, 1}, {12, 11}, {10, 11}, {16, 11}, {40, 33}, {24, 11}, {20, 11}, {32, 11},
+	{80, 33}, {18, 11}, {15, 11}, {64, 33}, {160, 99}, {4, 3}, {3, 2}, {2, 1},
+}
+
+/* Read a signed exp-golomb code */
+func (r *bitReader) readSE() (int, error) {
+	val, err := r.readUE()
+	if err != nil { return 0, err }
+	if val & 0x1 == 1 {
+		return (val + 1) / 2, nil
+	}
+	return -(val / 2), nil
+}
+
+/* Skip a scaling list of a H.264 SPS */
+func (r *bitReader) skipScalingList(size int) {
+	last := 8
+	next := 8
+	for i := 0; i < size; i++ {
+		if next != 0 {
+			delta, _ := r.readSE()
+			next = (last + delta + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+/* Return first SPS stored in an avcC content */
+func avccSPS(extradata []byte) []byte {
+	if len(extradata) < 8 || extradata[5] & 0x1F == 0 {
+		return nil
+	}
+	size := (int(extradata[6]) << 8) | int(extradata[7])
+	if len(extradata) < 8 + size {
+		return nil
+	}
+	return extradata[8:8 + size]
+}
+
+/* Parse a H.264 SPS (with its NAL header) : profile, level, cropped size, SAR and frame rate */
+func parseH264SPS(nal []byte) (*h264SPSInfos, error) {
+	var res h264SPSInfos
+	rbsp := nalToRBSP(nal)
+	if len(rbsp) < 5 || rbsp[0] & 0x1F != 7 {
+		return nil, errors.New("Invalid H264 SPS")
+	}
+	res.profile = int(rbsp[1])
+	res.constraints = int(rbsp[2])
+	res.level = int(rbsp[3])
+	r := bitReader{rbsp, 32}
+	/* seq_parameter_set_id */
+	r.readUE()
+	chromaFormat := 1
+	separateColourPlane := 0
+	switch res.profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat, _ = r.readUE()
+		if chromaFormat == 3 {
+			separateColourPlane, _ = r.readBits(1)
+		}
+		/* Bit depths and qpprime_y_zero_transform_bypass_flag */
+		r.readUE()
+		r.readUE()
+		r.skipBits(1)
+		scalingMatrix, _ := r.readBits(1)
+		if scalingMatrix == 1 {
+			count := 8
+			if chromaFormat == 3 {
+				count = 12
+			}
+			for i := 0; i < count; i++ {
+				present, _ := r.readBits(1)
+				if present == 1 && i < 6 {
+					r.skipScalingList(16)
+				} else if present == 1 {
+					r.skipScalingList(64)
+				}
+			}
+		}
+	}
+	/* log2_max_frame_num_minus4 */
+	r.readUE()
+	pocType, _ := r.readUE()
+	if pocType == 0 {
+		r.readUE()
+	} else if pocType == 1 {
+		r.skipBits(1)
+		r.readSE()
+		r.readSE()
+		cycle, _ := r.readUE()
+		for i := 0; i < cycle; i++ {
+			r.readSE()
+		}
+	}
+	/* max_num_ref_frames and gaps_in_frame_num_value_allowed_flag */
+	r.readUE()
+	r.skipBits(1)
+	widthInMbs, _ := r.readUE()
+	heightInMapUnits, _ := r.readUE()
+	frameMbsOnly, _ := r.readBits(1)
+	if frameMbsOnly == 0 {
+		r.skipBits(1)
+	}
+	/* direct_8x8_inference_flag */
+	r.skipBits(1)
+	res.width = (widthInMbs + 1) * 16
+	res.height = (2 - frameMbsOnly) * (heightInMapUnits + 1) * 16
+	cropping, _ := r.readBits(1)
+	if cropping == 1 {
+		left, _ := r.readUE()
+		right, _ := r.readUE()
+		top, _ := r.readUE()
+		bottom, _ := r.readUE()
+		/* Crop units depend on chroma subsampling */
+		cropX := 1
+		cropY := 2 - frameMbsOnly
+		if separateColourPlane == 0 && chromaFormat == 1 {
+			cropX, cropY = 2, 2 * (2 - frameMbsOnly)
+		} else if separateColourPlane == 0 && chromaFormat == 2 {
+			cropX = 2
+		}
+		res.width -= cropX * (left + right)
+		res.height -= cropY * (top + bottom)
+	}
+	res.sarNum, res.sarDen = 1, 1
+	vui, err := r.readBits(1)
+	if err != nil { return nil, err }
+	if vui == 0 {
+		return &res, nil
+	}
+	aspectRatio, _ := r.readBits(1)
+	if aspectRatio == 1 {
+		idc, _ := r.readBits(8)
+		if idc == 255 {
+			res.sarNum, _ = r.readBits(16)
+			res.sarDen, _ = r.readBits(16)
+		} else if idc >= 1 && idc <= len(h264SampleAspectRatios) {
+			res.sarNum = h264SampleAspectRatios[idc - 1][0]
+			res.sarDen = h264SampleAspectRatios[idc - 1][1]
+		}
+	}
+	overscan, _ := r.readBits(1)
+	if overscan == 1 {
+		r.skipBits(1)
+	}
+	videoSignal, _ := r.readBits(1)
+	if videoSignal == 1 {
+		r.skipBits(4)
+		colour, _ := r.readBits(1)
+		if colour == 1 {
+			r.skipBits(24)
+		}
+	}
+	chromaLocation, _ := r.readBits(1)
+	if chromaLocation == 1 {
+		r.readUE()
+		r.readUE()
+	}
+	timing, _ := r.readBits(1)
+	if timing == 1 {
+		unitsInTick, _ := r.readBits(32)
+		timeScale, err := r.readBits(32)
+		/* Two fields per frame */
+		if err == nil && unitsInTick > 0 {
+			res.frameRateNum, res.frameRateDen = reduceRatio(timeScale, 2 * unitsInTick)
+		}
+	}
+	if res.sarNum == 0 || res.sarDen == 0 {
+		res.sarNum, res.sarDen = 1, 1
+	}
+	return &res, nil
+}
+
+/* Build avcC content from SPS and PPS NAL units in Annex B format */
+func h264AnnexBToAVCC(data []byte) ([]byte, error) {
+	var sps [][]byte
+	var pps [][]byte
+	for _, nal := range splitAnnexB(data) {
+		if len(nal) < 4 {
+			continue
+		}
+		switch nal[0] & 0x1F {
+		case 7:
+			sps = append(sps, nal)
+		case 8:
+			pps = append(pps, nal)
+		}
+	}
+	if len(sps) == 0 || len(pps) == 0 {
+		return nil, errors.New("No SPS or PPS found in H.264 parameter sets")
+	}
+	/* Profile, compatibility and level are copied from the first SPS, NAL length size is 4 */
+	res := []byte{ 0x1, sps[0][1], sps[0][2], sps[0][3], 0xFF, 0xE0 | byte(len(sps)) }
+	for _, nal := range sps {
+		res = append(res, byte(len(nal) >> 8), byte(len(nal) & 0xFF))
+		res = append(res, nal...)
+	}
+	res = append(res, byte(len(pps)))
+	for _, nal := range pps {
+		res = append(res, byte(len(nal) >> 8), byte(len(nal) & 0xFF))
+		res = append(res, nal...)
+	}
+	return res, nil
+}
+
+/* Replace Annex B start codes of a sample by 4 bytes NAL unit sizes */
+func annexBToLengthPrefixed(data []byte) []byte {
+	var res []byte
+	for _, nal := range splitAnnexB(data) {
+		size := len(nal)
+		res = append(res, byte(size >> 24), byte(size >> 16), byte(size >> 8), byte(size))
+		res = append(res, nal...)
+	}
+	return res
+}
+
+/* Return greatest common divisor of two positive integers */
+func gcd(a int, b int) int {
+	for b != 0 {
+		a, b = b, a % b
+	}
+	return a
+}
+
+/* Reduce a ratio to its simplest form */
+func reduceRatio(num int, den int) (int, int) {
+	d := gcd(num, den)
+	if d == 0 {
+		return num, den
+	}
+	return num / d, den / d
+}
+
+/* AAC specific helpers */
+
+/* Sampling frequencies indexed by samplingFrequencyIndex */
+var aacSampleRates = []int{
+	96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050,
+	16000, 12000, 11025, 8000, 7350,
+}
+
+/* Channel counts indexed by channelConfiguration */
+var aacChannels = []int{0, 1, 2, 3, 4, 5, 6, 8, 0, 0, 0, 7, 8, 24, 8}
+
+/* Structure holding AudioSpecificConfig fields used in sample entries and manifests */
+type aacConfig struct {
+	objectType       int
+	sampleRate       int
+	outputSampleRate int
+	channels         int
+}
+
+/* Read audio object type of an AudioSpecificConfig */
+func (r *bitReader) readAudioObjectType() (int, error) {
+	objectType, err := r.readBits(5)
+	if err == nil && objectType == 31 {
+		objectType, err = r.readBits(6)
+		objectType += 32
+	}
+	return objectType, err
+}
+
+/* Read sampling frequency of an AudioSpecificConfig */
+func (r *bitReader) readSamplingFrequency() (int, error) {
+	index, err := r.readBits(4)
+	if err != nil { return 0, err }
+	if index == 0xF {
+		return r.readBits(24)
+	} else if index >= len(aacSampleRates) {
+		return 0, errors.New("Invalid AAC sampling frequency index")
+	}
+	return aacSampleRates[index], nil
+}
+
+/*
+ Parse an AudioSpecificConfig : object type (5 for HE-AAC, 29 for HE-AACv2), sample rate and channels.
+ SBR and PS are found with explicit signaling or a backward compatible sync extension.
+ */
+func parseAudioSpecificConfig(asc []byte) (*aacConfig, error) {
+	var res aacConfig
+	var err error
+	r := bitReader{asc, 0}
+	res.objectType, _ = r.readAudioObjectType()
+	res.sampleRate, _ = r.readSamplingFrequency()
+	channelConfig, err := r.readBits(4)
+	if err != nil { return nil, err }
+	if channelConfig < len(aacChannels) {
+		res.channels = aacChannels[channelConfig]
+	}
+	res.outputSampleRate = res.sampleRate
+	/* Explicit SBR signaling : extension sample rate, then core object type */
+	if res.objectType == 5 || res.objectType == 29 {
+		res.outputSampleRate, err = r.readSamplingFrequency()
+		if err != nil { return nil, err }
+		/* Parametric stereo always outputs stereo */
+		if res.objectType == 29 && res.channels == 1 {
+			res.channels = 2
+		}
+	} else if res.objectType == 2 && channelConfig != 0 {
+		/* GASpecificConfig : frameLengthFlag, dependsOnCoreCoder, extensionFlag */
+		dependsOnCoreCoder, _ := r.readBits(2)
+		if dependsOnCoreCoder & 0x1 != 0 {
+			r.skipBits(14)
+		}
+		r.skipBits(1)
+		r.readSyncExtension(&res)
+	}
+	return &res, nil
+}
+
+/*
+ Read the backward compatible SBR/PS signaling (sync extension 0x2b7) following
+ an AAC LC AudioSpecificConfig. Configs with a program_config_element are not
+ parsed and stay advertised as AAC LC at the core sample rate.
+ */
+func (r *bitReader) readSyncExtension(res *aacConfig) {
+	if r.bitsLeft() < 16 { return }
+	if syncExtensionType, _ := r.readBits(11); syncExtensionType != 0x2b7 { return }
+	if extensionObjectType, err := r.readAudioObjectType(); err != nil || extensionObjectType != 5 { return }
+	if sbrPresent, err := r.readBits(1); err != nil || sbrPresent == 0 { return }
+	outputSampleRate, err := r.readSamplingFrequency()
+	if err != nil { return }
+	res.objectType = 5
+	res.outputSampleRate = outputSampleRate
+	if r.bitsLeft() < 12 { return }
+	if syncExtensionType, _ := r.readBits(11); syncExtensionType != 0x548 { return }
+	if psPresent, _ := r.readBits(1); psPresent == 1 {
+		res.objectType = 29
+		if res.channels == 1 {
+			res.channels = 2
+		}
+	}
+}
+
+/* Return size of the ADTS header starting an AAC frame (9 with CRC), 0 if there is none */
+func adtsHeaderSize(data []byte) int {
+	/* Syncword, then layer always 0 */
+	if len(data) < 7 || data[0] != 0xFF || data[1] & 0xF6 != 0xF0 {
+		return 0
+	}
+	if data[1] & 0x1 == 0 {
+		return 9
+	}
+	return 7
+}
+
+/* Build the AudioSpecificConfig of an AAC stream from the ADTS header of one of its frames */
+func adtsToASC(data []byte) ([]byte, error) {
+	if adtsHeaderSize(data) == 0 {
+		return nil, errors.New("No ADTS header found in AAC frame")
+	}
+	objectType := int(data[2] >> 6) + 1
+	frequencyIndex := int(data[2] >> 2) & 0xF
+	channelConfig := (int(data[2] & 0x1) << 2) | int(data[3] >> 6)
+	if frequencyIndex >= len(aacSampleRates) {
+		return nil, errors.New("Invalid AAC sampling frequency index in ADTS header")
+	}
+	return []byte{
+		byte(objectType << 3) | byte(frequencyIndex >> 1),
+		byte((frequencyIndex & 0x1) << 7) | byte(channelConfig << 3),
+	}, nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+  "encoding/hex"
+  "testing"
+)
+
+func TestHEVCCodecString(t *testing.T) {
+  /* Main profile, compatibility 0x60000000, level 4 (120), progressive + frame only constraints */
+  extradata := []byte{
+    0x1, 0x1, 0x60, 0x0, 0x0, 0x0,
+    0x90, 0x0, 0x0, 0x0, 0x0, 0x0,
+    0x78,
+  }
+
+  got := hevcCodecString("hvc1", extradata)
+  if got != "hvc1.1.6.L120.90" {
+    t.Errorf("bad hevc codec string. want %q, got %q", "hvc1.1.6.L120.90", got)
+  }
+}
+
+func TestHEVCAnnexBSample(t *testing.T) {
+  /* Access unit delimiter, then IDR slice with an emulation prevention byte and a 4 bytes start code */
+  sample := []byte{
+    0x0, 0x0, 0x1, 0x46, 0x1, 0x10,
+    0x0, 0x0, 0x0, 0x1, 0x26, 0x1, 0xaf, 0x0, 0x0, 0x3, 0x1, 0x80,
+  }
+  want := "00000003460110000000082601af0000030180"
+  if got := hex.EncodeToString(annexBToLengthPrefixed(sample)); got != want {
+    t.Errorf("bad length prefixed HEVC sample. want %s, got %s", want, got)
+  }
+}
+
+func TestDolbyChannelMask(t *testing.T) {
+  cases := []struct {
+    fourcc string
+    extradata []byte
+    want string
+  }{
+    {"ec-3", buildEAC3Config(48000, 6, true, 640000), "F801"},
+    {"ac-3", buildAC3Config(48000, 6, true, 448000), "F801"},
+    {"ac-3", buildAC3Config(48000, 2, false, 192000), "A000"},
+  }
+
+  for _, c := range cases {
+    got := dolbyChannelMask(c.fourcc, c.extradata)
+    if got != c.want {
+      t.Errorf("bad channel mask for %s. want %q, got %q", c.fourcc, c.want, got)
+    }
+  }
+}
+
+func TestH264SPS(t *testing.T) {
+  /* High profile 1920x1080 (bottom cropping), SAR 4:3, 30000/1001 fps */
+  sps := []byte{
+    0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78, 0x02, 0x27, 0xe5, 0xff, 0xc0,
+    0x01, 0x00, 0x00, 0xc4, 0x00, 0x00, 0x0f, 0xa4, 0x00, 0x03, 0xa9, 0x83,
+  }
+  extradata := append([]byte{0x1, 0x64, 0x00, 0x28, 0xff, 0xe1, 0x0, byte(len(sps))}, sps...)
+  track := Track{extradata: extradata}
+
+  track.applyCodecParameters()
+  if track.width != 1920 || track.height != 1080 {
+    t.Errorf("bad size. want 1920x1080, got %dx%d", track.width, track.height)
+  }
+  if got := track.SampleAspectRatio(); got != "4:3" {
+    t.Errorf("bad sar. want 4:3, got %s", got)
+  }
+  if got := track.PictureAspectRatio(); got != "64:27" {
+    t.Errorf("bad par. want 64:27, got %s", got)
+  }
+  if got := track.FrameRate(); got != "30000/1001" {
+    t.Errorf("bad frame rate. want 30000/1001, got %s", got)
+  }
+}
+
+func TestAudioSpecificConfig(t *testing.T) {
+  /* HE-AACv2 : explicit SBR and PS, 24kHz mono core */
+  track := Track{isAudio: true, extradata: []byte{0xeb, 0x09, 0x88}}
+
+  track.applyCodecParameters()
+  track.extractAudioCodec()
+  if track.codec != "mp4a.40.29" {
+    t.Errorf("bad codec. want mp4a.40.29, got %s", track.codec)
+  }
+  if track.sampleRate != 48000 || track.channels != 2 {
+    t.Errorf("bad audio parameters. want 48000Hz 2ch, got %dHz %dch", track.sampleRate, track.channels)
+  }
+  /* Backward compatible signaling : AAC LC core followed by sync extensions */
+  for _, c := range []struct {
+    asc []byte
+    objectType, sampleRate, outputSampleRate, channels int
+  }{
+    {[]byte{0x11, 0x90}, 2, 48000, 48000, 2},
+    {[]byte{0x13, 0x10, 0x56, 0xe5, 0x98}, 5, 24000, 48000, 2},
+    {[]byte{0x13, 0x08, 0x56, 0xe5, 0x9d, 0x48, 0x80}, 29, 24000, 48000, 2},
+    {[]byte{0x13, 0x10, 0x56, 0xe5, 0x00}, 2, 24000, 24000, 2},
+  } {
+    config, err := parseAudioSpecificConfig(c.asc)
+    if err != nil {
+      t.Errorf("can't parse %x: %s", c.asc, err)
+    } else if config.objectType != c.objectType || config.sampleRate != c.sampleRate || config.outputSampleRate != c.outputSampleRate || config.channels != c.channels {
+      t.Errorf("bad config for %x. got %+v", c.asc, *config)
+    }
+  }
+}
+
+func TestADTSConfig(t *testing.T) {
+  /* AAC LC, 48 kHz, stereo, without CRC */
+  frame := []byte{0xff, 0xf1, 0x4c, 0x80, 0x01, 0x3f, 0xfc, 0x21, 0x10}
+  if size := adtsHeaderSize(frame); size != 7 {
+    t.Errorf("bad ADTS header size. want 7, got %d", size)
+  }
+  asc, err := adtsToASC(frame)
+  if err != nil || hex.EncodeToString(asc) != "1190" {
+    t.Fatalf("bad AudioSpecificConfig from ADTS. got %x (%v)", asc, err)
+  }
+  if config, err := parseAudioSpecificConfig(asc); err != nil || config.sampleRate != 48000 || config.channels != 2 {
+    t.Errorf("bad parsed config. got %v", config)
+  }
+  if size := adtsHeaderSize([]byte{0xff, 0xf0, 0x4c, 0x80, 0x01, 0x3f, 0xfc, 0x0, 0x0}); size != 9 {
+    t.Errorf("bad ADTS header size with CRC. want 9, got %d", size)
+  }
+  if _, err := adtsToASC([]byte{0x21, 0x10, 0x4, 0x60, 0x8c, 0x1c, 0x0}); err == nil {
+    t.Errorf("frame without ADTS header accepted")
+  }
+}
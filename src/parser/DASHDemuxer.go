@@ -43,7 +43,7 @@ type HTTPRequest struct {
 type DASHXMLSegment struct {
 	XMLName xml.Name `xml:"S"`
 	Duration int `xml:"d,attr"`
-	Time int `xml:"t,attr"`
+	Time *int64 `xml:"t,attr"`
 	Repetition int `xml:"r,attr"`
 }
 
@@ -53,6 +53,8 @@ type DASHXMLSegmentTemplate struct {
 	Initialization string `xml:"initialization,attr"`
 	Media string `xml:"media,attr"`
 	StartNumber int `xml:"startNumber,attr"`
+	Duration int `xml:"duration,attr"`
+	PresentationTimeOffset int64 `xml:"presentationTimeOffset,attr"`
 	Segments []DASHXMLSegment `xml:"SegmentTimeline>S"`
 }
 
@@ -81,10 +83,19 @@ type DASHXMLRepresentation struct {
 	BaseURL string `xml:"BaseURL">`
 }
 
+type DASHXMLRole struct {
+	XMLName xml.Name `xml:"Role"`
+	SchemeIdUri string `xml:"schemeIdUri,attr"`
+	Value string `xml:"value,attr"`
+}
+
 type DASHXMLAdaptionSet struct {
 	XMLName xml.Name `xml:"AdaptationSet"`
 	Group string `xml:"group,attr"`
 	MimeType string `xml:"mimeType,attr"`
+	Lang string `xml:"lang,attr"`
+	Roles []DASHXMLRole `xml:"Role"`
+	Label string `xml:"Label"`
 	MinWidth int `xml:"minWidth,attr"`
 	MaxWidth int `xml:"maxWidth,attr"`
 	MinHeight int `xml:"minHeight,attr"`
@@ -95,13 +106,24 @@ type DASHXMLAdaptionSet struct {
 
 type DASHXMLPeriod struct {
 	XMLName xml.Name `xml:"Period"`
+	Start string `xml:"start,attr"`
 	BaseURL string `xml:"BaseURL"`
 	AdaptationSets []DASHXMLAdaptionSet `xml:"AdaptationSet"`
 }
 
+type DASHXMLUTCTiming struct {
+	XMLName xml.Name `xml:"UTCTiming"`
+	SchemeIdUri string `xml:"schemeIdUri,attr"`
+	Value string `xml:"value,attr"`
+}
+
 type DASHManifest struct {
 	XMLName xml.Name `xml:"MPD"`
+	Type string `xml:"type,attr"`
 	Duration string `xml:"mediaPresentationDuration,attr"`
+	AvailabilityStartTime string `xml:"availabilityStartTime,attr"`
+	MinimumUpdatePeriod string `xml:"minimumUpdatePeriod,attr"`
+	UTCTimings []DASHXMLUTCTiming `xml:"UTCTiming"`
 	Period  DASHXMLPeriod
 }
 
@@ -116,6 +138,9 @@ type DASHDemuxer struct {
 	defaultSampleDuration int64
 	mediaTime int64
 	baseMediaDecodeTime int64
+	keys map[string][]byte
+	live *dashLiveState
+	err error
 	mutex sync.Mutex
 }
 
@@ -129,7 +154,17 @@ func (d *DASHDemuxer) Open(path string) error {
 	d.atomParsers["mvhd"] = (*DASHDemuxer).parseDASHMVHD
 	d.atomParsers["stsd"] = (*DASHDemuxer).parseDASHSTSD
 	d.atomParsers["mp4a"] = (*DASHDemuxer).parseDASHMP4A
+	d.atomParsers["ac-3"] = (*DASHDemuxer).parseDASHAC3
+	d.atomParsers["ec-3"] = (*DASHDemuxer).parseDASHEC3
+	d.atomParsers["esds"] = (*DASHDemuxer).parseDASHESDS
+	d.atomParsers["dac3"] = (*DASHDemuxer).parseDASHDOLBYConfig
+	d.atomParsers["dec3"] = (*DASHDemuxer).parseDASHDOLBYConfig
 	d.atomParsers["avc1"] = (*DASHDemuxer).parseDASHAVC1
+	d.atomParsers["hvc1"] = (*DASHDemuxer).parseDASHHVC1
+	d.atomParsers["hev1"] = (*DASHDemuxer).parseDASHHEV1
+	d.atomParsers["avcC"] = (*DASHDemuxer).parseDASHAVCC
+	d.atomParsers["hvcC"] = (*DASHDemuxer).parseDASHHVCC
+	d.atomParsers["frma"] = (*DASHDemuxer).parseDASHFRMA
 	d.atomParsers["hdlr"] = (*DASHDemuxer).parseDASHHDLR
 	d.atomParsers["tfhd"] = (*DASHDemuxer).parseDASHTFHD
 	d.atomParsers["elst"] = (*DASHDemuxer).parseDASHELST
@@ -139,6 +174,7 @@ func (d *DASHDemuxer) Open(path string) error {
 	d.atomParsers["encv"] = (*DASHDemuxer).parseDASHENCV
 	d.atomParsers["enca"] = (*DASHDemuxer).parseDASHENCA
 	d.atomParsers["tenc"] = (*DASHDemuxer).parseDASHTENC
+	d.atomParsers["schm"] = (*DASHDemuxer).parseDASHSCHM
 	d.atomParsers["senc"] = (*DASHDemuxer).parseDASHSENC
 	d.atomParsers["sidx"] = (*DASHDemuxer).parseDASHSIDX
 	return nil
@@ -209,11 +245,11 @@ func (d *DASHDemuxer) parseDASHMP4Descr(reader io.ReadSeeker, tag *int) int {
 }
 
 /* Extract audio extradata from DASH ESDS atom */
-func (d *DASHDemuxer) parseDASHESDS(reader io.ReadSeeker, track *Track) {
+func (d *DASHDemuxer) parseDASHESDS(reader io.ReadSeeker, size int, track *Track) {
 	var tag int
 	base, _ := utils.CurrentOffset(reader)
-	size, _ := utils.AtomReadInt32(reader)
-	reader.Seek(8, 1)
+	base -= 8
+	reader.Seek(4, 1)
 	len := d.parseDASHMP4Descr(reader, &tag)
 	if tag == 0x03 {
 		reader.Seek(3, 1)
@@ -234,30 +270,110 @@ func (d *DASHDemuxer) parseDASHESDS(reader io.ReadSeeker, track *Track) {
 	}
 }
 
-/* Extract audio info from DASH MP4A atom */
-func (d *DASHDemuxer) parseDASHMP4A(reader io.ReadSeeker, size int, track *Track) {
-	reader.Seek(24, 1)
+/* Extract Dolby audio extradata from DASH DAC3 or DEC3 atom */
+func (d *DASHDemuxer) parseDASHDOLBYConfig(reader io.ReadSeeker, size int, track *Track) {
+	track.extradata, _ = utils.AtomReadBuffer(reader, size - 8)
+}
+
+/* Extract audio info and codec configuration from a DASH audio sample entry */
+func (d *DASHDemuxer) parseDASHAudioSampleEntry(reader io.ReadSeeker, size int, track *Track) {
+	base, _ := utils.CurrentOffset(reader)
+	reader.Seek(16, 1)
+	track.channels, _ = utils.AtomReadInt16(reader)
+	reader.Seek(6, 1)
 	track.sampleRate, _ = utils.AtomReadInt32(reader)
 	track.sampleRate = (track.sampleRate >> 16)
-	d.parseDASHESDS(reader, track)
+	cur, _ := utils.CurrentOffset(reader)
+	/* Iterate over the other atoms (esds, dac3, dec3, sinf...) */
+	for cur - base < (size - 8) {
+		subSize := 0
+		tag, _ := utils.ReadAtomHeader(reader, &subSize)
+		if d.atomParsers[tag] != nil {
+			d.atomParsers[tag](d, reader, subSize, track)
+		} else if !containerDASHAtom(tag) {
+			reader.Seek(int64(subSize - 8), 1)
+		}
+		cur, _ = utils.CurrentOffset(reader)
+	}
 }
 
-/* Extract video extradata from DASH AVCD atom */
-func (d *DASHDemuxer) parseDASHAVCC(reader io.ReadSeeker, track *Track) {
-	size, _ := utils.AtomReadInt32(reader)
-	reader.Seek(4, 1)
+/* Extract audio info from DASH MP4A atom */
+func (d *DASHDemuxer) parseDASHMP4A(reader io.ReadSeeker, size int, track *Track) {
+	track.fourcc = "mp4a"
+	d.parseDASHAudioSampleEntry(reader, size, track)
+}
+
+/* Extract audio info from DASH AC-3 atom */
+func (d *DASHDemuxer) parseDASHAC3(reader io.ReadSeeker, size int, track *Track) {
+	track.fourcc = "ac-3"
+	d.parseDASHAudioSampleEntry(reader, size, track)
+}
+
+/* Extract audio info from DASH EC-3 atom */
+func (d *DASHDemuxer) parseDASHEC3(reader io.ReadSeeker, size int, track *Track) {
+	track.fourcc = "ec-3"
+	d.parseDASHAudioSampleEntry(reader, size, track)
+}
+
+/* Extract video extradata from DASH AVCC atom */
+func (d *DASHDemuxer) parseDASHAVCC(reader io.ReadSeeker, size int, track *Track) {
 	track.extradata, _ = utils.AtomReadBuffer(reader, size - 8)
 }
 
-/* Extract video info from DASH AVC1 atom */
-func (d *DASHDemuxer) parseDASHAVC1(reader io.ReadSeeker, size int, track *Track) {
+/* Extract video extradata from DASH HVCC atom */
+func (d *DASHDemuxer) parseDASHHVCC(reader io.ReadSeeker, size int, track *Track) {
+	track.extradata, _ = utils.AtomReadBuffer(reader, size - 8)
+	/* Encrypted sample entry, original format is given by FRMA */
+	if track.fourcc == "" {
+		track.fourcc = "hvc1"
+	}
+}
+
+/* Extract original sample entry name from DASH FRMA atom */
+func (d *DASHDemuxer) parseDASHFRMA(reader io.ReadSeeker, size int, track *Track) {
+	track.fourcc, _ = utils.AtomReadTag(reader)
+	reader.Seek(int64(size - 12), 1)
+}
+
+/* Extract video info and codec configuration from a DASH visual sample entry */
+func (d *DASHDemuxer) parseDASHVisualSampleEntry(reader io.ReadSeeker, size int, track *Track) {
+	base, _ := utils.CurrentOffset(reader)
 	reader.Seek(24, 1)
 	track.width, _ = utils.AtomReadInt16(reader)
 	track.height, _ = utils.AtomReadInt16(reader)
 	reader.Seek(46, 1)
 	track.bitsPerSample, _ = utils.AtomReadInt16(reader)
 	track.colorTableId, _ = utils.AtomReadInt16(reader)
-	d.parseDASHAVCC(reader, track)
+	cur, _ := utils.CurrentOffset(reader)
+	/* Iterate over the other atoms (avcC, hvcC, sinf...) */
+	for cur - base < (size - 8) {
+		subSize := 0
+		tag, _ := utils.ReadAtomHeader(reader, &subSize)
+		if d.atomParsers[tag] != nil {
+			d.atomParsers[tag](d, reader, subSize, track)
+		} else if !containerDASHAtom(tag) {
+			reader.Seek(int64(subSize - 8), 1)
+		}
+		cur, _ = utils.CurrentOffset(reader)
+	}
+}
+
+/* Extract video info from DASH AVC1 atom */
+func (d *DASHDemuxer) parseDASHAVC1(reader io.ReadSeeker, size int, track *Track) {
+	track.fourcc = "avc1"
+	d.parseDASHVisualSampleEntry(reader, size, track)
+}
+
+/* Extract video info from DASH HVC1 atom */
+func (d *DASHDemuxer) parseDASHHVC1(reader io.ReadSeeker, size int, track *Track) {
+	track.fourcc = "hvc1"
+	d.parseDASHVisualSampleEntry(reader, size, track)
+}
+
+/* Extract video info from DASH HEV1 atom */
+func (d *DASHDemuxer) parseDASHHEV1(reader io.ReadSeeker, size int, track *Track) {
+	track.fourcc = "hev1"
+	d.parseDASHVisualSampleEntry(reader, size, track)
 }
 
 /* Extract track type specific information from DASH STSD atom */
@@ -347,6 +463,10 @@ func (d *DASHDemuxer) parseDASHELST(reader io.ReadSeeker, size int, track *Track
 /* Extract encryption challenges from DASH PSSH atom */
 func (d *DASHDemuxer) parseDASHPSSH(reader io.ReadSeeker, size int, track *Track) {
 	var infos pss
+	if track.decryptKey != nil {
+		reader.Seek(int64(size - 8), 1)
+		return
+	}
 	if track.encryptInfos == nil {
 		track.encryptInfos = new(EncryptionInfo)
 	}
@@ -360,40 +480,14 @@ func (d *DASHDemuxer) parseDASHPSSH(reader io.ReadSeeker, size int, track *Track
 
 /* Extract video info and encryption from DASH ENCV atom */
 func (d *DASHDemuxer) parseDASHENCV(reader io.ReadSeeker, size int, track *Track) {
-	base, _ := utils.CurrentOffset(reader)
-	/* Extract video info */
-	d.parseDASHAVC1(reader, size, track)
-	cur, _ := utils.CurrentOffset(reader)
-	/* Iterate over the other atoms and extract encryption info */
-	for cur - base < (size - 8) {
-		subSize := 0
-		tag, _ := utils.ReadAtomHeader(reader, &subSize)
-		if d.atomParsers[tag] != nil {
-			d.atomParsers[tag](d, reader, subSize, track)
-		} else if !containerDASHAtom(tag) {
-			reader.Seek(int64(subSize - 8), 1)
-		}
-		cur, _ = utils.CurrentOffset(reader)
-	}
+	/* Extract video and encryption info, original format is given by FRMA */
+	d.parseDASHVisualSampleEntry(reader, size, track)
 }
 
 /* Extract audio info and encryption from DASH ENCV atom */
 func (d *DASHDemuxer) parseDASHENCA(reader io.ReadSeeker, size int, track *Track) {
-	base, _ := utils.CurrentOffset(reader)
-	/* Extract audio info */
-	d.parseDASHMP4A(reader, size, track)
-	cur, _ := utils.CurrentOffset(reader)
-	/* Iterate over the other atoms and extract encryption info */
-	for cur - base < (size - 8) {
-		subSize := 0
-		tag, _ := utils.ReadAtomHeader(reader, &subSize)
-		if d.atomParsers[tag] != nil {
-			d.atomParsers[tag](d, reader, subSize, track)
-		} else if !containerDASHAtom(tag) {
-			reader.Seek(int64(subSize - 8), 1)
-		}
-		cur, _ = utils.CurrentOffset(reader)
-	}
+	/* Extract audio and encryption info, original format is given by FRMA */
+	d.parseDASHAudioSampleEntry(reader, size, track)
 }
 
 /* Extract ecnryption keyId from DASH TENC atom */
@@ -406,6 +500,16 @@ func (d *DASHDemuxer) parseDASHTENC(reader io.ReadSeeker, size int, track *Track
 	track.encryptInfos.keyId = hex.EncodeToString(buf)
 }
 
+/* Extract protection scheme (cenc, cbcs...) from DASH SCHM atom */
+func (d *DASHDemuxer) parseDASHSCHM(reader io.ReadSeeker, size int, track *Track) {
+	if track.encryptInfos == nil {
+		track.encryptInfos = new(EncryptionInfo)
+	}
+	reader.Seek(4, 1)
+	track.encryptInfos.scheme, _ = utils.AtomReadTag(reader)
+	reader.Seek(int64(size - 16), 1)
+}
+
 /* Extract sample encryption info from DASH SENC atom */
 func (d *DASHDemuxer) parseDASHSENC(reader io.ReadSeeker, size int, track *Track) {
 	flags, _ := utils.AtomReadInt32(reader)
@@ -419,7 +523,10 @@ func (d *DASHDemuxer) parseDASHSENC(reader io.ReadSeeker, size int, track *Track
 		track.samples[i].encrypt = new(SampleEncryption)
 		track.samples[i].encrypt.initializationVector, _ = utils.AtomReadBuffer(reader, 8)
 		if flags & 0x2 > 0 {
-			track.encryptInfos.subEncrypt = true
+			/* Decrypted tracks are packaged clear or with their own encryption */
+			if track.decryptKey == nil {
+				track.encryptInfos.subEncrypt = true
+			}
 			nb, _ := utils.AtomReadInt16(reader)
 			for j := 0; j < nb; j++ {
 				clear, _ := utils.AtomReadInt16(reader)
@@ -548,7 +655,6 @@ func (d *DASHDemuxer) parseDASHTFDT(reader io.ReadSeeker, size int, track *Track
 func (d *DASHDemuxer) parseDASHFile(request HTTPRequest, track *Track) error {
 	client := new(http.Client)
 
-	var size int
 	/* Retrieve chunk data */
 	req, err := http.NewRequest("GET", request.Url, nil)
 	if err != nil {
@@ -569,6 +675,12 @@ func (d *DASHDemuxer) parseDASHFile(request HTTPRequest, track *Track) error {
 	if err != nil {
 		return err
 	}
+	return d.parseDASHData(buffer, track)
+}
+
+/* Parse atoms of a DASH chunk, either an init or data */
+func (d *DASHDemuxer) parseDASHData(buffer []byte, track *Track) error {
+	var size int
 	/* Retrieve reader from dowloaded data */
 	reader := bytes.NewReader(buffer)
 	d.mutex.Lock()
@@ -625,27 +737,11 @@ func parseDASHDuration(duration string) float64 {
 /* Retrieve URL for all chunks passed as argument in a segment template representation */
 func (d *DASHDemuxer) getSegmentTemplateChunksURL(adaptationSet DASHXMLAdaptionSet, representation DASHXMLRepresentation) *utils.Queue {
 	res := utils.Queue{}
-	time := 0
 	number := adaptationSet.Template.StartNumber
-	/* Iterate over each adaptation set in manifest */
-	for i := 0; i < len(adaptationSet.Template.Segments); i++ {
-		if adaptationSet.Template.Segments[i].Time > 0 {
-			time = adaptationSet.Template.Segments[i].Time
-		}
-		/* Iterate over each segment in representation */
-		for j := 0; j < adaptationSet.Template.Segments[i].Repetition + 1; j++ {
-			/* Build URL from template */
-			name := adaptationSet.Template.Media
-			name = strings.Replace(name, "$RepresentationID$", representation.Id, 1)
-			name = strings.Replace(name, "$Bandwidth$", representation.Bandwidth, 1)
-			name = strings.Replace(name, "$Time$", strconv.Itoa(time), 1)
-			name = strings.Replace(name, "$Number$", strconv.Itoa(number), 1)
-			req := HTTPRequest{Url: d.baseURL + "/" + name}
-			res.Push(req)
-			/* Increment time from duration for next chunk */
-			time += adaptationSet.Template.Segments[i].Duration
-			number += 1
-		}
+	/* Iterate over each segment in representation */
+	for _, time := range segmentTimelineTimes(adaptationSet.Template.Segments, 0) {
+		res.Push(d.buildTemplateURL(adaptationSet.Template.Media, representation, time, number))
+		number += 1
 	}
 	return &res
 }
@@ -705,6 +801,10 @@ func (d *DASHDemuxer) parseDASHManifest(manifest *DASHManifest, tracks *[]*Track
 	duration := parseDASHDuration(manifest.Duration)
 	acc := 0
 	d.chunksURL = make(map[int]*utils.Queue)
+	if manifest.Type == "dynamic" {
+		err := d.startLive(manifest)
+		if err != nil { return err }
+	}
 	/* Iterate over each adaptation set */
 	for i := 0; i < len(manifest.Period.AdaptationSets); i++ {
 		/* Iterate over each representation */
@@ -736,9 +836,18 @@ func (d *DASHDemuxer) parseDASHManifest(manifest *DASHManifest, tracks *[]*Track
 				fmt.Printf("error: %s \n", err)
 				return err
 			}
+			err = track.setDecryptionKey(d.keys)
+			if err != nil { return err }
 
 			track.duration = int(duration * float64(track.globalTimescale))
 			track.bandwidth, _ = strconv.Atoi(representation.Bandwidth)
+			track.language = adaptationSet.Lang
+			track.label = adaptationSet.Label
+			for _, role := range adaptationSet.Roles {
+				if role.SchemeIdUri == "urn:mpeg:dash:role:2011" {
+					track.role = role.Value
+				}
+			}
 			if track.timescale == 0 {
 				track.timescale = track.globalTimescale
 			}
@@ -746,7 +855,9 @@ func (d *DASHDemuxer) parseDASHManifest(manifest *DASHManifest, tracks *[]*Track
 			acc++
 			*tracks = append(*tracks, track)
 
-			if track.segmentType == "template" {
+			if track.segmentType == "template" && d.live != nil {
+				d.chunksURL[track.index] = d.followLiveTrack(track.index, adaptationSet, representation)
+			} else if track.segmentType == "template" {
 				d.chunksURL[track.index] = d.getSegmentTemplateChunksURL(adaptationSet, representation)
 			} else if track.segmentType == "base" {
 				d.chunksURL[track.index] = d.getSegmentBaseChunksURL(track, representation)
@@ -759,29 +870,50 @@ func (d *DASHDemuxer) parseDASHManifest(manifest *DASHManifest, tracks *[]*Track
 	return nil
 }
 
-/* Retrieve all tracks from a DASH source */
-func (d *DASHDemuxer) GetTracks(tracks *[]*Track) error {
-	/* Retrieve manifest */
+/* Download and decode the manifest of the source */
+func (d *DASHDemuxer) fetchManifest() (*DASHManifest, error) {
 	var manifest DASHManifest
 	resp, err := http.Get(d.manifestURL)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 	/* Transform XML to usable data structures */
 	decoder := xml.NewDecoder(resp.Body)
 	err = decoder.Decode(&manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+/* Retrieve all tracks from a DASH source */
+func (d *DASHDemuxer) GetTracks(tracks *[]*Track) error {
+	/* Retrieve manifest */
+	manifest, err := d.fetchManifest()
 	if err != nil {
 		return err
 	}
 	/* Parse manifest */
-	err = d.parseDASHManifest(&manifest, tracks)
+	err = d.parseDASHManifest(manifest, tracks)
 	if err != nil {
 		return err
 	}
 	return err
 }
 
+/* Set keys used to decrypt tracks, must be called before GetTracks */
+func (d *DASHDemuxer) SetDecryptionKeys(keys map[string]string) error {
+	var err error
+	d.keys, err = parseDecryptionKeys(keys)
+	return err
+}
+
+/* Return why the extraction stopped, nil if it did not fail */
+func (d *DASHDemuxer) Err() error {
+	return d.err
+}
+
 /* Clean demuxer internal info */
 func (d *DASHDemuxer) Close() {
 	for k := range d.chunksURL {
@@ -796,6 +928,10 @@ func (d *DASHDemuxer) ExtractChunk(tracks *[]*Track, isLive bool) bool {
 	var track *Track
 	var waitList []chan error
 	res := false
+	/* Add chunks published since last call for dynamic sources */
+	if isLive && d.live != nil {
+		d.updateLive()
+	}
 	/* Iterate over collection of chunk URL list */
 	for k := range d.chunksURL {
 		res = res || !d.chunksURL[k].Empty()
@@ -816,15 +952,34 @@ func (d *DASHDemuxer) ExtractChunk(tracks *[]*Track, isLive bool) bool {
 			request := d.chunksURL[k].Pop().(HTTPRequest)
 			c := make(chan error)
 			go func(c chan error, track *Track) {
-				c <- d.parseDASHFile(request, track)
+				err := d.parseDASHFile(request, track)
+				if err == nil {
+					err = track.decryptSamples()
+					/* Samples left encrypted must not be packaged as clear ones */
+					if err != nil {
+						track.Clean()
+						c <- fmt.Errorf("Decryption of track %d failed : %s", track.index, err.Error())
+						return
+					}
+				}
+				c <- nil
 			}(c, track)
 			waitList = append(waitList, c)
 		}
 	}
-	/* Wait for all parsing routines to end */
+	/* Wait for all parsing routines to end, a decryption error stops the extraction */
 	for i := 0; i < len(waitList); i++ {
-		<- waitList[i]
+		if err := <- waitList[i]; err != nil && d.err == nil {
+			d.err = err
+		}
 		close(waitList[i])
 	}
+	if d.err != nil {
+		return false
+	}
+	/* A dynamic source goes on until its manifest becomes static */
+	if isLive && d.live != nil && !d.live.ended {
+		return true
+	}
 	return res
 }
@@ -0,0 +1,319 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"time"
+	"utils"
+	"errors"
+	"strings"
+	"strconv"
+	"net/http"
+	"io/ioutil"
+)
+
+/* Number of segments before the live edge extracted when a dynamic source is opened */
+const DASH_LIVE_START_SEGMENTS = 3
+
+/* Interval between manifest reloads when the source gives no minimumUpdatePeriod, in seconds */
+const DASH_LIVE_DEFAULT_UPDATE_PERIOD = 2
+
+/* Representation of a dynamic source being followed, next segment to extract is kept */
+type dashLiveTrack struct {
+	adaptationSet  DASHXMLAdaptionSet
+	representation DASHXMLRepresentation
+	nextTime       int64
+	nextNumber     int
+	started        bool
+}
+
+/* State of a dynamic (live) DASH source */
+type dashLiveState struct {
+	availabilityStart time.Time
+	periodStart       float64
+	updatePeriod      time.Duration
+	lastUpdate        time.Time
+	clockOffset       time.Duration
+	tracks            map[int]*dashLiveTrack
+	ended             bool
+}
+
+/* Parse an xs:dateTime of a manifest, time zone defaults to UTC */
+func parseDASHDateTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999"} {
+		if res, err := time.Parse(layout, value); err == nil {
+			return res, nil
+		}
+	}
+	return time.Time{}, errors.New("Invalid date '" + value + "'")
+}
+
+/* Return wall clock of the source, synchronised with its UTCTiming */
+func (l *dashLiveState) now() time.Time {
+	return time.Now().Add(l.clockOffset)
+}
+
+/*
+ Compute offset between the local clock and the clock of the source from the first
+ supported UTCTiming (direct, http-xsdate, http-iso or http-head). Local clock is
+ used if none can be read.
+ */
+func (l *dashLiveState) syncClock(timings []DASHXMLUTCTiming) {
+	for _, timing := range timings {
+		var server time.Time
+		var err error
+		local := time.Now()
+		switch timing.SchemeIdUri {
+		case "urn:mpeg:dash:utc:direct:2014":
+			server, err = parseDASHDateTime(timing.Value)
+		case "urn:mpeg:dash:utc:http-xsdate:2014", "urn:mpeg:dash:utc:http-iso:2014":
+			var resp *http.Response
+			resp, err = http.Get(timing.Value)
+			if err != nil { continue }
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			server, err = parseDASHDateTime(string(body))
+		case "urn:mpeg:dash:utc:http-head:2014":
+			var resp *http.Response
+			resp, err = http.Head(timing.Value)
+			if err != nil { continue }
+			resp.Body.Close()
+			server, err = http.ParseTime(resp.Header.Get("Date"))
+		default:
+			continue
+		}
+		if err == nil {
+			l.clockOffset = server.Sub(local)
+			return
+		}
+	}
+}
+
+/* Format a template identifier value with its optional %0[width]d format tag */
+func formatTemplateValue(value string, format string) (string, bool) {
+	if format == "" {
+		return value, true
+	}
+	if !strings.HasPrefix(format, "%") || !strings.HasSuffix(format, "d") {
+		return "", false
+	}
+	width := 0
+	if digits := strings.TrimPrefix(format[1:len(format) - 1], "0"); digits != "" {
+		var err error
+		if width, err = strconv.Atoi(digits); err != nil { return "", false }
+	}
+	if len(value) < width {
+		value = strings.Repeat("0", width - len(value)) + value
+	}
+	return value, true
+}
+
+/*
+ Replace the identifiers of a SegmentTemplate: $RepresentationID$, $Bandwidth$,
+ $Time$ and $Number$, the last three with an optional %0[width]d format tag,
+ and $$ escapes. Unknown identifiers are kept as is.
+ */
+func expandTemplate(media string, representation DASHXMLRepresentation, time int64, number int) string {
+	res := ""
+	for {
+		start := strings.Index(media, "$")
+		if start < 0 { break }
+		end := strings.Index(media[start + 1:], "$")
+		if end < 0 { break }
+		end += start + 1
+		res += media[:start]
+		identifier := media[start + 1:end]
+		media = media[end + 1:]
+		if identifier == "" {
+			res += "$"
+			continue
+		}
+		name, format := identifier, ""
+		if i := strings.Index(identifier, "%"); i >= 0 {
+			name, format = identifier[:i], identifier[i:]
+		}
+		value, ok := "", true
+		switch name {
+		case "RepresentationID":
+			value, ok = representation.Id, format == ""
+		case "Bandwidth":
+			value, ok = formatTemplateValue(representation.Bandwidth, format)
+		case "Time":
+			value, ok = formatTemplateValue(strconv.FormatInt(time, 10), format)
+		case "Number":
+			value, ok = formatTemplateValue(strconv.Itoa(number), format)
+		default:
+			ok = false
+		}
+		if !ok {
+			value = "$" + identifier + "$"
+		}
+		res += value
+	}
+	return res + media
+}
+
+/* Build URL of a segment from a template */
+func (d *DASHDemuxer) buildTemplateURL(media string, representation DASHXMLRepresentation, time int64, number int) HTTPRequest {
+	return HTTPRequest{Url: d.baseURL + "/" + expandTemplate(media, representation, time, number)}
+}
+
+/*
+ Return start times of the segments of a SegmentTimeline. A negative repeat count
+ repeats a segment until the next S@t, or for the last one, while segments end
+ before end.
+ */
+func segmentTimelineTimes(segments []DASHXMLSegment, end int64) []int64 {
+	var res []int64
+	time := int64(0)
+	for i, s := range segments {
+		if s.Time != nil {
+			time = *s.Time
+		}
+		count := s.Repetition + 1
+		if s.Repetition < 0 && s.Duration > 0 {
+			if i + 1 < len(segments) && segments[i + 1].Time != nil {
+				count = int((*segments[i + 1].Time - time + int64(s.Duration) - 1) / int64(s.Duration))
+			} else {
+				count = int((end - time) / int64(s.Duration))
+			}
+		}
+		for j := 0; j < count; j++ {
+			res = append(res, time)
+			time += int64(s.Duration)
+		}
+	}
+	return res
+}
+
+/*
+ Return segments of a followed representation published since the last call. The
+ first call only returns the last segments before the live edge.
+ */
+func (d *DASHDemuxer) newLiveSegments(t *dashLiveTrack) []HTTPRequest {
+	var res []HTTPRequest
+	var times []int64
+	var numbers []int
+	template := t.adaptationSet.Template
+	timescale := template.Timescale
+	if timescale <= 0 {
+		timescale = 1
+	}
+	elapsed := d.live.now().Sub(d.live.availabilityStart).Seconds() - d.live.periodStart
+	if len(template.Segments) > 0 {
+		/* Segments of the SegmentTimeline, open repeats stop at now */
+		end := int64(elapsed * float64(timescale)) + template.PresentationTimeOffset
+		for i, time := range segmentTimelineTimes(template.Segments, end) {
+			if !t.started || time >= t.nextTime {
+				times = append(times, time)
+				numbers = append(numbers, template.StartNumber + i)
+			}
+		}
+	} else if template.Duration > 0 {
+		/* Segments of a fixed duration, the last one available ended before now */
+		last := template.StartNumber + int(elapsed * float64(timescale) / float64(template.Duration)) - 1
+		first := t.nextNumber
+		if !t.started {
+			first = last - DASH_LIVE_START_SEGMENTS + 1
+		}
+		if first < template.StartNumber {
+			first = template.StartNumber
+		}
+		for number := first; number <= last; number++ {
+			times = append(times, int64(number - template.StartNumber) * int64(template.Duration) + template.PresentationTimeOffset)
+			numbers = append(numbers, number)
+		}
+	}
+	if !t.started && len(template.Segments) > 0 && len(times) > DASH_LIVE_START_SEGMENTS {
+		times = times[len(times) - DASH_LIVE_START_SEGMENTS:]
+		numbers = numbers[len(numbers) - DASH_LIVE_START_SEGMENTS:]
+	}
+	for i := range times {
+		res = append(res, d.buildTemplateURL(template.Media, t.representation, times[i], numbers[i]))
+		t.nextNumber = numbers[i] + 1
+		if i + 1 < len(times) {
+			t.nextTime = times[i + 1]
+		} else if len(template.Segments) > 0 {
+			/* Next segment starts after the last one returned */
+			t.nextTime = times[i] + 1
+		}
+		t.started = true
+	}
+	return res
+}
+
+/* Initialise following of a dynamic manifest, chunks to extract are set for each track */
+func (d *DASHDemuxer) startLive(manifest *DASHManifest) error {
+	var err error
+	d.live = new(dashLiveState)
+	d.live.tracks = make(map[int]*dashLiveTrack)
+	if manifest.AvailabilityStartTime != "" {
+		d.live.availabilityStart, err = parseDASHDateTime(manifest.AvailabilityStartTime)
+		if err != nil { return err }
+	}
+	d.live.periodStart = parseDASHDuration(manifest.Period.Start)
+	d.live.updatePeriod = time.Duration(parseDASHDuration(manifest.MinimumUpdatePeriod) * float64(time.Second))
+	if d.live.updatePeriod <= 0 {
+		d.live.updatePeriod = DASH_LIVE_DEFAULT_UPDATE_PERIOD * time.Second
+	}
+	d.live.lastUpdate = time.Now()
+	d.live.syncClock(manifest.UTCTimings)
+	return nil
+}
+
+/* Follow a representation of a dynamic manifest, return URLs of its first chunks */
+func (d *DASHDemuxer) followLiveTrack(index int, adaptationSet DASHXMLAdaptionSet, representation DASHXMLRepresentation) *utils.Queue {
+	res := utils.Queue{}
+	t := &dashLiveTrack{adaptationSet: adaptationSet, representation: representation}
+	d.live.tracks[index] = t
+	for _, request := range d.newLiveSegments(t) {
+		res.Push(request)
+	}
+	return &res
+}
+
+/*
+ Add chunks published since the last update to the tracks of a dynamic source. The
+ manifest is reloaded every minimumUpdatePeriod, segments of fixed duration are
+ computed from the wall clock. The source ends when its manifest becomes static.
+ */
+func (d *DASHDemuxer) updateLive() {
+	if time.Since(d.live.lastUpdate) >= d.live.updatePeriod {
+		d.live.lastUpdate = time.Now()
+		manifest, err := d.fetchManifest()
+		if err == nil && manifest.Type != "dynamic" {
+			d.live.ended = true
+		}
+		if err == nil {
+			/* Representations are matched by their id */
+			for _, as := range manifest.Period.AdaptationSets {
+				for _, r := range as.Representations {
+					for _, t := range d.live.tracks {
+						if t.representation.Id == r.Id {
+							t.adaptationSet = as
+							t.representation = r
+						}
+					}
+				}
+			}
+		}
+	}
+	for index, t := range d.live.tracks {
+		for _, request := range d.newLiveSegments(t) {
+			d.chunksURL[index].Push(request)
+		}
+	}
+}
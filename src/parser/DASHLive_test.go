@@ -0,0 +1,99 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+  "time"
+  "testing"
+  "encoding/xml"
+)
+
+func segmentTime(t int64) *int64 {
+  return &t
+}
+
+func TestDASHLiveSegments(t *testing.T) {
+  d := DASHDemuxer{baseURL: "http://host"}
+  d.live = &dashLiveState{availabilityStart: time.Now().Add(-100 * time.Second)}
+  representation := DASHXMLRepresentation{Id: "v1"}
+  number := DASHXMLAdaptionSet{Template: DASHXMLSegmentTemplate{Timescale: 1000, Duration: 2000, StartNumber: 1, Media: "$RepresentationID$_$Number$.m4s"}}
+  live := &dashLiveTrack{adaptationSet: number, representation: representation}
+  segments := d.newLiveSegments(live)
+  if len(segments) != DASH_LIVE_START_SEGMENTS || segments[2].Url != "http://host/v1_50.m4s" {
+    t.Errorf("bad segments at live edge. got %v", segments)
+  }
+  if segments = d.newLiveSegments(live); len(segments) != 0 {
+    t.Errorf("no new segment expected. got %v", segments)
+  }
+  timeline := DASHXMLAdaptionSet{Template: DASHXMLSegmentTemplate{Media: "$Time$.m4s", Segments: []DASHXMLSegment{{Time: segmentTime(1000), Duration: 10, Repetition: 4}}}}
+  live = &dashLiveTrack{adaptationSet: timeline, representation: representation}
+  segments = d.newLiveSegments(live)
+  if len(segments) != DASH_LIVE_START_SEGMENTS || segments[0].Url != "http://host/1020.m4s" {
+    t.Errorf("bad timeline segments. got %v", segments)
+  }
+  live.adaptationSet.Template.Segments = []DASHXMLSegment{{Time: segmentTime(1030), Duration: 10, Repetition: 2}}
+  segments = d.newLiveSegments(live)
+  if len(segments) != 1 || segments[0].Url != "http://host/1050.m4s" {
+    t.Errorf("bad appended segments. got %v", segments)
+  }
+}
+
+func TestSegmentTimelineRepeat(t *testing.T) {
+  /* Explicit t="0" restarts the timeline, r="-1" repeats until the next S@t */
+  var template DASHXMLSegmentTemplate
+  data := `<SegmentTemplate><SegmentTimeline><S t="50" d="10"/><S t="0" d="10" r="-1"/><S t="35" d="5" r="1"/></SegmentTimeline></SegmentTemplate>`
+  if err := xml.Unmarshal([]byte(data), &template); err != nil {
+    t.Fatalf("can't parse template: %v", err)
+  }
+  want := []int64{50, 0, 10, 20, 30, 35, 40}
+  got := segmentTimelineTimes(template.Segments, 0)
+  if len(got) != len(want) {
+    t.Fatalf("bad segment count. want %v, got %v", want, got)
+  }
+  for i := range want {
+    if got[i] != want[i] {
+      t.Errorf("bad segment %d time. want %d, got %d", i, want[i], got[i])
+    }
+  }
+
+  /* Last S with r="-1" repeats until the live edge */
+  d := DASHDemuxer{baseURL: "http://host"}
+  d.live = &dashLiveState{availabilityStart: time.Now().Add(-100 * time.Second)}
+  open := DASHXMLAdaptionSet{Template: DASHXMLSegmentTemplate{Timescale: 1000, Media: "$Time$.m4s", Segments: []DASHXMLSegment{{Time: segmentTime(0), Duration: 2000, Repetition: -1}}}}
+  live := &dashLiveTrack{adaptationSet: open, representation: DASHXMLRepresentation{Id: "v1"}}
+  segments := d.newLiveSegments(live)
+  if len(segments) != DASH_LIVE_START_SEGMENTS || segments[2].Url != "http://host/98000.m4s" {
+    t.Errorf("bad open repeat segments. got %v", segments)
+  }
+}
+
+func TestExpandTemplate(t *testing.T) {
+  representation := DASHXMLRepresentation{Id: "v1", Bandwidth: "500000"}
+  for _, c := range []struct {
+    media, want string
+  }{
+    {"$RepresentationID$/$Number$.m4s", "v1/42.m4s"},
+    {"$RepresentationID$/$Number%05d$.m4s", "v1/00042.m4s"},
+    {"$Time%d$_$Time$.m4s", "90000_90000.m4s"},
+    {"$Number%01d$_$Bandwidth%08d$.m4s", "42_00500000.m4s"},
+    {"price$$_$Number$$$.m4s", "price$_42$.m4s"},
+    {"$Unknown$_$Number%5x$_$Number$.m4s", "$Unknown$_$Number%5x$_42.m4s"},
+    {"$Number$_$Time", "42_$Time"},
+  } {
+    if got := expandTemplate(c.media, representation, 90000, 42); got != c.want {
+      t.Errorf("bad expansion of %q. want %q, got %q", c.media, c.want, got)
+    }
+  }
+}
@@ -26,6 +26,38 @@ type Demuxer interface {
 	ExtractChunk(tracks *[]*Track, isLive bool) bool
 }
 
+/* Demuxer able to index its whole source and to extract any chunk on request */
+type IndexedDemuxer interface {
+	Demuxer
+	BuildIndex(tracks *[]*Track) error
+	ExtractIndexedChunk(track *Track, chunk int) error
+}
+
+/* Demuxer able to decrypt its encrypted source with keys given by key id (hexadecimal) */
+type DecryptingDemuxer interface {
+	Demuxer
+	SetDecryptionKeys(keys map[string]string) error
+}
+
+/* Demuxer stopping its extraction on errors, reporting why it stopped */
+type FailingDemuxer interface {
+	Demuxer
+	Err() error
+}
+
+/* Demuxer of a live network stream, reporting why its extraction stopped */
+type StreamDemuxer interface {
+	Demuxer
+	SetInputOptions(options map[string]string, readTimeout float64)
+	Err() error
+}
+
+/* Demuxer of a remote file, requested with custom HTTP headers and credentials */
+type RemoteDemuxer interface {
+	Demuxer
+	SetHeaders(headers map[string]string, username string, password string)
+}
+
 type DemuxerConstructor func() Demuxer
 
 var demuxerConstructors map[string]DemuxerConstructor
@@ -42,12 +74,28 @@ func smoothConstructor() Demuxer {
 	return new(SmoothDemuxer)
 }
 
+func hlsConstructor() Demuxer {
+	return new(HLSDemuxer)
+}
+
+func ingestConstructor() Demuxer {
+	return new(IngestDemuxer)
+}
+
 /* Initialise specifics for each demuxer interface */
 func InitialiseDemuxers() error {
 	demuxerConstructors = make(map[string]DemuxerConstructor)
 	demuxerConstructors["file"] = fileConstructor
 	demuxerConstructors["dash"] = dashConstructor
 	demuxerConstructors["smooth"] = smoothConstructor
+	demuxerConstructors["hls"] = hlsConstructor
+	demuxerConstructors[INGEST_PROTOCOL] = ingestConstructor
+	for _, proto := range streamProtocols {
+		demuxerConstructors[proto] = streamConstructor(proto)
+	}
+	for _, proto := range remoteProtocols {
+		demuxerConstructors[proto] = streamConstructor(proto)
+	}
 	err := FFMPEGInitialise()
 	return err
 }
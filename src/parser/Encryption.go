@@ -0,0 +1,331 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"errors"
+	"strings"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/cipher"
+	"encoding/hex"
+	"encoding/binary"
+)
+
+/* Common Encryption schemes used to encrypt clear inputs */
+const (
+	ENCRYPTION_SCHEME_CENC = "cenc"
+	ENCRYPTION_SCHEME_CBCS = "cbcs"
+)
+
+/* Pattern of cbcs video : one encrypted block out of ten */
+const (
+	CBCS_CRYPT_BLOCKS = 1
+	CBCS_SKIP_BLOCKS  = 9
+)
+
+/* W3C ClearKey DRM system */
+const CLEARKEY_SYSTEM_ID = "E2719D58A985B3C9781AB030AF78D30E"
+
+/* Bytes left clear at the beginning of video NAL units, covering NAL and slice headers */
+const ENCRYPTION_CLEAR_LEAD = 32
+
+/* Content key of an asset, values are in hexadecimal */
+type EncryptionKey struct {
+	Scheme string
+	KeyId  string
+	Key    string
+	IV     string
+}
+
+/* Decode an hexadecimal value of a given size in bytes, dashes of UUIDs are ignored */
+func parseHexValue(name string, value string, size int) ([]byte, error) {
+	res, err := hex.DecodeString(strings.Replace(value, "-", "", -1))
+	if err != nil || len(res) != size {
+		return nil, errors.New("Invalid encryption " + name + " '" + value + "'")
+	}
+	return res, nil
+}
+
+/*
+ Encrypt samples of the track with a content key when they are packaged. Text tracks
+ stay clear, tracks already encrypted in the input are left untouched. Position is
+ the rank of the track in its presentation : with cenc, it is mixed in the first
+ bytes of a given IV so that tracks sharing the key never reuse a keystream, sample
+ decode times being mixed in the other bytes (see nextIV).
+ */
+func (t *Track) SetEncryption(key *EncryptionKey, position int) error {
+	var err error
+	if key == nil || t.isText || t.encryptInfos != nil {
+		return nil
+	}
+	info := new(EncryptionInfo)
+	info.scheme = key.Scheme
+	if info.scheme == "" {
+		info.scheme = ENCRYPTION_SCHEME_CENC
+	} else if info.scheme != ENCRYPTION_SCHEME_CENC && info.scheme != ENCRYPTION_SCHEME_CBCS {
+		return errors.New("Unsupported encryption scheme '" + key.Scheme + "'")
+	}
+	keyId, err := parseHexValue("key id", key.KeyId, 16)
+	if err != nil { return err }
+	info.keyId = hex.EncodeToString(keyId)
+	info.key, err = parseHexValue("key", key.Key, 16)
+	if err != nil { return err }
+	/* cenc IVs are incremented for each sample, cbcs uses a constant IV */
+	ivSize := 8
+	if info.scheme == ENCRYPTION_SCHEME_CBCS {
+		ivSize = 16
+	}
+	if key.IV != "" {
+		info.iv, err = parseHexValue("IV", key.IV, ivSize)
+		if err != nil { return err }
+		if info.scheme == ENCRYPTION_SCHEME_CENC {
+			info.iv[0] ^= byte(position >> 8)
+			info.iv[1] ^= byte(position)
+			info.fixedIV = true
+		}
+	} else {
+		info.iv = make([]byte, ivSize)
+		_, err = rand.Read(info.iv)
+		if err != nil { return err }
+	}
+	/* Video is encrypted by subsamples, NAL headers stay clear */
+	info.subEncrypt = !t.isAudio
+	if info.scheme == ENCRYPTION_SCHEME_CBCS && !t.isAudio {
+		info.cryptBlocks = CBCS_CRYPT_BLOCKS
+		info.skipBlocks = CBCS_SKIP_BLOCKS
+	}
+	t.encryptInfos = info
+	return nil
+}
+
+/*
+ Signal the key of a track encrypted at packaging time with ClearKey, licenses
+ being requested to licenseUrl. The pssh atom lists the key id.
+ */
+func (t *Track) SetClearKey(licenseUrl string) {
+	info := t.encryptInfos
+	if info == nil || info.key == nil || licenseUrl == "" {
+		return
+	}
+	keyId, err := hex.DecodeString(info.keyId)
+	if err != nil {
+		return
+	}
+	info.licenseUrl = licenseUrl
+	info.pssList = append(info.pssList, pss{CLEARKEY_SYSTEM_ID, nil, [][]byte{keyId}})
+}
+
+/* Decode keys given by key id, both in hexadecimal */
+func parseDecryptionKeys(keys map[string]string) (map[string][]byte, error) {
+	res := make(map[string][]byte)
+	for keyId, key := range keys {
+		id, err := parseHexValue("key id", keyId, 16)
+		if err != nil { return nil, err }
+		res[hex.EncodeToString(id)], err = parseHexValue("key", key, 16)
+		if err != nil { return nil, err }
+	}
+	return res, nil
+}
+
+/*
+ Remove encryption of the input if its key is known, samples are then decrypted
+ when extracted and the track is packaged as a clear one. Only the cenc scheme
+ (AES-CTR without pattern) can be decrypted, smooth sources giving no scheme use it.
+ */
+func (t *Track) setDecryptionKey(keys map[string][]byte) error {
+	if t.encryptInfos == nil || keys[t.encryptInfos.keyId] == nil {
+		return nil
+	}
+	if t.encryptInfos.scheme != "" && t.encryptInfos.scheme != ENCRYPTION_SCHEME_CENC {
+		return errors.New("Decryption of scheme '" + t.encryptInfos.scheme + "' is not supported, only " + ENCRYPTION_SCHEME_CENC + " inputs can be decrypted")
+	}
+	t.decryptKey = keys[t.encryptInfos.keyId]
+	t.encryptInfos = nil
+	return nil
+}
+
+/* Decrypt extracted samples of a cenc (AES-CTR) input using their IV and subsamples */
+func (t *Track) decryptSamples() error {
+	if t.decryptKey == nil {
+		return nil
+	}
+	block, err := aes.NewCipher(t.decryptKey)
+	if err != nil { return err }
+	for _, s := range t.samples {
+		if s.encrypt == nil || s.data == nil {
+			continue
+		}
+		data := s.GetData()
+		size := 0
+		for _, sub := range s.encrypt.subEncrypt {
+			size += sub.clear + sub.encrypted
+		}
+		if size > len(data) {
+			return errors.New("Encrypted subsamples larger than their sample")
+		}
+		/* CTR decryption is the same operation as encryption */
+		encryptCTR(block, s.encrypt.initializationVector, data, s.encrypt.subEncrypt)
+		s.setData(data)
+		s.encrypt = nil
+	}
+	return nil
+}
+
+/* Return if samples of the track are encrypted in the input */
+func (t *Track) sourceEncrypted() bool {
+	return t.encryptInfos != nil && t.encryptInfos.key == nil
+}
+
+/*
+ Return IV of the next cenc sample, decoded at dts. A random IV is incremented for
+ each sample. A given IV is the same on every build (restart, just in time index
+ rebuilt, file generated again) : the decode time is then mixed in its last 6 bytes,
+ so that a sample encrypted again gets the same IV and every other one a distinct IV.
+ */
+func (info *EncryptionInfo) nextIV(dts int64) []byte {
+	res := make([]byte, len(info.iv))
+	if info.fixedIV {
+		binary.BigEndian.PutUint64(res, binary.BigEndian.Uint64(info.iv) ^ (uint64(dts) & 0xFFFFFFFFFFFF))
+		return res
+	}
+	copy(res, info.iv)
+	binary.BigEndian.PutUint64(info.iv, binary.BigEndian.Uint64(info.iv) + 1)
+	return res
+}
+
+/* Append a subsample, clear bytes are split to fit on 16 bits */
+func appendSubsample(subsamples []SubSampleEncryption, clear int, encrypted int) []SubSampleEncryption {
+	for clear > 0xFFFF {
+		subsamples = append(subsamples, SubSampleEncryption{0xFFFF, 0})
+		clear -= 0xFFFF
+	}
+	return append(subsamples, SubSampleEncryption{clear, encrypted})
+}
+
+/*
+ Compute subsamples of a video sample with 4 bytes NAL unit sizes. Only slices are
+ encrypted, after their first bytes. With cenc, encrypted parts are whole blocks.
+ Samples that can't be parsed stay clear.
+ */
+func videoSubsamples(data []byte, hevc bool, scheme string) []SubSampleEncryption {
+	var res []SubSampleEncryption
+	clear := 0
+	offset := 0
+	for offset + 4 <= len(data) {
+		size := int(binary.BigEndian.Uint32(data[offset:offset + 4]))
+		if size <= 0 || offset + 4 + size > len(data) {
+			return appendSubsample(nil, len(data), 0)
+		}
+		vcl := false
+		if hevc {
+			vcl = (data[offset + 4] >> 1) & 0x3F < 32
+		} else {
+			nalType := data[offset + 4] & 0x1F
+			vcl = nalType >= 1 && nalType <= 5
+		}
+		encrypted := 0
+		if vcl && size > ENCRYPTION_CLEAR_LEAD {
+			encrypted = size - ENCRYPTION_CLEAR_LEAD
+			if scheme != ENCRYPTION_SCHEME_CBCS {
+				encrypted -= encrypted % aes.BlockSize
+			}
+		}
+		clear += 4 + size - encrypted
+		if encrypted > 0 {
+			res = appendSubsample(res, clear, encrypted)
+			clear = 0
+		}
+		offset += 4 + size
+	}
+	clear += len(data) - offset
+	if clear > 0 || len(res) == 0 {
+		res = appendSubsample(res, clear, 0)
+	}
+	return res
+}
+
+/* Encrypt a sample with AES-CTR, the counter goes on between subsamples */
+func encryptCTR(block cipher.Block, iv []byte, data []byte, subsamples []SubSampleEncryption) {
+	counter := make([]byte, aes.BlockSize)
+	copy(counter, iv)
+	stream := cipher.NewCTR(block, counter)
+	if subsamples == nil {
+		stream.XORKeyStream(data, data)
+		return
+	}
+	offset := 0
+	for _, s := range subsamples {
+		offset += s.clear
+		stream.XORKeyStream(data[offset:offset + s.encrypted], data[offset:offset + s.encrypted])
+		offset += s.encrypted
+	}
+}
+
+/* Encrypt whole blocks of a range with AES-CBC following a pattern (0:0 encrypts every block) */
+func encryptPattern(block cipher.Block, iv []byte, data []byte, cryptBlocks int, skipBlocks int) {
+	mode := cipher.NewCBCEncrypter(block, iv)
+	offset := 0
+	for offset + aes.BlockSize <= len(data) {
+		size := (len(data) - offset) / aes.BlockSize * aes.BlockSize
+		if cryptBlocks > 0 && size > cryptBlocks * aes.BlockSize {
+			size = cryptBlocks * aes.BlockSize
+		}
+		mode.CryptBlocks(data[offset:offset + size], data[offset:offset + size])
+		offset += size + skipBlocks * aes.BlockSize
+	}
+}
+
+/* Encrypt a sample with AES-CBC pattern encryption, the constant IV is used for each subsample */
+func encryptCBCS(block cipher.Block, iv []byte, data []byte, subsamples []SubSampleEncryption, cryptBlocks int, skipBlocks int) {
+	if subsamples == nil {
+		encryptPattern(block, iv, data, cryptBlocks, skipBlocks)
+		return
+	}
+	offset := 0
+	for _, s := range subsamples {
+		offset += s.clear
+		encryptPattern(block, iv, data[offset:offset + s.encrypted], cryptBlocks, skipBlocks)
+		offset += s.encrypted
+	}
+}
+
+/* Encrypt samples waiting to be packaged, samples already encrypted are skipped */
+func (t *Track) encryptSamples() error {
+	info := t.encryptInfos
+	if info == nil || info.key == nil {
+		return nil
+	}
+	block, err := aes.NewCipher(info.key)
+	if err != nil { return err }
+	for _, s := range t.samples {
+		if s.encrypt != nil {
+			continue
+		}
+		data := s.GetData()
+		s.encrypt = new(SampleEncryption)
+		if info.subEncrypt {
+			s.encrypt.subEncrypt = videoSubsamples(data, t.isHEVC(), info.scheme)
+		}
+		if info.scheme == ENCRYPTION_SCHEME_CBCS {
+			encryptCBCS(block, info.iv, data, s.encrypt.subEncrypt, info.cryptBlocks, info.skipBlocks)
+		} else {
+			s.encrypt.initializationVector = info.nextIV(s.dts)
+			encryptCTR(block, s.encrypt.initializationVector, data, s.encrypt.subEncrypt)
+		}
+		s.setData(data)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+  "bytes"
+  "strings"
+  "crypto/aes"
+  "encoding/hex"
+  "testing"
+)
+
+func TestSampleEncryption(t *testing.T) {
+  track := Track{}
+  err := track.SetEncryption(&EncryptionKey{
+    Scheme: "cbcs",
+    KeyId: "0123456789abcdef-0123-456789abcdef",
+    Key: "00112233445566778899aabbccddeeff",
+    IV: "0f0e0d0c0b0a09080706050403020100",
+  }, 1)
+  if err != nil {
+    t.Fatalf("can't set encryption: %v", err)
+  }
+  tenc, err := buildTENC(track)
+  if err != nil {
+    t.Fatalf("can't build tenc: %v", err)
+  }
+  if got := hex.EncodeToString(tenc); got != "0000003174656e6301000000001901000123456789abcdef0123456789abcdef100f0e0d0c0b0a09080706050403020100" {
+    t.Errorf("bad cbcs tenc. got %s", got)
+  }
+  if err := track.SetEncryption(&EncryptionKey{Scheme: "cens"}, 0); err != nil {
+    t.Errorf("encryption of an encrypted track should be ignored. got %v", err)
+  }
+  if err := (&Track{}).SetEncryption(&EncryptionKey{Scheme: "cens"}, 0); err == nil {
+    t.Errorf("scheme cens should be rejected")
+  }
+  /* cenc tracks sharing a key and an IV must not reuse a keystream */
+  first, second := Track{}, Track{}
+  key := &EncryptionKey{KeyId: "0123456789abcdef0123456789abcdef", Key: "00112233445566778899aabbccddeeff", IV: "0706050403020100"}
+  if err := first.SetEncryption(key, 0); err != nil {
+    t.Fatalf("can't set encryption: %v", err)
+  }
+  if err := second.SetEncryption(key, 1); err != nil {
+    t.Fatalf("can't set encryption: %v", err)
+  }
+  if got := hex.EncodeToString(first.encryptInfos.iv); got != "0706050403020100" {
+    t.Errorf("bad IV of first track. got %s", got)
+  }
+  if got := hex.EncodeToString(second.encryptInfos.iv); got != "0707050403020100" {
+    t.Errorf("bad IV of second track. got %s", got)
+  }
+
+  /* SPS of 10 bytes then a slice of 100 bytes */
+  data := append([]byte{0x0, 0x0, 0x0, 0xa, 0x67}, make([]byte, 9)...)
+  data = append(append(data, 0x0, 0x0, 0x0, 0x64, 0x65), make([]byte, 99)...)
+  for scheme, want := range map[string]SubSampleEncryption{"cenc": {54, 64}, "cbcs": {50, 68}} {
+    subsamples := videoSubsamples(data, false, scheme)
+    if len(subsamples) != 1 || subsamples[0] != want {
+      t.Errorf("bad %s subsamples. want %v, got %v", scheme, want, subsamples)
+    }
+  }
+  if subsamples := videoSubsamples([]byte{0x0, 0x0, 0x0, 0x20, 0x65}, false, "cenc"); len(subsamples) != 1 || subsamples[0].encrypted != 0 {
+    t.Errorf("truncated sample should stay clear. got %v", subsamples)
+  }
+
+  /* CTR encryption only changes encrypted bytes and is its own inverse */
+  block, _ := aes.NewCipher(make([]byte, 16))
+  info := EncryptionInfo{iv: []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xff}}
+  iv := info.nextIV(0)
+  if hex.EncodeToString(info.iv) != "0000000000000100" {
+    t.Errorf("bad next IV. got %x", info.iv)
+  }
+  /* A given IV does not depend on the samples encrypted before */
+  fixed := EncryptionInfo{iv: []byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0xff}, fixedIV: true}
+  for i := 0; i < 2; i++ {
+    if got := hex.EncodeToString(fixed.nextIV(0x1234)); got != "00010000000012cb" {
+      t.Errorf("bad IV from decode time. got %s", got)
+    }
+  }
+  if hex.EncodeToString(fixed.nextIV(0x1235)) == hex.EncodeToString(fixed.nextIV(0x1234)) {
+    t.Errorf("samples with distinct decode times should get distinct IVs")
+  }
+  subsamples := videoSubsamples(data, false, "cenc")
+  encrypted := append([]byte{}, data...)
+  encryptCTR(block, iv, encrypted, subsamples)
+  if hex.EncodeToString(encrypted[:54]) != hex.EncodeToString(data[:54]) || hex.EncodeToString(encrypted[54:118]) == hex.EncodeToString(data[54:118]) {
+    t.Errorf("bad encrypted ranges")
+  }
+  encryptCTR(block, iv, encrypted, subsamples)
+  if hex.EncodeToString(encrypted) != hex.EncodeToString(data) {
+    t.Errorf("CTR encryption is not reversible")
+  }
+}
+
+func TestContentProtection(t *testing.T) {
+  if (&Track{}).BuildContentProtection() != "" {
+    t.Errorf("clear track should have no ContentProtection")
+  }
+  keyId := []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+  track := Track{encryptInfos: &EncryptionInfo{keyId: hex.EncodeToString(keyId)}}
+  track.encryptInfos.pssList = append(track.encryptInfos.pssList, buildWidevinePSS(keyId))
+  track.encryptInfos.pssList = append(track.encryptInfos.pssList, pss{"9A04F07998404286AB92E65BE0885F95", []byte{0x1, 0x2}, nil})
+  res := track.BuildContentProtection()
+  for _, want := range []string{
+    `schemeIdUri="urn:mpeg:dash:mp4protection:2011"`,
+    `value="cenc"`,
+    `cenc:default_KID="01234567-89ab-cdef-0123-456789abcdef"`,
+    `schemeIdUri="urn:uuid:edef8ba9-79d6-4ace-a3c8-27dcd51d21ed"`,
+    `schemeIdUri="urn:uuid:9a04f079-9840-4286-ab92-e65be0885f95"`,
+    `<cenc:pssh>AAAAInBzc2gAAAAAmgTweZhAQoarkuZb4IhflQAAAAIBAg==</cenc:pssh>`,
+    `<mspr:pro>AQI=</mspr:pro>`,
+  } {
+    if !strings.Contains(res, want) {
+      t.Errorf("missing %s in ContentProtection. got %s", want, res)
+    }
+  }
+}
+
+func TestClearKey(t *testing.T) {
+  track := Track{}
+  track.SetClearKey("/license/clearkey")
+  if track.encryptInfos != nil {
+    t.Errorf("ClearKey should be ignored for clear tracks")
+  }
+  err := track.SetEncryption(&EncryptionKey{KeyId: "0123456789abcdef0123456789abcdef", Key: "00112233445566778899aabbccddeeff"}, 0)
+  if err != nil {
+    t.Fatalf("can't set encryption: %v", err)
+  }
+  track.SetClearKey("/license/clearkey?a=1&b=2")
+  if len(track.encryptInfos.pssList) != 1 {
+    t.Fatalf("bad pss count. want 1, got %d", len(track.encryptInfos.pssList))
+  }
+  pssh, err := buildPSSH(track.encryptInfos.pssList[0])
+  if err != nil {
+    t.Fatalf("can't build pssh: %v", err)
+  }
+  if got := hex.EncodeToString(pssh); got != "000000347073736801000000e2719d58a985b3c9781ab030af78d30e000000010123456789abcdef0123456789abcdef00000000" {
+    t.Errorf("bad ClearKey pssh. got %s", got)
+  }
+  res := track.BuildContentProtection()
+  for _, want := range []string{
+    `schemeIdUri="urn:uuid:e2719d58-a985-b3c9-781a-b030af78d30e"`,
+    `<clearkey:Laurl Lic_type="EME-1.0">/license/clearkey?a=1&amp;b=2</clearkey:Laurl>`,
+    `<dashif:laurl>/license/clearkey?a=1&amp;b=2</dashif:laurl>`,
+  } {
+    if !strings.Contains(res, want) {
+      t.Errorf("missing %s in ContentProtection. got %s", want, res)
+    }
+  }
+}
+
+func TestSampleDecryption(t *testing.T) {
+  keys, err := parseDecryptionKeys(map[string]string{"01234567-89ab-cdef-0123-456789abcdef": "00112233445566778899aabbccddeeff"})
+  if err != nil {
+    t.Fatalf("can't parse keys: %v", err)
+  }
+  if _, err := parseDecryptionKeys(map[string]string{"0123": "00"}); err == nil {
+    t.Errorf("invalid key id should be rejected")
+  }
+  track := Track{encryptInfos: &EncryptionInfo{keyId: "fedcba9876543210fedcba9876543210"}}
+  track.setDecryptionKey(keys)
+  if track.encryptInfos == nil || track.decryptKey != nil {
+    t.Errorf("track with an unknown key should stay encrypted")
+  }
+  track.encryptInfos.keyId = "0123456789abcdef0123456789abcdef"
+  track.setDecryptionKey(keys)
+  if track.encryptInfos != nil || track.decryptKey == nil {
+    t.Fatalf("track with a known key should be decrypted")
+  }
+
+  clear := make([]byte, 64)
+  for i := range clear {
+    clear[i] = byte(i)
+  }
+  encrypted := append([]byte{}, clear...)
+  iv := []byte{0x0, 0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7}
+  subsamples := []SubSampleEncryption{{10, 32}, {6, 16}}
+  block, _ := aes.NewCipher(track.decryptKey)
+  encryptCTR(block, iv, encrypted, subsamples)
+  sample := &Sample{data: CArray(encrypted), size: CInt(len(encrypted))}
+  sample.encrypt = &SampleEncryption{initializationVector: iv, subEncrypt: subsamples}
+  track.samples = []*Sample{sample}
+  if err := track.decryptSamples(); err != nil {
+    t.Fatalf("can't decrypt samples: %v", err)
+  }
+  if sample.encrypt != nil || hex.EncodeToString(sample.GetData()) != hex.EncodeToString(clear) {
+    t.Errorf("bad decrypted sample. got %x", sample.GetData())
+  }
+}
+
+func TestDecryptionScheme(t *testing.T) {
+  keys, _ := parseDecryptionKeys(map[string]string{"0123456789abcdef0123456789abcdef": "00112233445566778899aabbccddeeff"})
+  /* schm atom body : version and flags, scheme type, scheme version */
+  for scheme, supported := range map[string]bool{"cenc": true, "cbcs": false, "cens": false, "cbc1": false} {
+    track := Track{}
+    body := append([]byte{0x0, 0x0, 0x0, 0x0}, append([]byte(scheme), 0x0, 0x1, 0x0, 0x0)...)
+    d := DASHDemuxer{}
+    d.parseDASHSCHM(bytes.NewReader(body), 8 + len(body), &track)
+    if track.encryptInfos == nil || track.encryptInfos.scheme != scheme {
+      t.Fatalf("bad parsed scheme. want %s", scheme)
+    }
+    track.encryptInfos.keyId = "0123456789abcdef0123456789abcdef"
+    err := track.setDecryptionKey(keys)
+    if supported && (err != nil || track.decryptKey == nil) {
+      t.Errorf("scheme %s should be decrypted. got %v", scheme, err)
+    }
+    if !supported && (err == nil || track.decryptKey != nil) {
+      t.Errorf("scheme %s should be rejected", scheme)
+    }
+  }
+}
@@ -0,0 +1,480 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"time"
+	"utils"
+	"bufio"
+	"errors"
+	"strings"
+	"strconv"
+	"net/url"
+	"net/http"
+	"io/ioutil"
+)
+
+/* Number of segments before the end of a live playlist extracted when it is opened */
+const HLS_LIVE_START_SEGMENTS = 3
+
+/* Variant stream declared in a master playlist */
+type hlsVariant struct {
+	uri   string
+	audio string
+}
+
+/* Alternative rendition declared in a master playlist */
+type hlsMedia struct {
+	mediaType string
+	uri       string
+	language  string
+	name      string
+	isDefault bool
+}
+
+/* Media segment of a playlist */
+type hlsSegment struct {
+	url      string
+	duration float64
+	sequence int
+}
+
+/* Content of a master or media playlist */
+type hlsPlaylist struct {
+	variants       []hlsVariant
+	media          []hlsMedia
+	segments       []hlsSegment
+	mapURL         string
+	targetDuration float64
+	ended          bool
+	encrypted      bool
+}
+
+/* Media playlist followed by the demuxer and tracks extracted from its segments */
+type hlsRendition struct {
+	url          string
+	keepVideo    bool
+	keepAudio    bool
+	language     string
+	label        string
+	role         string
+	mapURL       string
+	fmp4         *DASHDemuxer
+	sources      []int
+	indexes      []int
+	segments     utils.Queue
+	nextSequence int
+	duration     float64
+	reloadPeriod time.Duration
+	lastReload   time.Time
+	ended        bool
+}
+
+/* Demuxer structure for HLS sources, segments are either MPEG-TS or fMP4 */
+type HLSDemuxer struct {
+	manifestURL string
+	renditions  []*hlsRendition
+}
+
+/* Parse attributes of a tag (ex: BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2") */
+func parseHLSAttributes(list string) map[string]string {
+	res := make(map[string]string)
+	for len(list) > 0 {
+		eq := strings.Index(list, "=")
+		if eq < 0 {
+			break
+		}
+		name := strings.TrimSpace(list[:eq])
+		list = list[eq + 1:]
+		value := ""
+		if strings.HasPrefix(list, "\"") {
+			end := strings.Index(list[1:], "\"")
+			if end < 0 {
+				end = len(list) - 1
+			}
+			value = list[1:end + 1]
+			list = list[end + 1:]
+			if len(list) > 0 {
+				list = list[1:]
+			}
+		}
+		comma := strings.Index(list, ",")
+		if comma < 0 {
+			comma = len(list)
+		}
+		if value == "" {
+			value = list[:comma]
+		}
+		res[name] = value
+		list = strings.TrimPrefix(list[comma:], ",")
+	}
+	return res
+}
+
+/* Resolve a URI of a playlist relative to the playlist URL */
+func resolveHLSURL(base string, uri string) string {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return uri
+	}
+	ref, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	return baseURL.ResolveReference(ref).String()
+}
+
+/* Parse a master or media playlist, URIs are resolved against its URL */
+func parseHLSPlaylist(playlistURL string, content string) (*hlsPlaylist, error) {
+	res := new(hlsPlaylist)
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	sequence := 0
+	duration := 0.0
+	streamInf := false
+	audio := ""
+	first := true
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if first && line != "#EXTM3U" {
+			return nil, errors.New("Invalid playlist '" + playlistURL + "'")
+		}
+		first = false
+		tag := line
+		attributes := ""
+		if colon := strings.Index(line, ":"); colon >= 0 && strings.HasPrefix(line, "#") {
+			tag = line[:colon]
+			attributes = line[colon + 1:]
+		}
+		switch tag {
+		case "#EXT-X-STREAM-INF":
+			streamInf = true
+			audio = parseHLSAttributes(attributes)["AUDIO"]
+		case "#EXT-X-MEDIA":
+			attrs := parseHLSAttributes(attributes)
+			media := hlsMedia{mediaType: attrs["TYPE"], language: attrs["LANGUAGE"], name: attrs["NAME"], isDefault: attrs["DEFAULT"] == "YES"}
+			if attrs["URI"] != "" {
+				media.uri = resolveHLSURL(playlistURL, attrs["URI"])
+			}
+			res.media = append(res.media, media)
+		case "#EXT-X-TARGETDURATION":
+			res.targetDuration, _ = strconv.ParseFloat(attributes, 64)
+		case "#EXT-X-MEDIA-SEQUENCE":
+			sequence, _ = strconv.Atoi(attributes)
+		case "#EXTINF":
+			duration, _ = strconv.ParseFloat(strings.Split(attributes, ",")[0], 64)
+		case "#EXT-X-MAP":
+			res.mapURL = resolveHLSURL(playlistURL, parseHLSAttributes(attributes)["URI"])
+		case "#EXT-X-KEY":
+			res.encrypted = res.encrypted || parseHLSAttributes(attributes)["METHOD"] != "NONE"
+		case "#EXT-X-BYTERANGE":
+			return nil, errors.New("Byte range segments are not supported in '" + playlistURL + "'")
+		case "#EXT-X-ENDLIST":
+			res.ended = true
+		default:
+			if strings.HasPrefix(line, "#") {
+				continue
+			}
+			/* Line is an URI, of a variant or of a segment */
+			uri := resolveHLSURL(playlistURL, line)
+			if streamInf {
+				res.variants = append(res.variants, hlsVariant{uri, audio})
+				streamInf = false
+			} else {
+				res.segments = append(res.segments, hlsSegment{uri, duration, sequence})
+				sequence++
+			}
+		}
+	}
+	return res, scanner.Err()
+}
+
+/* Download and parse a playlist */
+func fetchHLSPlaylist(playlistURL string) (*hlsPlaylist, error) {
+	resp, err := http.Get(playlistURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Can't retrieve playlist '" + playlistURL + "' : " + resp.Status)
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return parseHLSPlaylist(playlistURL, string(content))
+}
+
+/*
+ Return renditions followed for a master playlist : every variant for its video,
+ alternative audio renditions, and audio muxed in the first variant without an
+ audio group.
+ */
+func hlsRenditions(master *hlsPlaylist) []*hlsRendition {
+	var res []*hlsRendition
+	seen := make(map[string]bool)
+	audioTaken := false
+	for _, v := range master.variants {
+		if seen[v.uri] {
+			continue
+		}
+		seen[v.uri] = true
+		r := &hlsRendition{url: v.uri, keepVideo: true}
+		if v.audio == "" && !audioTaken {
+			r.keepAudio = true
+			audioTaken = true
+		}
+		res = append(res, r)
+	}
+	for _, m := range master.media {
+		if m.mediaType != "AUDIO" || m.uri == "" || seen[m.uri] {
+			continue
+		}
+		seen[m.uri] = true
+		r := &hlsRendition{url: m.uri, keepAudio: true, language: m.language, label: m.name}
+		if m.isDefault {
+			r.role = "main"
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+/* Add segments of a media playlist not queued yet, a live playlist is opened near its end */
+func (r *hlsRendition) update(playlist *hlsPlaylist, first bool) {
+	segments := playlist.segments
+	if first && !playlist.ended && len(segments) > HLS_LIVE_START_SEGMENTS {
+		segments = segments[len(segments) - HLS_LIVE_START_SEGMENTS:]
+	}
+	for _, s := range segments {
+		if !first && s.sequence < r.nextSequence {
+			continue
+		}
+		r.segments.Push(s)
+		r.duration += s.duration
+		r.nextSequence = s.sequence + 1
+	}
+	if first {
+		r.mapURL = playlist.mapURL
+	}
+	r.ended = playlist.ended
+	r.reloadPeriod = time.Duration(playlist.targetDuration * float64(time.Second))
+	r.lastReload = time.Now()
+}
+
+/*
+ Reload a live media playlist. An unchanged playlist is reloaded after half the target
+ duration, a changed one after the target duration again.
+ */
+func (r *hlsRendition) reload() {
+	playlist, err := fetchHLSPlaylist(r.url)
+	if err != nil {
+		r.lastReload = time.Now()
+		return
+	}
+	next := r.nextSequence
+	r.update(playlist, false)
+	target := time.Duration(playlist.targetDuration * float64(time.Second))
+	if r.nextSequence == next {
+		r.reloadPeriod = target / 2
+	} else {
+		r.reloadPeriod = target
+	}
+}
+
+/* Create tracks of a rendition from its fMP4 init segment */
+func (d *HLSDemuxer) probeFMP4(r *hlsRendition, acc *int, tracks *[]*Track) error {
+	r.fmp4 = new(DASHDemuxer)
+	r.fmp4.Open("")
+	track := new(Track)
+	err := r.fmp4.parseDASHFile(HTTPRequest{Url: r.mapURL}, track)
+	if err != nil { return err }
+	if (track.isAudio && !r.keepAudio) || (!track.isAudio && !r.keepVideo) {
+		return nil
+	}
+	if track.timescale == 0 {
+		track.timescale = track.globalTimescale
+	}
+	d.addTrack(r, track, 0, acc, tracks)
+	return nil
+}
+
+/* Create tracks of a rendition from its first MPEG-TS segment, with avcC/hvcC and AudioSpecificConfig built by FFMPEGDemuxer */
+func (d *HLSDemuxer) probeTS(r *hlsRendition, segment hlsSegment, acc *int, tracks *[]*Track) error {
+	var sources []*Track
+	demuxer := new(FFMPEGDemuxer)
+	err := demuxer.Open(segment.url)
+	if err != nil { return err }
+	defer demuxer.Close()
+	err = demuxer.GetTracks(&sources)
+	if err != nil { return err }
+	for _, track := range sources {
+		if track.isText || (track.isAudio && !r.keepAudio) || (!track.isAudio && !r.keepVideo) {
+			continue
+		}
+		d.addTrack(r, track, track.index, acc, tracks)
+	}
+	return nil
+}
+
+/* Add a track extracted from a rendition, source is its index in the segments */
+func (d *HLSDemuxer) addTrack(r *hlsRendition, track *Track, source int, acc *int, tracks *[]*Track) {
+	track.index = *acc
+	track.SetTimeFields()
+	if r.language != "" {
+		track.language = r.language
+	}
+	if r.label != "" {
+		track.label = r.label
+	}
+	if r.role != "" {
+		track.role = r.role
+	}
+	if r.ended {
+		track.duration = int(r.duration * float64(track.globalTimescale))
+	}
+	r.sources = append(r.sources, source)
+	r.indexes = append(r.indexes, track.index)
+	*tracks = append(*tracks, track)
+	*acc++
+}
+
+/* Initialise HLS demuxer, the path may start with its scheme (https://), http is used otherwise */
+func (d *HLSDemuxer) Open(path string) error {
+	d.manifestURL = path
+	if !strings.HasPrefix(path, "http://") && !strings.HasPrefix(path, "https://") {
+		d.manifestURL = "http://" + path
+	}
+	return nil
+}
+
+/* Retrieve all tracks from an HLS source, from a master or a media playlist */
+func (d *HLSDemuxer) GetTracks(tracks *[]*Track) error {
+	master, err := fetchHLSPlaylist(d.manifestURL)
+	if err != nil { return err }
+	if len(master.variants) > 0 {
+		d.renditions = hlsRenditions(master)
+	} else {
+		d.renditions = []*hlsRendition{{url: d.manifestURL, keepVideo: true, keepAudio: true}}
+	}
+	acc := 0
+	for _, r := range d.renditions {
+		/* The source may directly be a media playlist */
+		playlist := master
+		if len(master.variants) > 0 {
+			playlist, err = fetchHLSPlaylist(r.url)
+			if err != nil { return err }
+		}
+		if playlist.encrypted {
+			return errors.New("Encrypted HLS playlist '" + r.url + "' is not supported")
+		}
+		r.update(playlist, true)
+		if r.segments.Empty() {
+			continue
+		}
+		if r.mapURL != "" {
+			err = d.probeFMP4(r, &acc, tracks)
+		} else {
+			/* Segments queued first are the last ones of the playlist */
+			err = d.probeTS(r, playlist.segments[len(playlist.segments) - r.segments.Size()], &acc, tracks)
+		}
+		if err != nil { return err }
+	}
+	if acc == 0 {
+		return errors.New("No track found in HLS source '" + d.manifestURL + "'")
+	}
+	return nil
+}
+
+/* Extract samples of a MPEG-TS segment (length prefixed NAL units, AAC without ADTS) and add them to the tracks of its rendition */
+func (d *HLSDemuxer) extractTS(r *hlsRendition, segment hlsSegment, tracks []*Track) error {
+	var sources []*Track
+	demuxer := new(FFMPEGDemuxer)
+	err := demuxer.Open(segment.url)
+	if err != nil { return err }
+	defer demuxer.Close()
+	err = demuxer.GetTracks(&sources)
+	if err != nil { return err }
+	for demuxer.ExtractChunk(&sources, false) {
+	}
+	for i, source := range r.sources {
+		track := findTrack(tracks, r.indexes[i])
+		extracted := findTrack(sources, source)
+		if track == nil || extracted == nil {
+			continue
+		}
+		for _, s := range extracted.samples {
+			track.appendSample(s)
+		}
+	}
+	return nil
+}
+
+/* Extract samples of a segment of a rendition */
+func (d *HLSDemuxer) extractSegment(r *hlsRendition, segment hlsSegment, tracks []*Track) error {
+	if r.fmp4 == nil {
+		return d.extractTS(r, segment, tracks)
+	}
+	track := findTrack(tracks, r.indexes[0])
+	if track == nil {
+		return nil
+	}
+	return r.fmp4.parseDASHFile(HTTPRequest{Url: segment.url}, track)
+}
+
+/* Clean demuxer internal info */
+func (d *HLSDemuxer) Close() {
+	for _, r := range d.renditions {
+		r.segments.Clear()
+	}
+	d.renditions = nil
+}
+
+/*
+ Extract one segment for each rendition. Live playlists are reloaded every target
+ duration once their segments have been extracted, until they end.
+ */
+func (d *HLSDemuxer) ExtractChunk(tracks *[]*Track, isLive bool) bool {
+	var waitList []chan error
+	res := false
+	for _, r := range d.renditions {
+		if len(r.indexes) == 0 {
+			continue
+		}
+		if isLive && !r.ended && r.segments.Empty() && time.Since(r.lastReload) >= r.reloadPeriod {
+			r.reload()
+		}
+		res = res || !r.segments.Empty() || (isLive && !r.ended)
+		if r.segments.Empty() {
+			continue
+		}
+		/* Parallelised download and parsing of the next segment */
+		segment := r.segments.Pop().(hlsSegment)
+		c := make(chan error)
+		go func(c chan error, r *hlsRendition) {
+			c <- d.extractSegment(r, segment, *tracks)
+		}(c, r)
+		waitList = append(waitList, c)
+	}
+	/* Wait for all parsing routines to end */
+	for i := 0; i < len(waitList); i++ {
+		<- waitList[i]
+		close(waitList[i])
+	}
+	return res
+}
@@ -0,0 +1,278 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+  "time"
+  "bytes"
+  "testing"
+  "net/http"
+  "net/http/httptest"
+)
+
+func TestHLSPlaylist(t *testing.T) {
+  master, err := parseHLSPlaylist("http://host/live/master.m3u8", `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",LANGUAGE="fr",NAME="Français",DEFAULT=YES,URI="audio/fr.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2",AUDIO="aac"
+video/720.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=640000,CODECS="avc1.4d401e,mp4a.40.2",AUDIO="aac"
+/other/360.m3u8
+`)
+  if err != nil {
+    t.Fatal(err)
+  }
+  renditions := hlsRenditions(master)
+  if len(renditions) != 3 || renditions[1].url != "http://host/other/360.m3u8" || renditions[0].keepAudio {
+    t.Errorf("bad variants. got %v", renditions)
+  }
+  if r := renditions[2]; r.url != "http://host/live/audio/fr.m3u8" || r.language != "fr" || r.label != "Français" || r.role != "main" || r.keepVideo {
+    t.Errorf("bad audio rendition. got %v", r)
+  }
+  media, err := parseHLSPlaylist("http://host/live/video/720.m3u8", `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:10
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:4.0,
+s10.m4s
+#EXTINF:4.0,
+s11.m4s
+#EXTINF:4.0,
+s12.m4s
+#EXTINF:4.0,
+s13.m4s
+`)
+  if err != nil {
+    t.Fatal(err)
+  }
+  r := renditions[0]
+  r.update(media, true)
+  if r.segments.Size() != HLS_LIVE_START_SEGMENTS || r.nextSequence != 14 || r.mapURL != "http://host/live/video/init.mp4" || r.ended {
+    t.Errorf("bad live start. got %d segments, next %d", r.segments.Size(), r.nextSequence)
+  }
+  media.segments = append(media.segments[2:], hlsSegment{"http://host/live/video/s14.m4s", 4, 14})
+  r.update(media, false)
+  if r.segments.Size() != HLS_LIVE_START_SEGMENTS + 1 || r.reloadPeriod != 4 * time.Second {
+    t.Errorf("bad reload. got %d segments", r.segments.Size())
+  }
+  if s := r.segments.Pop().(hlsSegment); s.url != "http://host/live/video/s11.m4s" || s.sequence != 11 {
+    t.Errorf("bad first segment. got %v", s)
+  }
+}
+
+func TestHLSOpen(t *testing.T) {
+  cases := []struct {
+    path, want string
+  }{
+    {"host/live/master.m3u8", "http://host/live/master.m3u8"},
+    {"http://host/live/master.m3u8", "http://host/live/master.m3u8"},
+    {"https://host/live/master.m3u8", "https://host/live/master.m3u8"},
+  }
+  for _, c := range cases {
+    var d HLSDemuxer
+    d.Open(c.path)
+    if d.manifestURL != c.want {
+      t.Errorf("bad manifest URL for %q. want %q, got %q", c.path, c.want, d.manifestURL)
+    }
+  }
+}
+
+func TestHLSReloadPeriod(t *testing.T) {
+  segments := "#EXTINF:4.0,\ns10.m4s\n"
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:10\n" + segments))
+  }))
+  defer server.Close()
+  r := &hlsRendition{url: server.URL + "/media.m3u8"}
+  r.reload()
+  cases := []struct {
+    segments string
+    want time.Duration
+  }{
+    {"#EXTINF:4.0,\ns10.m4s\n", 2 * time.Second},
+    {"#EXTINF:4.0,\ns10.m4s\n", 2 * time.Second},
+    {"#EXTINF:4.0,\ns10.m4s\n#EXTINF:4.0,\ns11.m4s\n", 4 * time.Second},
+  }
+  for i, c := range cases {
+    segments = c.segments
+    r.reload()
+    if r.reloadPeriod != c.want {
+      t.Errorf("bad reload period %d. want %v, got %v", i, c.want, r.reloadPeriod)
+    }
+  }
+}
+
+/* MPEG-2 CRC32 of PSI sections */
+func tsCRC32(data []byte) uint32 {
+  crc := uint32(0xffffffff)
+  for _, b := range data {
+    crc ^= uint32(b) << 24
+    for i := 0; i < 8; i++ {
+      if crc & 0x80000000 != 0 {
+        crc = (crc << 1) ^ 0x04c11db7
+      } else {
+        crc <<= 1
+      }
+    }
+  }
+  return crc
+}
+
+/* Add CRC to a PSI section and prefix it by its pointer field */
+func tsSection(section []byte) []byte {
+  crc := tsCRC32(section)
+  return append(append([]byte{0x0}, section...), byte(crc >> 24), byte(crc >> 16), byte(crc >> 8), byte(crc))
+}
+
+/* Split a payload in transport packets of a PID, last one is stuffed with an adaptation field */
+func tsPackets(pid int, payload []byte, cc *int) []byte {
+  var res []byte
+  start := true
+  for len(payload) > 0 {
+    packet := []byte{0x47, byte(pid >> 8), byte(pid), 0x10 | byte(*cc & 0xF)}
+    if start {
+      packet[1] |= 0x40
+    }
+    *cc++
+    size := 184
+    if len(payload) < size {
+      stuffing := 184 - len(payload)
+      packet[3] |= 0x20
+      packet = append(packet, byte(stuffing - 1))
+      if stuffing > 1 {
+        packet = append(packet, 0x0)
+      }
+      for i := 2; i < stuffing; i++ {
+        packet = append(packet, 0xff)
+      }
+      size = len(payload)
+    }
+    packet = append(packet, payload[:size]...)
+    payload = payload[size:]
+    res = append(res, packet...)
+    start = false
+  }
+  return res
+}
+
+/* Build a PES packet with a PTS (90kHz) */
+func tsPES(streamId byte, pts int64, data []byte) []byte {
+  res := []byte{
+    0x0, 0x0, 0x1, streamId, 0x0, 0x0, 0x80, 0x80, 0x5,
+    byte(0x21 | ((pts >> 29) & 0xe)), byte(pts >> 22), byte(0x1 | ((pts >> 14) & 0xfe)), byte(pts >> 7), byte(0x1 | ((pts << 1) & 0xfe)),
+  }
+  length := len(res) - 6 + len(data)
+  res[4], res[5] = byte(length >> 8), byte(length)
+  return append(res, data...)
+}
+
+/* H.264 baseline 16x16 parameter sets and AAC LC frame of the test transport stream */
+var (
+  testSPS = []byte{0x67, 0x42, 0xc0, 0x0a, 0xda, 0x79}
+  testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+  testAAC = []byte{0x00, 0xc8, 0x00, 0x07}
+)
+
+/* Build a transport stream of 5 IDR frames (one I_PCM macroblock each) and 10 silent AAC frames */
+func testTransportStream() []byte {
+  sps, pps := testSPS, testPPS
+  idr := func(id int) []byte {
+    header := []byte{0x65, 0x88, 0x84, 0xa0, 0xd0}
+    if id % 2 == 1 {
+      header = []byte{0x65, 0x88, 0x82, 0x28, 0x34}
+    }
+    return append(append(header, bytes.Repeat([]byte{0x80}, 384)...), 0x80)
+  }
+  /* AAC LC, 48 kHz, mono, silent frames in ADTS */
+  adts := []byte{0xff, 0xf1, 0x4c, 0x40, 0x01, 0x7f, 0xfc}
+  aac := testAAC
+  var segment []byte
+  var cc [4]int
+  segment = append(segment, tsPackets(0x0, tsSection([]byte{
+    0x0, 0xb0, 0x0d, 0x0, 0x1, 0xc1, 0x0, 0x0, 0x0, 0x1, 0xf0, 0x0,
+  }), &cc[0])...)
+  segment = append(segment, tsPackets(0x1000, tsSection([]byte{
+    0x2, 0xb0, 0x17, 0x0, 0x1, 0xc1, 0x0, 0x0, 0xe1, 0x0, 0xf0, 0x0,
+    0x1b, 0xe1, 0x0, 0xf0, 0x0,
+    0x0f, 0xe1, 0x1, 0xf0, 0x0,
+  }), &cc[1])...)
+  for i := 0; i < 5; i++ {
+    var au []byte
+    for _, nal := range [][]byte{sps, pps, idr(i)} {
+      au = append(append(au, 0x0, 0x0, 0x0, 0x1), nal...)
+    }
+    segment = append(segment, tsPackets(0x100, tsPES(0xe0, 126000 + int64(i) * 3600, au), &cc[2])...)
+    for j := 0; j < 2; j++ {
+      pts := 126000 + int64(2 * i + j) * 1920
+      segment = append(segment, tsPackets(0x101, tsPES(0xc0, pts, append(append([]byte{}, adts...), aac...)), &cc[3])...)
+    }
+  }
+  return segment
+}
+
+func TestHLSTransportStream(t *testing.T) {
+  sps, pps, aac := testSPS, testPPS, testAAC
+  segment := testTransportStream()
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Path == "/segment.ts" {
+      w.Write(segment)
+      return
+    }
+    w.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:0\n#EXTINF:0.2,\nsegment.ts\n#EXT-X-ENDLIST\n"))
+  }))
+  defer server.Close()
+
+  var tracks []*Track
+  d := new(HLSDemuxer)
+  d.Open(server.URL[len("http://"):] + "/media.m3u8")
+  if err := d.GetTracks(&tracks); err != nil {
+    t.Fatalf("got error in GetTracks %q", err)
+  }
+  defer d.Close()
+  var video, audio *Track
+  for _, track := range tracks {
+    if track.isAudio {
+      audio = track
+    } else {
+      video = track
+    }
+  }
+  if video == nil || audio == nil {
+    t.Fatalf("bad tracks. got %v", tracks)
+  }
+  /* avcC : version, profile, compatibility, level, 4 bytes NAL sizes, one SPS and one PPS */
+  avcc := append(append([]byte{0x1, 0x42, 0xc0, 0x0a, 0xff, 0xe1, 0x0, byte(len(sps))}, sps...), 0x1, 0x0, byte(len(pps)))
+  avcc = append(avcc, pps...)
+  if !bytes.Equal(video.extradata, avcc) {
+    t.Errorf("bad avcC. want %x, got %x", avcc, video.extradata)
+  }
+  if !bytes.Equal(audio.extradata, []byte{0x11, 0x88}) {
+    t.Errorf("bad AudioSpecificConfig. want 1188, got %x", audio.extradata)
+  }
+  esds, err := buildESDS(*audio)
+  if err != nil || !bytes.Contains(esds, []byte{0x5, 0x80, 0x80, 0x80, 0x2, 0x11, 0x88, 0x6}) {
+    t.Errorf("bad esds. got %x", esds)
+  }
+  for i := 0; i < 10 && d.ExtractChunk(&tracks, false); i++ {
+  }
+  if len(video.samples) != 5 || len(audio.samples) != 10 {
+    t.Fatalf("bad samples. got %d video and %d audio", len(video.samples), len(audio.samples))
+  }
+  if data := video.samples[0].GetData(); !bytes.HasPrefix(data, append([]byte{0x0, 0x0, 0x0, byte(len(sps))}, sps...)) {
+    t.Errorf("bad length prefixed video sample. got %x", data[:12])
+  }
+  if data := audio.samples[0].GetData(); !bytes.Equal(data, aac) {
+    t.Errorf("bad audio sample without ADTS header. got %x", data)
+  }
+}
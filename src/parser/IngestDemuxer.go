@@ -0,0 +1,248 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"sync"
+	"time"
+	"utils"
+	"bytes"
+	"errors"
+	"strconv"
+)
+
+/* Protocol of streams pushed by live encoders (DASH-IF Live Media Ingest, CMAF over HTTP) */
+const INGEST_PROTOCOL = "ingest"
+
+/* Time given to the other tracks of an ingest once a first one has been pushed, in seconds */
+const INGEST_TRACKS_DELAY = 2
+
+/* Maximum number of fragments of a track waiting to be extracted, older ones are dropped */
+const INGEST_MAX_PENDING = 30
+
+/* Track pushed to an ingest, identified by its name in the ingest URL */
+type ingestTrack struct {
+	name      string
+	init      []byte
+	fragments [][]byte
+	index     int
+	dash      *DASHDemuxer
+}
+
+/* Fragments pushed to an ingest, waiting to be extracted */
+type ingestSession struct {
+	tracks    []*ingestTrack
+	firstInit time.Time
+	lastPush  time.Time
+	demuxer   *IngestDemuxer
+}
+
+var ingestMutex sync.Mutex
+var ingestSessions = make(map[string]*ingestSession)
+
+/* Demuxer structure for CMAF tracks pushed over HTTP */
+type IngestDemuxer struct {
+	name        string
+	readTimeout float64
+	tracks      []*ingestTrack
+	err         error
+}
+
+/* Return types of the top level atoms of a segment */
+func topLevelAtoms(data []byte) []string {
+	var res []string
+	var size int
+	reader := bytes.NewReader(data)
+	for {
+		tag, err := utils.ReadAtomHeader(reader, &size)
+		if err != nil || size < 8 {
+			return res
+		}
+		res = append(res, tag)
+		reader.Seek(int64(size - 8), 1)
+	}
+}
+
+/*
+ Add a segment pushed for a track of an ingest : an init segment (moov) or a media
+ fragment (moof). Segments are kept until the ingest is demuxed.
+ */
+func PushIngest(name string, trackName string, data []byte) error {
+	isInit := false
+	isFragment := false
+	for _, tag := range topLevelAtoms(data) {
+		isInit = isInit || tag == "moov"
+		isFragment = isFragment || tag == "moof"
+	}
+	if !isInit && !isFragment {
+		return errors.New("Segment pushed to '" + name + "/" + trackName + "' is neither an init segment nor a fragment")
+	}
+	ingestMutex.Lock()
+	defer ingestMutex.Unlock()
+	session := ingestSessions[name]
+	if session == nil {
+		session = new(ingestSession)
+		ingestSessions[name] = session
+	}
+	var track *ingestTrack
+	for _, t := range session.tracks {
+		if t.name == trackName {
+			track = t
+		}
+	}
+	if track == nil {
+		track = &ingestTrack{name: trackName}
+		session.tracks = append(session.tracks, track)
+	}
+	if isInit {
+		track.init = data
+		if session.firstInit.IsZero() {
+			session.firstInit = time.Now()
+		}
+	} else {
+		track.fragments = append(track.fragments, data)
+		if len(track.fragments) > INGEST_MAX_PENDING {
+			track.fragments = track.fragments[1:]
+		}
+	}
+	session.lastPush = time.Now()
+	return nil
+}
+
+/*
+ Return if tracks of an ingest can be declared : every track pushed has a fragment,
+ or the other tracks had INGEST_TRACKS_DELAY seconds to start.
+ */
+func (s *ingestSession) ready() bool {
+	started := false
+	complete := true
+	for _, t := range s.tracks {
+		if t.init != nil {
+			started = true
+		}
+		complete = complete && t.init != nil && len(t.fragments) > 0
+	}
+	return started && (complete || time.Since(s.firstInit) >= INGEST_TRACKS_DELAY * time.Second)
+}
+
+/* Initialise ingest demuxer, path is the name of the ingest */
+func (d *IngestDemuxer) Open(path string) error {
+	d.name = path
+	d.readTimeout = STREAM_READ_TIMEOUT
+	return nil
+}
+
+/* Set time (seconds) without any segment pushed after which the ingest is stopped, options are unused */
+func (d *IngestDemuxer) SetInputOptions(options map[string]string, readTimeout float64) {
+	if readTimeout > 0 {
+		d.readTimeout = readTimeout
+	}
+}
+
+/* Return why the ingest stopped, nil while segments are pushed */
+func (d *IngestDemuxer) Err() error {
+	return d.err
+}
+
+/* Wait for the init segments of the ingest and create a track from each one */
+func (d *IngestDemuxer) GetTracks(tracks *[]*Track) error {
+	var session *ingestSession
+	start := time.Now()
+	for {
+		ingestMutex.Lock()
+		session = ingestSessions[d.name]
+		if session != nil && session.ready() {
+			break
+		}
+		ingestMutex.Unlock()
+		if time.Since(start).Seconds() >= d.readTimeout {
+			return errors.New("No track pushed to ingest '" + d.name + "'")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	defer ingestMutex.Unlock()
+	session.demuxer = d
+	for _, t := range session.tracks {
+		if t.init == nil {
+			continue
+		}
+		track := new(Track)
+		t.dash = new(DASHDemuxer)
+		t.dash.Open("")
+		err := t.dash.parseDASHData(t.init, track)
+		if err != nil { return err }
+		if track.timescale == 0 {
+			track.timescale = track.globalTimescale
+		}
+		t.index = len(*tracks)
+		track.index = t.index
+		track.SetTimeFields()
+		*tracks = append(*tracks, track)
+		d.tracks = append(d.tracks, t)
+	}
+	return nil
+}
+
+/*
+ Clean demuxer internal info. Init segments of the ingest are kept, as encoders
+ only send them once, for the next demuxer started by a push.
+ */
+func (d *IngestDemuxer) Close() {
+	ingestMutex.Lock()
+	defer ingestMutex.Unlock()
+	session := ingestSessions[d.name]
+	if session != nil && session.demuxer == d {
+		session.demuxer = nil
+		for _, t := range session.tracks {
+			t.fragments = nil
+		}
+	}
+	d.tracks = nil
+}
+
+/*
+ Extract the oldest fragment pushed for each track. The ingest stops when no
+ segment has been pushed for its read timeout, or when a fragment can't be parsed.
+ */
+func (d *IngestDemuxer) ExtractChunk(tracks *[]*Track, isLive bool) bool {
+	var fragments [][]byte
+	ingestMutex.Lock()
+	session := ingestSessions[d.name]
+	for _, t := range d.tracks {
+		var fragment []byte
+		if len(t.fragments) > 0 {
+			fragment = t.fragments[0]
+			t.fragments = t.fragments[1:]
+		}
+		fragments = append(fragments, fragment)
+	}
+	if session == nil || time.Since(session.lastPush).Seconds() >= d.readTimeout {
+		d.err = errors.New("No segment pushed to ingest '" + d.name + "' for " + strconv.FormatFloat(d.readTimeout, 'f', -1, 64) + " seconds")
+	}
+	ingestMutex.Unlock()
+	res := false
+	for i, t := range d.tracks {
+		track := findTrack(*tracks, t.index)
+		if fragments[i] == nil || track == nil {
+			continue
+		}
+		err := t.dash.parseDASHData(fragments[i], track)
+		if err != nil && d.err == nil {
+			d.err = errors.New("Invalid fragment pushed to '" + d.name + "/" + t.name + "' : " + err.Error())
+		}
+		res = true
+	}
+	return res || d.err == nil
+}
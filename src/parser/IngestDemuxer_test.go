@@ -0,0 +1,61 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+  "time"
+  "testing"
+)
+
+func TestPushIngest(t *testing.T) {
+  moov := []byte{0, 0, 0, 8, 'm', 'o', 'o', 'v'}
+  moof := []byte{0, 0, 0, 8, 'm', 'o', 'o', 'f', 0, 0, 0, 8, 'm', 'd', 'a', 't'}
+  if PushIngest("test", "video", []byte{0, 0, 0, 8, 'f', 'r', 'e', 'e'}) == nil {
+    t.Errorf("segment without moov nor moof accepted")
+  }
+  PushIngest("test", "video", moov)
+  PushIngest("test", "audio", moov)
+  for i := 0; i < INGEST_MAX_PENDING + 2; i++ {
+    PushIngest("test", "video", moof)
+  }
+  session := ingestSessions["test"]
+  defer delete(ingestSessions, "test")
+  if len(session.tracks) != 2 || len(session.tracks[0].fragments) != INGEST_MAX_PENDING || session.tracks[0].init == nil {
+    t.Fatalf("bad session. got %d tracks", len(session.tracks))
+  }
+  if session.ready() {
+    t.Errorf("session ready without audio fragment")
+  }
+  PushIngest("test", "audio", moof)
+  if !session.ready() {
+    t.Errorf("session not ready")
+  }
+}
+
+func TestIngestInvalidFragment(t *testing.T) {
+  dash := new(DASHDemuxer)
+  dash.Open("")
+  ingestSessions["broken"] = &ingestSession{lastPush: time.Now()}
+  defer delete(ingestSessions, "broken")
+  /* Fragment truncated in the header of its second atom */
+  fragment := []byte{0, 0, 0, 8, 'm', 'o', 'o', 'f', 0, 0}
+  d := IngestDemuxer{name: "broken", readTimeout: 10}
+  d.tracks = []*ingestTrack{{name: "video", dash: dash, fragments: [][]byte{fragment}}}
+  tracks := []*Track{&Track{}}
+  d.ExtractChunk(&tracks, true)
+  if d.Err() == nil {
+    t.Errorf("invalid fragment should stop the ingest")
+  }
+}
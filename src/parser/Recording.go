@@ -0,0 +1,101 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"strconv"
+)
+
+/* Chunks that went out of the live window of a recorded track */
+type recording struct {
+	chunksDuration []int64
+	chunksSize     []int
+	chunksName     []string
+	finished       bool
+}
+
+/* Keep every chunk of a live track, they are referenced again once the recording is finished */
+func (t *Track) SetRecording(record bool) {
+	if record {
+		t.recording = new(recording)
+	} else {
+		t.recording = nil
+	}
+}
+
+/* Save chunks about to go out of the live window, keep is the number of chunks left in it */
+func (t *Track) recordWindowChunks(keep int) {
+	if t.recording == nil {
+		return
+	}
+	if n := len(t.chunksDuration) - keep; n > 0 {
+		t.recording.chunksDuration = append(t.recording.chunksDuration, t.chunksDuration[:n]...)
+	}
+	if n := len(t.chunksSize) - keep; n > 0 {
+		t.recording.chunksSize = append(t.recording.chunksSize, t.chunksSize[:n]...)
+	}
+	if n := len(t.chunksName) - keep; n > 0 {
+		t.recording.chunksName = append(t.recording.chunksName, t.chunksName[:n]...)
+	}
+}
+
+/* Return if a chunk file is kept by the recording */
+func (t *Track) isRecordedChunk(name string) bool {
+	if t.recording == nil {
+		return false
+	}
+	for _, recorded := range t.recording.chunksName {
+		if recorded == name {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ Reference every recorded chunk again, manifests then describe the whole recording
+ as a static presentation starting at its first chunk.
+ */
+func (t *Track) FinishRecording() {
+	if t.recording == nil || t.recording.finished {
+		return
+	}
+	t.chunksDuration = append(t.recording.chunksDuration, t.chunksDuration...)
+	t.chunksSize = append(t.recording.chunksSize, t.chunksSize...)
+	t.chunksName = append(t.recording.chunksName, t.chunksName...)
+	t.recording.chunksDuration = nil
+	t.recording.chunksSize = nil
+	t.recording.chunksName = nil
+	t.recording.finished = true
+	t.mediaSequence = 0
+	duration := int64(0)
+	for _, d := range t.chunksDuration {
+		duration += d
+	}
+	t.duration = int(duration * int64(t.globalTimescale) / int64(t.timescale))
+}
+
+/* Return presentationTimeOffset attribute of a finished recording, chunks don't start at 0 */
+func (t *Track) presentationTimeOffset() string {
+	if t.recording == nil || !t.recording.finished {
+		return ""
+	}
+	start := t.currentDuration
+	for _, d := range t.chunksDuration {
+		start -= d
+	}
+	return `
+        presentationTimeOffset="` + strconv.FormatInt(start, 10) + `"`
+}
@@ -0,0 +1,79 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+  "os"
+  "strconv"
+  "strings"
+  "io/ioutil"
+  "path/filepath"
+  "testing"
+)
+
+func TestLiveRecording(t *testing.T) {
+  dir, err := ioutil.TempDir("", "recording")
+  if err != nil {
+    t.Fatalf("can't create directory: %v", err)
+  }
+  defer os.RemoveAll(dir)
+  track := Track{timescale: 1000, globalTimescale: 1000, liveWindow: 6, currentDuration: 5000}
+  track.SetRecording(true)
+  for i := 0; i < 5; i++ {
+    name := "chunk_video0_" + strconv.FormatInt(track.currentDuration, 10) + ".mp4"
+    ioutil.WriteFile(filepath.Join(dir, name), []byte{0x0}, 0644)
+    track.chunksDuration = append(track.chunksDuration, 2000)
+    track.chunksSize = append(track.chunksSize, 100)
+    track.chunksName = append(track.chunksName, name)
+    track.currentDuration += 2000
+    track.CleanForLive()
+    track.CleanDirectory(dir)
+  }
+  if len(track.chunksDuration) != 3 || track.presentationTimeOffset() != "" {
+    t.Errorf("bad live window. got %d chunks", len(track.chunksDuration))
+  }
+  if files, _ := ioutil.ReadDir(dir); len(files) != 5 {
+    t.Errorf("recorded chunks should be kept. got %d files", len(files))
+  }
+  track.FinishRecording()
+  if len(track.chunksDuration) != 5 || len(track.chunksName) != 5 || track.chunksName[0] != "chunk_video0_5000.mp4" {
+    t.Errorf("bad recorded chunks. got %v", track.chunksName)
+  }
+  if track.Duration() != 10 {
+    t.Errorf("bad recording duration. want 10, got %f", track.Duration())
+  }
+  if !strings.Contains(track.BuildAdaptationSet(), `presentationTimeOffset="5000"`) {
+    t.Errorf("missing presentationTimeOffset. got %s", track.BuildAdaptationSet())
+  }
+}
+
+func TestLiveWindow(t *testing.T) {
+  track := Track{timescale: 1000, liveWindow: DEFAULT_LIVE_WINDOW}
+  track.SetLiveWindow(0)
+  track.SetLiveWindow(4)
+  if track.liveWindow != 4 {
+    t.Fatalf("bad live window. want 4, got %f", track.liveWindow)
+  }
+  track.chunksDuration = []int64{1000, 3000, 2000, 2000}
+  track.chunksSize = []int{1, 2, 3, 4}
+  track.chunksName = []string{"a", "b", "c", "d"}
+  track.CleanForLive()
+  if len(track.chunksDuration) != 2 || track.chunksDuration[0] != 2000 || track.mediaSequence != 2 {
+    t.Errorf("bad window chunks. got %v, media sequence %d", track.chunksDuration, track.mediaSequence)
+  }
+  if len(track.chunksSize) != 2 || track.chunksName[0] != "c" {
+    t.Errorf("bad window names. got %v", track.chunksName)
+  }
+}
@@ -0,0 +1,58 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"sort"
+	"encoding/base64"
+)
+
+/* Protocols of remote progressive files read by FFMPEG with range requests */
+var remoteProtocols = []string{"http", "https"}
+
+/* Return if a protocol is a remote progressive file */
+func IsRemoteProtocol(proto string) bool {
+	for _, p := range remoteProtocols {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ Return HTTP headers given to FFMPEG for a remote file, one "Name: value" line
+ each, with a basic Authorization header when credentials are set.
+ */
+func remoteHeaders(headers map[string]string, username string, password string) string {
+	var names []string
+	res := ""
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		res += name + ": " + headers[name] + "\r\n"
+	}
+	if username != "" || password != "" {
+		res += "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(username + ":" + password)) + "\r\n"
+	}
+	return res
+}
+
+/* Set HTTP headers and credentials sent when requesting a remote file, must be called before GetTracks */
+func (d *FFMPEGDemuxer) SetHeaders(headers map[string]string, username string, password string) {
+	d.headers = remoteHeaders(headers, username, password)
+}
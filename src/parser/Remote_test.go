@@ -0,0 +1,33 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import "testing"
+
+func TestRemoteHeaders(t *testing.T) {
+  if !IsRemoteProtocol("https") || IsRemoteProtocol("udp") || IsStreamProtocol("http") {
+    t.Errorf("bad remote protocols")
+  }
+  headers := remoteHeaders(map[string]string{"X-Token": "abc", "Accept": "*/*"}, "user", "pass")
+  if headers != "Accept: */*\r\nX-Token: abc\r\nAuthorization: Basic dXNlcjpwYXNz\r\n" {
+    t.Errorf("bad headers. got %q", headers)
+  }
+  if headers = remoteHeaders(nil, "", ""); headers != "" {
+    t.Errorf("bad empty headers. got %q", headers)
+  }
+  if options := streamOptions("http", nil, 10); options["reconnect"] != "1" || options["rw_timeout"] != "10000000" {
+    t.Errorf("bad http options. got %v", options)
+  }
+}
@@ -16,6 +16,7 @@ package parser
 
 import (
 	"io"
+	"errors"
 	"sync"
 	"utils"
 	"bytes"
@@ -62,6 +63,7 @@ type SmoothStreamIndex struct {
 	Type string `xml:"Type,attr"`
 	Url string `xml:"Url,attr"`
 	Name string `xml:"Name,attr"`
+	Language string `xml:"Language,attr"`
 	Chunks int `xml:"Chunks,attr"`
 	QualityLevels int `xml:"QualityLevels,attr"`
 	MaxWidth int `xml:"MaxWidth,attr"`
@@ -97,6 +99,9 @@ type SmoothTrackInfo struct {
 	baseDecodeTime int64
 	bitrate        int
 	urlTemplate    string
+	streamIndex    int
+	lookahead      []int64
+	lastTime       int64
 }
 
 /* Demuxer structure for smooth streaming parsing */
@@ -107,6 +112,9 @@ type SmoothDemuxer struct {
 	atomParsers map[string]SmoothAtomParser
 	trackInfos map[int]*SmoothTrackInfo
 	defaultSampleDuration int64
+	keys map[string][]byte
+	live bool
+	err error
 	mutex sync.Mutex
 }
 
@@ -215,7 +223,10 @@ func parseSMOOTHSENC(reader io.ReadSeeker, track *Track) {
 		track.samples[i].encrypt = new(SampleEncryption)
 		track.samples[i].encrypt.initializationVector, _ = utils.AtomReadBuffer(reader, 8)
 		if flags & 0x2 > 0 {
-			track.encryptInfos.subEncrypt = true
+			/* Decrypted tracks are packaged clear or with their own encryption */
+			if track.decryptKey == nil {
+				track.encryptInfos.subEncrypt = true
+			}
 			nb, _ := utils.AtomReadInt16(reader)
 			for j := 0; j < nb; j++ {
 				clear, _ := utils.AtomReadInt16(reader)
@@ -228,15 +239,22 @@ func parseSMOOTHSENC(reader io.ReadSeeker, track *Track) {
 
 /* Parse a smooth UUID atom : skip if unknown, otherwise call real parsing function */
 func (d *SmoothDemuxer) parseSmoothUUID(reader io.ReadSeeker, size int, track *Track) {
+	base, _ := utils.CurrentOffset(reader)
 	highhigh, _ := utils.AtomReadInt32(reader)
 	highlow, _ := utils.AtomReadInt32(reader)
 	lowhigh, _ := utils.AtomReadInt32(reader)
 	lowlow, _ := utils.AtomReadInt32(reader)
 	if uint(highhigh) == 0xa2394f52 && uint(highlow) == 0x5a9b4f14 && uint(lowhigh) == 0xa2446c42 && uint(lowlow) == 0x7c648df4 {
 		parseSMOOTHSENC(reader, track)
-	} else {
-		reader.Seek(int64(size - 24), 1)
-	}
+		return
+	} else if uint(highhigh) == 0x6d1d9b05 && uint(highlow) == 0x42d544e6 && uint(lowhigh) == 0x80e2141d && uint(lowlow) == 0xaff757b2 {
+		d.parseSmoothTFXD(reader, track)
+	} else if uint(highhigh) == 0xd4807ef2 && uint(highlow) == 0xca394695 && uint(lowhigh) == 0x8e5426cb && uint(lowlow) == 0x9e46a79f {
+		d.parseSmoothTFRF(reader, track)
+	}
+	/* Skip what is left of the atom */
+	cur, _ := utils.CurrentOffset(reader)
+	reader.Seek(int64(size - 8 - (cur - base)), 1)
 }
 
 /* Build audio extradata for MP4A/ENCA atom using info from manifest */
@@ -259,6 +277,14 @@ func (d *SmoothDemuxer) buildAudioExtradata(privateData string, freq int, chans
 	}
 }
 
+/* Build Dolby extradata for DAC3/DEC3 atom using info from manifest, 6 channels are taken as 5.1 */
+func (d *SmoothDemuxer) buildDolbyExtradata(fourcc string, quality SmoothQualityLevel) []byte {
+	if fourcc == "ac-3" {
+		return buildAC3Config(quality.SamplingRate, quality.Channels, quality.Channels == 6, quality.Bitrate)
+	}
+	return buildEAC3Config(quality.SamplingRate, quality.Channels, quality.Channels == 6, quality.Bitrate)
+}
+
 /* Build video extradata for AVCC/ENCV atom using info from manifest */
 func (d *SmoothDemuxer) buildVideoExtradata(privateData string) []byte {
 	split := strings.Split(privateData, "00000001")
@@ -279,6 +305,13 @@ func (d *SmoothDemuxer) buildVideoExtradata(privateData string) []byte {
 	)...)
 }
 
+/* Build video extradata for HVCC atom using Annex B parameter sets from manifest */
+func (d *SmoothDemuxer) buildHEVCExtradata(privateData string) ([]byte, error) {
+	data, err := hex.DecodeString(privateData)
+	if err != nil { return nil, err }
+	return hevcAnnexBToHVCC(data)
+}
+
 /* Build URL to retrieve one chunk using template from manifest */
 func (d *SmoothDemuxer) buildChunkURL(time int64, bitrate int, url string) string {
 	suffix := strings.Replace(url, "{start time}", strconv.FormatInt(time, 10), 1)
@@ -303,7 +336,7 @@ func buildWidevinePSS(key []byte) pss {
 		0x8, 0x1, 0x12, 0x10,
 	}
 	blob = append(blob, key...)
-	return pss{"EDEF8BA979D64ACEA3C827DCD51D21ED", blob}
+	return pss{"EDEF8BA979D64ACEA3C827DCD51D21ED", blob, nil}
 }
 
 /* Extract keyId from playReady callenge */
@@ -356,7 +389,7 @@ func (d *SmoothDemuxer) buildEncryptionInfos(headers []SmoothProtectionHeader) *
 	}
 	/* Add challenges for Widevine and playReady */
 	res.pssList = append(res.pssList, buildWidevinePSS(keyId))
-	res.pssList = append(res.pssList, pss{"9A04F07998404286AB92E65BE0885F95", blob})
+	res.pssList = append(res.pssList, pss{"9A04F07998404286AB92E65BE0885F95", blob, nil})
 	return &res
 }
 
@@ -370,6 +403,20 @@ func (d *SmoothDemuxer) parseSmoothManifest(manifest *SmoothStreamingMedia, trac
 	acc := 0
 	d.chunksURL = make(map[int]*utils.Queue)
 	d.trackInfos = make(map[int]*SmoothTrackInfo)
+	/* Live streams are opened near their last advertised chunk */
+	d.live = manifest.IsLive
+	if manifest.IsLive {
+		for i := range manifest.StreamIndexes {
+			s := &manifest.StreamIndexes[i]
+			times := smoothChunkTimes(s.ChunksInfos)
+			if len(times) == 0 {
+				continue
+			}
+			start := smoothLiveStart(times, manifest.LookaheadCount)
+			s.ChunksInfos = s.ChunksInfos[len(times) - len(start):]
+			s.ChunksInfos[0].StartTime = start[0]
+		}
+	}
 	/* Iterate over each stream declaration */
 	for i := 0; i < len(manifest.StreamIndexes); i++ {
 		/* Iterator over each quality declared */
@@ -382,21 +429,41 @@ func (d *SmoothDemuxer) parseSmoothManifest(manifest *SmoothStreamingMedia, trac
 			track.globalTimescale = manifest.Timescale
 			track.duration = manifest.Duration
 			track.bandwidth = manifest.StreamIndexes[i].QualityInfos[j].Bitrate
+			track.language = manifest.StreamIndexes[i].Language
+			/* Default stream names are only the stream type */
+			if manifest.StreamIndexes[i].Name != manifest.StreamIndexes[i].Type {
+				track.label = manifest.StreamIndexes[i].Name
+			}
 			if track.isAudio {
 				/* Fill audio specific info */
 				track.sampleRate = manifest.StreamIndexes[i].QualityInfos[j].SamplingRate
-				track.extradata = d.buildAudioExtradata(manifest.StreamIndexes[i].QualityInfos[j].CodecPrivateData, manifest.StreamIndexes[i].QualityInfos[j].SamplingRate, manifest.StreamIndexes[i].QualityInfos[j].Channels)
+				track.channels = manifest.StreamIndexes[i].QualityInfos[j].Channels
+				fourcc := strings.ToUpper(manifest.StreamIndexes[i].QualityInfos[j].FourCC)
+				if fourcc == "AC-3" || fourcc == "EC-3" {
+					track.fourcc = strings.ToLower(fourcc)
+					track.extradata = d.buildDolbyExtradata(track.fourcc, manifest.StreamIndexes[i].QualityInfos[j])
+				} else {
+					track.extradata = d.buildAudioExtradata(manifest.StreamIndexes[i].QualityInfos[j].CodecPrivateData, manifest.StreamIndexes[i].QualityInfos[j].SamplingRate, manifest.StreamIndexes[i].QualityInfos[j].Channels)
+				}
 			} else {
 				/* Fill audio specific info */
 				track.width = manifest.StreamIndexes[i].QualityInfos[j].MaxWidth
 				track.height = manifest.StreamIndexes[i].QualityInfos[j].MaxHeight
 				track.bitsPerSample = 0
 				track.colorTableId = 24
-				track.extradata = d.buildVideoExtradata(manifest.StreamIndexes[i].QualityInfos[j].CodecPrivateData)
+				fourcc := strings.ToUpper(manifest.StreamIndexes[i].QualityInfos[j].FourCC)
+				if fourcc == "HVC1" || fourcc == "HEV1" {
+					track.fourcc = strings.ToLower(fourcc)
+					track.extradata, _ = d.buildHEVCExtradata(manifest.StreamIndexes[i].QualityInfos[j].CodecPrivateData)
+				} else {
+					track.extradata = d.buildVideoExtradata(manifest.StreamIndexes[i].QualityInfos[j].CodecPrivateData)
+				}
 			}
 			/* If manifest has encryption info, extract them */
 			if len(manifest.Protection) > 0 {
 				track.encryptInfos = d.buildEncryptionInfos(manifest.Protection)
+				err := track.setDecryptionKey(d.keys)
+				if err != nil { return err }
 			}
 			acc += 1
 			track.SetTimeFields()
@@ -408,6 +475,9 @@ func (d *SmoothDemuxer) parseSmoothManifest(manifest *SmoothStreamingMedia, trac
 			d.trackInfos[track.index].baseDecodeTime = manifest.StreamIndexes[i].ChunksInfos[0].StartTime
 			d.trackInfos[track.index].urlTemplate = manifest.StreamIndexes[i].Url
 			d.trackInfos[track.index].bitrate = manifest.StreamIndexes[i].QualityInfos[j].Bitrate
+			d.trackInfos[track.index].streamIndex = i
+			times := smoothChunkTimes(manifest.StreamIndexes[i].ChunksInfos)
+			d.trackInfos[track.index].lastTime = times[len(times) - 1]
 			track.currentDuration = d.trackInfos[track.index].baseDecodeTime
 		}
 	}
@@ -426,23 +496,32 @@ func (d *SmoothDemuxer) Open(path string) error {
 	return nil
 }
 
-/* Retrieve all tracks from a smooth source */
-func (d *SmoothDemuxer) GetTracks(tracks *[]*Track) error {
-	/* Retrieve manifest */
+/* Download and decode the client manifest of the source */
+func (d *SmoothDemuxer) fetchManifest() (*SmoothStreamingMedia, error) {
 	var manifest SmoothStreamingMedia
 	resp, err := http.Get(d.manifestURL)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 	/* Transform XML to usable data structures */
 	decoder := xml.NewDecoder(resp.Body)
 	err = decoder.Decode(&manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+/* Retrieve all tracks from a smooth source */
+func (d *SmoothDemuxer) GetTracks(tracks *[]*Track) error {
+	/* Retrieve manifest */
+	manifest, err := d.fetchManifest()
 	if err != nil {
 		return err
 	}
 	/* Parse manifest */
-	err = d.parseSmoothManifest(&manifest, tracks)
+	err = d.parseSmoothManifest(manifest, tracks)
 	if err != nil {
 		return err
 	}
@@ -458,6 +537,10 @@ func (d *SmoothDemuxer) parseSmoothChunk(url string, track *Track) error {
 		return err
 	}
 	defer resp.Body.Close()
+	/* Live fragments may not be available yet */
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("Can't retrieve chunk '" + url + "' : " + resp.Status)
+	}
 	buffer, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return err
@@ -486,6 +569,18 @@ func (d *SmoothDemuxer) parseSmoothChunk(url string, track *Track) error {
 	return nil
 }
 
+/* Set keys used to decrypt tracks, must be called before GetTracks */
+func (d *SmoothDemuxer) SetDecryptionKeys(keys map[string]string) error {
+	var err error
+	d.keys, err = parseDecryptionKeys(keys)
+	return err
+}
+
+/* Return why the extraction stopped, nil if it did not fail */
+func (d *SmoothDemuxer) Err() error {
+	return d.err
+}
+
 /* Clean demuxer internal info */
 func (d *SmoothDemuxer) Close() {
 	for k := range d.chunksURL {
@@ -502,16 +597,20 @@ func (d *SmoothDemuxer) Close() {
 func (d *SmoothDemuxer) ExtractChunk(tracks *[]*Track, isLive bool) bool {
 	var track *Track
 	var waitList []chan error
+	var waitTracks []int
+	var decryptErrs []*error
+	var liveTimes map[int]int64
 	res := false
+	/* Queue next fragments known from tfrf atoms or from the manifest */
+	if isLive {
+		liveTimes = d.queueLiveFragments()
+	}
 	/* Iterate over collection of chunk URL list */
 	for k := range d.chunksURL {
 		res = res || !d.chunksURL[k].Empty()
-		if d.chunksURL[k].Empty() && !isLive {
-			/* No URL left and it is not live so do nothing */
+		if d.chunksURL[k].Empty() {
+			/* No URL left so do nothing */
 			continue
-		} else if isLive {
-			/* No URL left but it is live so build next chunk URL */
-			d.chunksURL[k].Push(d.buildChunkURL(d.trackInfos[k].baseDecodeTime, d.trackInfos[k].bitrate, d.trackInfos[k].urlTemplate))
 		}
 		track = nil
 		/* Look for the corresponding track */
@@ -525,16 +624,36 @@ func (d *SmoothDemuxer) ExtractChunk(tracks *[]*Track, isLive bool) bool {
 			/* Retrieve URL to chunk and parallelised download and parsing */
 			url := d.chunksURL[k].Pop().(string)
 			c := make(chan error)
+			decryptErr := new(error)
 			go func(c chan error, track *Track) {
-				c <- d.parseSmoothChunk(url, track)
+				err := d.parseSmoothChunk(url, track)
+				if err == nil {
+					/* Samples left encrypted must not be packaged as clear ones */
+					if *decryptErr = track.decryptSamples(); *decryptErr != nil {
+						track.Clean()
+					}
+				}
+				c <- err
 			}(c, track)
 			waitList = append(waitList, c)
+			waitTracks = append(waitTracks, k)
+			decryptErrs = append(decryptErrs, decryptErr)
 		}
 	}
-	/* Wait for all parsing routines to end */
+	/* Wait for all parsing routines to end, a decryption error stops the extraction */
 	for i := 0; i < len(waitList); i++ {
-		<- waitList[i]
+		err := <- waitList[i]
 		close(waitList[i])
+		if time, ok := liveTimes[waitTracks[i]]; ok && err != nil {
+			d.retryLiveFragment(waitTracks[i], time)
+		}
+		if *decryptErrs[i] != nil && d.err == nil {
+			d.err = errors.New("Decryption of track " + strconv.Itoa(waitTracks[i]) + " failed : " + (*decryptErrs[i]).Error())
+		}
 	}
-	return res
+	if d.err != nil {
+		return false
+	}
+	/* A live source goes on until its manifest is no longer live */
+	return res || (isLive && d.live)
 }
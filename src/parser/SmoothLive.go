@@ -0,0 +1,143 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"io"
+	"utils"
+)
+
+/* Return start time of each chunk of a stream, times not declared follow the previous chunk */
+func smoothChunkTimes(chunks []SmoothChunk) []int64 {
+	var res []int64
+	current := int64(0)
+	for _, c := range chunks {
+		if c.StartTime > 0 {
+			current = c.StartTime
+		}
+		res = append(res, current)
+		current += c.Duration
+	}
+	return res
+}
+
+/*
+ Return chunks extracted when a live stream is opened : the last one advertised
+ and the LookaheadCount ones before it, whose tfrf boxes announce the next ones.
+ */
+func smoothLiveStart(times []int64, lookaheadCount int) []int64 {
+	start := len(times) - 1 - lookaheadCount
+	if start < 0 {
+		start = 0
+	}
+	return times[start:]
+}
+
+/* Read a time and a duration of a tfxd or tfrf box, on 64 bits for version 1 */
+func readSmoothFragmentTime(reader io.ReadSeeker, version int) (int64, int64) {
+	if version == 1 {
+		time, _ := utils.AtomReadInt64(reader)
+		duration, _ := utils.AtomReadInt64(reader)
+		return time, duration
+	}
+	time, _ := utils.AtomReadInt32(reader)
+	duration, _ := utils.AtomReadInt32(reader)
+	return int64(time), int64(duration)
+}
+
+/*
+ Extract absolute time and duration of the current fragment from smooth streaming
+ TFXD atom, next fragment of the track starts right after it.
+ */
+func (d *SmoothDemuxer) parseSmoothTFXD(reader io.ReadSeeker, track *Track) {
+	version, _ := utils.AtomReadInt8(reader)
+	reader.Seek(3, 1)
+	time, duration := readSmoothFragmentTime(reader, version)
+	info := d.trackInfos[track.index]
+	info.baseDecodeTime = time + duration
+	if time > info.lastTime {
+		info.lastTime = time
+	}
+}
+
+/* Add upcoming fragments declared by smooth streaming TFRF atom to the lookahead of the track */
+func (d *SmoothDemuxer) parseSmoothTFRF(reader io.ReadSeeker, track *Track) {
+	version, _ := utils.AtomReadInt8(reader)
+	reader.Seek(3, 1)
+	count, _ := utils.AtomReadInt8(reader)
+	info := d.trackInfos[track.index]
+	for i := 0; i < count; i++ {
+		time, _ := readSmoothFragmentTime(reader, version)
+		if time > info.lastTime {
+			info.lookahead = append(info.lookahead, time)
+			info.lastTime = time
+		}
+	}
+}
+
+/*
+ Refetch the manifest and add chunks advertised since the last known one to each
+ track lookahead. The stream has ended once the manifest is no longer live.
+ */
+func (d *SmoothDemuxer) reloadLiveManifest() {
+	manifest, err := d.fetchManifest()
+	if err != nil {
+		return
+	}
+	d.live = manifest.IsLive
+	for _, info := range d.trackInfos {
+		if info.streamIndex >= len(manifest.StreamIndexes) {
+			continue
+		}
+		for _, time := range smoothChunkTimes(manifest.StreamIndexes[info.streamIndex].ChunksInfos) {
+			if time > info.lastTime {
+				info.lookahead = append(info.lookahead, time)
+				info.lastTime = time
+			}
+		}
+	}
+}
+
+/*
+ Queue next live fragment of each track from its lookahead, the manifest is
+ refetched when a lookahead runs out. Return start time of the fragment queued
+ by track.
+ */
+func (d *SmoothDemuxer) queueLiveFragments() map[int]int64 {
+	res := make(map[int]int64)
+	for _, info := range d.trackInfos {
+		if len(info.lookahead) == 0 {
+			d.reloadLiveManifest()
+			break
+		}
+	}
+	for k, info := range d.trackInfos {
+		if !d.chunksURL[k].Empty() || len(info.lookahead) == 0 {
+			continue
+		}
+		time := info.lookahead[0]
+		info.lookahead = info.lookahead[1:]
+		info.baseDecodeTime = time
+		d.chunksURL[k].Push(d.buildChunkURL(time, info.bitrate, info.urlTemplate))
+		res[k] = time
+	}
+	return res
+}
+
+/* Put back a live fragment that could not be retrieved, it is retried first */
+func (d *SmoothDemuxer) retryLiveFragment(k int, time int64) {
+	info := d.trackInfos[k]
+	info.lookahead = append([]int64{time}, info.lookahead...)
+}
@@ -0,0 +1,41 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+  "bytes"
+  "testing"
+  "encoding/hex"
+)
+
+func TestSmoothLookahead(t *testing.T) {
+  times := smoothChunkTimes([]SmoothChunk{{StartTime: 100, Duration: 20}, {Duration: 20}, {Duration: 20}, {Duration: 20}})
+  if start := smoothLiveStart(times, 2); len(start) != 3 || start[0] != 120 {
+    t.Errorf("bad live start. got %v", start)
+  }
+  d := SmoothDemuxer{trackInfos: map[int]*SmoothTrackInfo{0: {lastTime: 160}}}
+  track := Track{index: 0}
+  tfxd, _ := hex.DecodeString("6d1d9b0542d544e680e2141daff757b2" + "01000000" + "00000000000000a0" + "0000000000000014")
+  tfrf, _ := hex.DecodeString("d4807ef2ca3946958e5426cb9e46a79f" + "00000000" + "02" + "000000b4" + "00000014" + "000000c8" + "00000014")
+  d.parseSmoothUUID(bytes.NewReader(tfxd), len(tfxd) + 8, &track)
+  d.parseSmoothUUID(bytes.NewReader(tfrf), len(tfrf) + 8, &track)
+  info := d.trackInfos[0]
+  if info.baseDecodeTime != 180 {
+    t.Errorf("bad decode time from tfxd. want 180, got %d", info.baseDecodeTime)
+  }
+  if len(info.lookahead) != 2 || info.lookahead[0] != 180 || info.lookahead[1] != 200 || info.lastTime != 200 {
+    t.Errorf("bad lookahead from tfrf. got %v", info.lookahead)
+  }
+}
@@ -0,0 +1,81 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"strconv"
+)
+
+/* Time without any data after which a network stream is considered dead, in seconds */
+const STREAM_READ_TIMEOUT = 10
+
+/* Protocols of live network streams read by FFMPEG (MPEG-TS over UDP, RTP, SRT or TCP) */
+var streamProtocols = []string{"udp", "rtp", "srt", "tcp"}
+
+/* Return if a protocol is a live network stream */
+func IsStreamProtocol(proto string) bool {
+	for _, p := range streamProtocols {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
+
+/* Return constructor of FFMPEG demuxers opening URLs of a network protocol (streams and remote files) */
+func streamConstructor(proto string) DemuxerConstructor {
+	return func() Demuxer {
+		return &FFMPEGDemuxer{proto: proto}
+	}
+}
+
+/*
+ Return FFMPEG input options of a network stream : large socket buffers and a
+ receiving FIFO for UDP/RTP, reconnection for remote files, and a read timeout
+ in microseconds for every protocol. Options given by the user override them.
+ */
+func streamOptions(proto string, options map[string]string, readTimeout float64) map[string]string {
+	res := make(map[string]string)
+	res["rw_timeout"] = strconv.FormatInt(int64(readTimeout * 1000000), 10)
+	if proto == "udp" || proto == "rtp" {
+		res["buffer_size"] = "4194304"
+	}
+	if IsRemoteProtocol(proto) {
+		res["reconnect"] = "1"
+	}
+	if proto == "udp" {
+		res["fifo_size"] = "50000"
+		res["overrun_nonfatal"] = "1"
+		res["timeout"] = res["rw_timeout"]
+	}
+	for name, value := range options {
+		res[name] = value
+	}
+	return res
+}
+
+/* Set FFMPEG input options and read timeout (seconds) of a network stream, must be called before GetTracks */
+func (d *FFMPEGDemuxer) SetInputOptions(options map[string]string, readTimeout float64) {
+	if readTimeout <= 0 {
+		readTimeout = STREAM_READ_TIMEOUT
+	}
+	d.readTimeout = readTimeout
+	d.options = streamOptions(d.proto, options, readTimeout)
+}
+
+/* Return why extraction of a network stream stopped, nil while it is running */
+func (d *FFMPEGDemuxer) Err() error {
+	return d.err
+}
@@ -0,0 +1,30 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import "testing"
+
+func TestStreamOptions(t *testing.T) {
+  if !IsStreamProtocol("udp") || IsStreamProtocol("file") {
+    t.Errorf("bad stream protocols")
+  }
+  options := streamOptions("udp", map[string]string{"fifo_size": "1000"}, 5)
+  if options["rw_timeout"] != "5000000" || options["timeout"] != "5000000" || options["fifo_size"] != "1000" || options["overrun_nonfatal"] != "1" {
+    t.Errorf("bad udp options. got %v", options)
+  }
+  if options = streamOptions("srt", nil, 2.5); len(options) != 1 || options["rw_timeout"] != "2500000" {
+    t.Errorf("bad srt options. got %v", options)
+  }
+}
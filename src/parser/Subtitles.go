@@ -0,0 +1,269 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"utils"
+	"bytes"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"encoding/xml"
+)
+
+/* Text formats used for subtitle tracks */
+const (
+	TEXT_FORMAT_WVTT = "wvtt"
+	TEXT_FORMAT_STPP = "stpp"
+)
+
+/* Subtitle codecs of source streams */
+const (
+	SUBTITLE_SOURCE_TEXT   = "text"
+	SUBTITLE_SOURCE_TX3G   = "tx3g"
+	SUBTITLE_SOURCE_ASS    = "ass"
+)
+
+var assOverrideRegexp = regexp.MustCompile(`\{[^}]*\}`)
+
+/* Structure representing one subtitle cue, times are in track timescale */
+type Cue struct {
+	start int64
+	end   int64
+	text  string
+}
+
+/* Extract cue text from a source subtitle packet */
+func subtitleText(source string, data []byte) string {
+	switch source {
+	case SUBTITLE_SOURCE_TX3G:
+		/* Text is prefixed by its size, styles may follow */
+		if len(data) < 2 {
+			return ""
+		}
+		size := (int(data[0]) << 8) | int(data[1])
+		if size > len(data) - 2 {
+			size = len(data) - 2
+		}
+		return string(data[2:2 + size])
+	case SUBTITLE_SOURCE_ASS:
+		/* ReadOrder,Layer,Style,Name,MarginL,MarginR,MarginV,Effect,Text */
+		fields := strings.SplitN(string(data), ",", 9)
+		text := fields[len(fields) - 1]
+		text = assOverrideRegexp.ReplaceAllString(text, "")
+		text = strings.Replace(text, "\\N", "\n", -1)
+		return strings.Replace(text, "\\n", "\n", -1)
+	}
+	return strings.TrimSpace(string(data))
+}
+
+/* Append a cue to a text track, it will be packaged in the chunks it overlaps */
+func (t *Track) appendCue(start int64, end int64, text string) {
+	if end <= start || text == "" {
+		return
+	}
+	t.cues = append(t.cues, &Cue{start, end, text})
+}
+
+/* Append a sample holding generated text data to the track */
+func (t *Track) appendTextSample(start int64, end int64, data []byte) {
+	sample := new(Sample)
+	sample.pts = start
+	sample.dts = start
+	sample.duration = end - start
+	sample.keyFrame = true
+	sample.data = CArray(data)
+	sample.size = CInt(len(data))
+	runtime.SetFinalizer(sample, allocatedSampleFinalizer)
+	t.appendSample(sample)
+}
+
+/* Build a WebVTT cue box (vttc) */
+func buildVTTCue(text string) []byte {
+	payload, _ := utils.BuildAtom("payl", []byte(text))
+	cue, _ := utils.BuildAtom("vttc", payload)
+	return cue
+}
+
+/* Build wvtt samples covering [start, end[ : one sample per interval between cue boundaries */
+func (t *Track) buildWVTTSamples(start int64, end int64) {
+	/* Collect cue boundaries inside the chunk */
+	bounds := []int64{start, end}
+	for _, cue := range t.cues {
+		if cue.start > start && cue.start < end {
+			bounds = append(bounds, cue.start)
+		}
+		if cue.end > start && cue.end < end {
+			bounds = append(bounds, cue.end)
+		}
+	}
+	sortInt64(bounds)
+	for i := 0; i + 1 < len(bounds); i++ {
+		if bounds[i] == bounds[i + 1] {
+			continue
+		}
+		var data []byte
+		for _, cue := range t.cues {
+			if cue.start <= bounds[i] && cue.end > bounds[i] {
+				data = append(data, buildVTTCue(cue.text)...)
+			}
+		}
+		/* Nothing displayed : empty cue box */
+		if len(data) == 0 {
+			data, _ = utils.BuildAtom("vtte", []byte{})
+		}
+		t.appendTextSample(bounds[i], bounds[i + 1], data)
+	}
+}
+
+/* Format a time in track timescale as a TTML clock time in seconds */
+func (t *Track) ttmlTime(val int64) string {
+	return strconv.FormatFloat(float64(val) / float64(t.timescale), 'f', 3, 64) + "s"
+}
+
+/* Build one stpp sample covering [start, end[ with an IMSC1 text document */
+func (t *Track) buildSTPPSamples(start int64, end int64) {
+	var buf bytes.Buffer
+	lang := t.language
+	if lang == "" {
+		lang = "und"
+	}
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<tt xmlns="http://www.w3.org/ns/ttml" xmlns:ttp="http://www.w3.org/ns/ttml#parameter" ttp:profile="http://www.w3.org/ns/ttml/profile/imsc1/text" xml:lang="` + lang + `">
+  <body>
+    <div>`)
+	for _, cue := range t.cues {
+		if cue.end <= start || cue.start >= end {
+			continue
+		}
+		cueStart := cue.start
+		if cueStart < start {
+			cueStart = start
+		}
+		cueEnd := cue.end
+		if cueEnd > end {
+			cueEnd = end
+		}
+		buf.WriteString(`
+      <p begin="` + t.ttmlTime(cueStart) + `" end="` + t.ttmlTime(cueEnd) + `">`)
+		lines := strings.Split(cue.text, "\n")
+		for i, line := range lines {
+			if i > 0 {
+				buf.WriteString(`<br/>`)
+			}
+			xml.EscapeText(&buf, []byte(line))
+		}
+		buf.WriteString(`</p>`)
+	}
+	buf.WriteString(`
+    </div>
+  </body>
+</tt>
+`)
+	t.appendTextSample(start, end, buf.Bytes())
+}
+
+/* Build text samples of the chunk [start, start + duration[ from pending cues */
+func (t *Track) BuildTextSamples(start int64, duration int64) {
+	end := start + duration
+	if t.fourcc == TEXT_FORMAT_STPP {
+		t.buildSTPPSamples(start, end)
+	} else {
+		t.buildWVTTSamples(start, end)
+	}
+	/* Keep cues still displayed after this chunk */
+	var cues []*Cue
+	for _, cue := range t.cues {
+		if cue.end > end {
+			cues = append(cues, cue)
+		}
+	}
+	t.cues = cues
+}
+
+/*
+ Index chunks of a text track on the chunks of the reference track of an indexed
+ source, all the cues of the source having been read. Chunk size is the size of the
+ text of the cues it overlaps.
+ */
+func (t *Track) indexTextChunks(reference *Track) {
+	for i := 0; i < len(reference.chunksStart); i++ {
+		start := int64(TimebaseRescale(int(reference.chunksStart[i]), reference.timescale, t.timescale))
+		duration := int64(TimebaseRescale(int(reference.chunksDuration[i]), reference.timescale, t.timescale))
+		size := 0
+		for _, cue := range t.cues {
+			if cue.start < start + duration && cue.end > start {
+				size += len(cue.text)
+			}
+		}
+		t.appendIndexedChunk(start, duration, size)
+	}
+}
+
+/* Build text samples of an indexed chunk, cues are kept for the other chunks */
+func (t *Track) buildIndexedTextSamples(chunk int) {
+	cues := t.cues
+	t.BuildTextSamples(t.chunksStart[chunk], t.chunksDuration[chunk])
+	t.cues = cues
+}
+
+/* Sort a slice of int64 (insertion sort, slices are small) */
+func sortInt64(values []int64) {
+	for i := 1; i < len(values); i++ {
+		for j := i; j > 0 && values[j] < values[j - 1]; j-- {
+			values[j], values[j - 1] = values[j - 1], values[j]
+		}
+	}
+}
+
+/* Set format used to package a text track (wvtt or stpp) */
+func (t *Track) SetTextFormat(format string) {
+	if !t.isText {
+		return
+	}
+	if format == TEXT_FORMAT_STPP {
+		t.fourcc = TEXT_FORMAT_STPP
+	} else {
+		t.fourcc = TEXT_FORMAT_WVTT
+	}
+}
+
+/* Return if the track is a text track */
+func (t *Track) IsText() bool {
+	return t.isText
+}
+
+/* Return track language, empty if unknown */
+func (t *Track) Language() string {
+	return t.language
+}
+
+/* Return ISO 639-2/T language packed for mdhd, und if unknown */
+func (t *Track) packedLanguage() int {
+	lang := t.language
+	if len(lang) != 3 {
+		lang = "und"
+	}
+	res := 0
+	for i := 0; i < 3; i++ {
+		c := int(lang[i])
+		if c < 'a' || c > 'z' {
+			return 0x55C4
+		}
+		res = (res << 5) | (c - 0x60)
+	}
+	return res
+}
@@ -0,0 +1,54 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+  "strings"
+  "testing"
+)
+
+func TestWVTTSamples(t *testing.T) {
+  track := Track{isText: true, fourcc: TEXT_FORMAT_WVTT, timescale: 1000}
+  track.appendCue(100, 300, "first")
+  track.appendCue(250, 500, "second")
+
+  track.BuildTextSamples(0, 400)
+  cases := []struct {
+    pts, duration int64
+    cues int
+  }{
+    {0, 100, 0},
+    {100, 150, 1},
+    {250, 50, 2},
+    {300, 100, 1},
+  }
+  if len(track.samples) != len(cases) {
+    t.Fatalf("bad sample count. want %d, got %d", len(cases), len(track.samples))
+  }
+  for i, c := range cases {
+    s := track.samples[i]
+    data := s.GetData()
+    if s.pts != c.pts || s.duration != c.duration {
+      t.Errorf("bad sample %d timing. want %d/%d, got %d/%d", i, c.pts, c.duration, s.pts, s.duration)
+    }
+    if got := strings.Count(string(data), "vttc"); got != c.cues {
+      t.Errorf("bad sample %d cue count. want %d, got %d", i, c.cues, got)
+    }
+  }
+  /* Second cue is still displayed after the chunk */
+  if len(track.cues) != 1 || track.cues[0].text != "second" {
+    t.Errorf("bad pending cues after chunk. got %d", len(track.cues))
+  }
+}
@@ -0,0 +1,234 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"os"
+	"image"
+	"bytes"
+	"errors"
+	"strconv"
+	"image/jpeg"
+	"image/color"
+	"path/filepath"
+)
+
+/* Size and layout of thumbnail tile sheets */
+const (
+	THUMBNAIL_WIDTH   = 160
+	THUMBNAIL_COLUMNS = 5
+	THUMBNAIL_ROWS    = 5
+)
+
+/*
+ Structure used to build JPEG tile sheets from key frames of a video track. Times
+ are in the source track timescale, on the chunks timeline.
+ */
+type Thumbnails struct {
+	source      *Track
+	decoder     *videoDecoder
+	path        string
+	interval    int64
+	width       int
+	height      int
+	next        int64
+	started     bool
+	sheet       *image.RGBA
+	count       int
+	sheetStart  int64
+	sheetsStart []int64
+	totalSize   int64
+}
+
+/* Create thumbnails generation from the smallest video track, interval is in seconds */
+func NewThumbnails(tracks []*Track, interval int, path string) (*Thumbnails, error) {
+	var source *Track
+	for _, t := range tracks {
+		/* Encrypted samples can't be decoded */
+		if t.isAudio || t.isText || t.trickSource != nil || t.transcodeSource != nil || t.sourceEncrypted() {
+			continue
+		}
+		if source == nil || t.width < source.width {
+			source = t
+		}
+	}
+	if source == nil || source.width <= 0 || source.height <= 0 {
+		return nil, errors.New("No video track to build thumbnails from")
+	}
+	decoder, err := openVideoDecoder(source)
+	if err != nil { return nil, err }
+	th := new(Thumbnails)
+	th.source = source
+	th.decoder = decoder
+	th.path = path
+	th.interval = int64(interval) * int64(source.timescale)
+	th.width = THUMBNAIL_WIDTH
+	/* Keep display aspect ratio, with an even height */
+	th.height = (THUMBNAIL_WIDTH * source.height / source.displayWidth()) &^ 1
+	return th, nil
+}
+
+/* Draw an image scaled in a slot of the current sheet */
+func (th *Thumbnails) drawThumbnail(img *image.YCbCr, slot int) {
+	x0 := (slot % THUMBNAIL_COLUMNS) * th.width
+	y0 := (slot / THUMBNAIL_COLUMNS) * th.height
+	bounds := img.Bounds()
+	for y := 0; y < th.height; y++ {
+		sy := bounds.Min.Y + y * bounds.Dy() / th.height
+		for x := 0; x < th.width; x++ {
+			sx := bounds.Min.X + x * bounds.Dx() / th.width
+			cOffset := img.COffset(sx, sy)
+			r, g, b := color.YCbCrToRGB(img.Y[img.YOffset(sx, sy)], img.Cb[cOffset], img.Cr[cOffset])
+			th.sheet.SetRGBA(x0 + x, y0 + y, color.RGBA{r, g, b, 0xFF})
+		}
+	}
+}
+
+/* Return name of the file of a sheet */
+func (th *Thumbnails) sheetName(start int64) string {
+	return "thumbnails_" + strconv.FormatInt(start, 10) + ".jpg"
+}
+
+/* Encode current sheet, it is added to the timeline the first time it is written */
+func (th *Thumbnails) writeSheet() error {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, th.sheet, &jpeg.Options{Quality: 75})
+	if err != nil { return err }
+	f, err := os.OpenFile(filepath.Join(th.path, th.sheetName(th.sheetStart)), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+	if err != nil { return err }
+	defer f.Close()
+	_, err = f.Write(buf.Bytes())
+	if err != nil { return err }
+	if len(th.sheetsStart) == 0 || th.sheetsStart[len(th.sheetsStart) - 1] != th.sheetStart {
+		th.sheetsStart = append(th.sheetsStart, th.sheetStart)
+		th.totalSize += int64(buf.Len())
+	}
+	return nil
+}
+
+/* Add a thumbnail in the next slot, a sheet is written once full */
+func (th *Thumbnails) addThumbnail(img *image.YCbCr) error {
+	if th.sheet == nil {
+		th.sheet = image.NewRGBA(image.Rect(0, 0, th.width * THUMBNAIL_COLUMNS, th.height * THUMBNAIL_ROWS))
+		th.sheetStart = th.next
+		th.count = 0
+	}
+	th.drawThumbnail(img, th.count)
+	th.count++
+	th.next += th.interval
+	if th.count < THUMBNAIL_COLUMNS * THUMBNAIL_ROWS {
+		return nil
+	}
+	err := th.writeSheet()
+	th.sheet = nil
+	return err
+}
+
+/*
+ Decode key frames of the source samples waiting to be packaged. Must be called
+ before the source chunk is built. A key frame fills every slot up to its time.
+ */
+func (th *Thumbnails) Update() error {
+	samples := th.source.samples
+	if len(samples) <= 0 {
+		return nil
+	}
+	/* Offset from sample times to the chunks timeline */
+	base := th.source.currentDuration - samples[0].pts
+	for _, s := range samples {
+		time := s.pts + base
+		if !s.keyFrame || (th.started && time < th.next) {
+			continue
+		}
+		img, err := th.decoder.decode(s)
+		if err != nil { return err }
+		if !th.started {
+			th.next = time
+			th.started = true
+		}
+		for th.next <= time {
+			err = th.addThumbnail(img)
+			if err != nil { return err }
+		}
+	}
+	return nil
+}
+
+/* Write the sheet being filled, used at the end of a file and for live streams */
+func (th *Thumbnails) WritePartial() error {
+	if th.sheet == nil {
+		return nil
+	}
+	return th.writeSheet()
+}
+
+/* Remove sheets that are out of the source track window */
+func (th *Thumbnails) CleanForLive() {
+	windowStart := th.source.currentDuration
+	for _, duration := range th.source.chunksDuration {
+		windowStart -= duration
+	}
+	sheetDuration := th.interval * THUMBNAIL_COLUMNS * THUMBNAIL_ROWS
+	for len(th.sheetsStart) > 1 && th.sheetsStart[0] + sheetDuration <= windowStart {
+		os.Remove(filepath.Join(th.path, th.sheetName(th.sheetsStart[0])))
+		th.sheetsStart = th.sheetsStart[1:]
+	}
+}
+
+/* Build thumbnails adaptation set (DASH-IF image track) */
+func (th *Thumbnails) BuildAdaptationSet() string {
+	if len(th.sheetsStart) <= 0 {
+		return ""
+	}
+	sheetDuration := th.interval * THUMBNAIL_COLUMNS * THUMBNAIL_ROWS
+	seconds := (float64(sheetDuration) * float64(len(th.sheetsStart))) / float64(th.source.timescale)
+	bandwidth := int(float64(th.totalSize * 8) / seconds)
+	res := `
+    <AdaptationSet
+      id="3"
+      contentType="image"
+      mimeType="image/jpeg">
+      <SegmentTemplate
+        timescale="` + strconv.Itoa(th.source.timescale) + `"` + th.source.presentationTimeOffset() + `
+        media="thumbnails_$Time$.jpg">
+        <SegmentTimeline>`
+	for i, start := range th.sheetsStart {
+		if i == 0 {
+			res += `
+          <S t="` + strconv.FormatInt(start, 10) + `" d="` + strconv.FormatInt(sheetDuration, 10) + `" />`
+		} else {
+			res += `
+          <S d="` + strconv.FormatInt(sheetDuration, 10) + `" />`
+		}
+	}
+	return res + `
+        </SegmentTimeline>
+      </SegmentTemplate>
+      <Representation
+        id="thumbnails"
+        bandwidth="` + strconv.Itoa(bandwidth) + `"
+        width="` + strconv.Itoa(th.width * THUMBNAIL_COLUMNS) + `"
+        height="` + strconv.Itoa(th.height * THUMBNAIL_ROWS) + `">
+        <EssentialProperty
+          schemeIdUri="http://dashif.org/thumbnail_tile"
+          value="` + strconv.Itoa(THUMBNAIL_COLUMNS) + `x` + strconv.Itoa(THUMBNAIL_ROWS) + `" />
+      </Representation>
+    </AdaptationSet>`
+}
+
+/* Release decoder */
+func (th *Thumbnails) Close() {
+	th.decoder.close()
+}
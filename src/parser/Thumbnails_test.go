@@ -0,0 +1,55 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+  "os"
+  "image"
+  "strings"
+  "io/ioutil"
+  "path/filepath"
+  "testing"
+)
+
+func TestThumbnailSheets(t *testing.T) {
+  dir, err := ioutil.TempDir("", "thumbnails")
+  if err != nil {
+    t.Fatalf("can't create directory: %v", err)
+  }
+  defer os.RemoveAll(dir)
+  source := Track{timescale: 1000, width: 640, height: 360}
+  th := Thumbnails{source: &source, path: dir, interval: 2000, width: 160, height: 90}
+  img := image.NewYCbCr(image.Rect(0, 0, 640, 360), image.YCbCrSubsampleRatio420)
+  for i := 0; i < THUMBNAIL_COLUMNS * THUMBNAIL_ROWS + 1; i++ {
+    if err := th.addThumbnail(img); err != nil {
+      t.Fatalf("can't add thumbnail: %v", err)
+    }
+  }
+  th.WritePartial()
+  th.WritePartial()
+
+  if len(th.sheetsStart) != 2 || th.sheetsStart[1] != 50000 {
+    t.Fatalf("bad sheets. want [0 50000], got %v", th.sheetsStart)
+  }
+  for _, start := range th.sheetsStart {
+    if _, err := os.Stat(filepath.Join(dir, th.sheetName(start))); err != nil {
+      t.Errorf("missing sheet: %v", err)
+    }
+  }
+  set := th.BuildAdaptationSet()
+  if !strings.Contains(set, `<S t="0" d="50000" />`) || !strings.Contains(set, `width="800"`) || !strings.Contains(set, `value="5x5"`) {
+    t.Errorf("bad adaptation set: %s", set)
+  }
+}
@@ -16,6 +16,7 @@ package parser
 
 import (
 	"os"
+	"io"
 	"fmt"
 	"time"
 	"utils"
@@ -25,8 +26,12 @@ import (
 	"io/ioutil"
 	"path/filepath"
 	"encoding/hex"
+	"encoding/base64"
 )
 
+/* Default duration in seconds of the chunks kept in live manifests */
+const DEFAULT_LIVE_WINDOW = 60
+
 /* Structure used to build chunks */
 type Builder struct {
 	builders map[string]AtomBuilder
@@ -48,19 +53,38 @@ type SampleEncryption struct {
 type pss struct {
 	systemId    string
 	privateData []byte
+	keyIds      [][]byte
 }
 
 /* Strcture used to store encryption specific info of the track */
 type EncryptionInfo struct {
-	pssList    []pss
-	subEncrypt bool
-	keyId      string
+	pssList     []pss
+	subEncrypt  bool
+	keyId       string
+	licenseUrl  string
+	scheme      string
+	key         []byte
+	iv          []byte
+	fixedIV     bool
+	cryptBlocks int
+	skipBlocks  int
 }
 
 /* Structure representing a track inside an input file */
 type Track struct {
 	index            int
 	isAudio	         bool
+	isText           bool
+	language         string
+	role             string
+	label            string
+	subtitleSource   string
+	cues             []*Cue
+	trickSource      *Track
+	trickFrames      int
+	trickKeyFrames   int
+	transcodeSource  *Track
+	rendition        string
 	creationTime     int
 	duration         int
 	modificationTime int
@@ -69,23 +93,48 @@ type Track struct {
 	width            int
 	height           int
 	sampleRate       int
+	channels         int
+	sarNum           int
+	sarDen           int
+	frameRateNum     int
+	frameRateDen     int
 	bitsPerSample    int
 	colorTableId     int
 	bandwidth        int
 	initOffset			 int
 	codec            string
+	fourcc           string
 	currentDuration  int64
 	extradata        []byte
 	samples          []*Sample
 	chunksDuration   []int64
 	chunksSize       []int
 	chunksName       []string
+	chunksStart      []int64
 	chunksRanges		 []*Range
 	encryptInfos     *EncryptionInfo
+	decryptKey       []byte
+	recording        *recording
 	builder          Builder
-	chunksDepth      int
+	liveWindow       float64
+	mediaSequence    int
 	startTime        int64
 	segmentType      string
+	onDemand         bool
+	earliestTime     int64
+	initSize         int
+	indexSize        int
+}
+
+/* Structure describing a track for the files listing */
+type TrackDescription struct {
+	Id        string
+	Type      string
+	Codec     string
+	Bandwidth int
+	Language  string
+	Role      string
+	Label     string
 }
 
 /* Structure representing range in a segment base DASH */
@@ -113,6 +162,10 @@ func (t *Track) Print() {
 	fmt.Println("Track :")
 	fmt.Println("\tindex : ", t.index)
 	fmt.Println("\tisAudio : ", t.isAudio)
+	fmt.Println("\tisText : ", t.isText)
+	fmt.Println("\tlanguage : ", t.language)
+	fmt.Println("\trole : ", t.role)
+	fmt.Println("\tlabel : ", t.label)
 	fmt.Println("\tcreationTime : ", t.creationTime)
 	fmt.Println("\tmodificationTime : ", t.modificationTime)
 	fmt.Println("\tduration : ", t.duration)
@@ -121,10 +174,14 @@ func (t *Track) Print() {
 	fmt.Println("\twidth : ", t.width)
 	fmt.Println("\theight : ", t.height)
 	fmt.Println("\tsampleRate : ", t.sampleRate)
+	fmt.Println("\tsar : ", t.SampleAspectRatio())
+	fmt.Println("\tframeRate : ", t.FrameRate())
+	fmt.Println("\tchannels : ", t.channels)
 	fmt.Println("\tbitsPerSample : ", t.bitsPerSample)
 	fmt.Println("\tcolorTableId : ", t.colorTableId)
 	fmt.Println("\tbandwidth: ", t.bandwidth)
 	fmt.Println("\tcodec: ", t.codec)
+	fmt.Println("\tfourcc: ", t.fourcc)
 	fmt.Println("\tencrypted : ", (t.encryptInfos != nil))
 	fmt.Println("\tsamples count : ", len(t.samples))
 	fmt.Println("\tsegment type : ", t.segmentType)
@@ -168,17 +225,30 @@ func (b *Builder) Initialise() {
 	b.builders["tfdt"] = buildTFDT /**/
 	b.builders["trun"] = buildTRUN /**/
 	b.builders["mdat"] = buildMDAT /**/
-	b.builders["mp4a"] = buildMP4AENCA /**/
+	b.builders["mp4a"] = buildAudioSampleEntry /**/
+	b.builders["ac-3"] = buildAudioSampleEntry /**/
+	b.builders["ec-3"] = buildAudioSampleEntry /**/
+	b.builders["dac3"] = buildDAC3 /**/
+	b.builders["dec3"] = buildDEC3 /**/
 b.builders["esds"] = buildESDS /**/
 	b.builders["avcC"] = buildAVCC /**/
-	b.builders["avc1"] = buildAVC1ENCV /**/
+	b.builders["pasp"] = buildPASP /**/
+	b.builders["hvcC"] = buildHVCC /**/
+	b.builders["avc1"] = buildVisualSampleEntry /**/
+	b.builders["hvc1"] = buildVisualSampleEntry /**/
+	b.builders["hev1"] = buildVisualSampleEntry /**/
 	b.builders["sinf"] = buildSINF /**/
 	b.builders["frma"] = buildFRMA /**/
 	b.builders["schm"] = buildSCHM /**/
 	b.builders["schi"] = buildSCHI /**/
 	b.builders["tenc"] = buildTENC /**/
-	b.builders["enca"] = buildMP4AENCA /**/
-	b.builders["encv"] = buildAVC1ENCV /**/
+	b.builders["enca"] = buildAudioSampleEntry /**/
+	b.builders["encv"] = buildVisualSampleEntry /**/
+	b.builders["wvtt"] = buildWVTT /**/
+	b.builders["vttC"] = buildVTTC /**/
+	b.builders["stpp"] = buildSTPP /**/
+	b.builders["nmhd"] = buildNMHD /**/
+	b.builders["sthd"] = buildSTHD /**/
 	b.builders["senc"] = buildSENC
 	b.builders["saiz"] = buildSAIZ
 	b.builders["saio"] = buildSAIO
@@ -271,7 +341,7 @@ func (t *Track) buildInitChunk(path string) error {
 /* Build a chunk with samples from internal information */
 func (t *Track) buildSampleChunk(samples []*Sample, path string) (int64, error) {
 	/* Build chunk atoms */
-	b, err := t.buildAtoms("styp", "free", "sidx", "moof", "mdat")
+	b, err := t.BuildChunkData()
 	if err != nil {
 		return 0, err
 	}
@@ -288,12 +358,103 @@ func (t *Track) buildSampleChunk(samples []*Sample, path string) (int64, error)
 	return t.computeChunkDuration(), err
 }
 
+/* Build chunk atoms from current samples without writing them */
+func (t *Track) BuildChunkData() ([]byte, error) {
+	if len(t.samples) <= 0 {
+		return nil, errors.New("No sample to build chunk")
+	}
+	err := t.encryptSamples()
+	if err != nil { return nil, err }
+	return t.buildAtoms("styp", "free", "sidx", "moof", "mdat")
+}
+
+/* Append a fragment (moof and mdat) to the fragments file of an on-demand track */
+func (t *Track) buildOnDemandFragment(path string) (int64, error) {
+	/* Build fragment atoms */
+	b, err := t.buildAtoms("moof", "mdat")
+	if err != nil {
+		return 0, err
+	}
+	/* Start a new file with the first fragment */
+	flags := os.O_WRONLY|os.O_CREATE|os.O_APPEND
+	if len(t.chunksSize) == 0 {
+		flags |= os.O_TRUNC
+		t.earliestTime = t.samples[0].pts
+	}
+	f, err := os.OpenFile(path, flags, os.ModePerm)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	/* Write generated atoms */
+	_, err = f.Write(b)
+	t.chunksSize = append(t.chunksSize, len(b))
+	return t.computeChunkDuration(), err
+}
+
+/* Return name of the temporary file holding fragments of an on-demand track */
+func (t *Track) fragmentsName() string {
+	return "fragments_" + t.RepresentationId() + ".tmp"
+}
+
+/* Return name of the single file of an on-demand track */
+func (t *Track) OnDemandName() string {
+	return t.RepresentationId() + ".mp4"
+}
+
+/* Write init atoms, a sidx indexing every fragment and the fragments in the on-demand file */
+func (t *Track) BuildOnDemandFile(path string) error {
+	init, err := t.buildAtoms("ftyp", "free", "moov")
+	if err != nil { return err }
+	index, err := buildOnDemandSIDX(*t)
+	if err != nil { return err }
+	fragmentsPath := filepath.Join(path, t.fragmentsName())
+	in, err := os.Open(fragmentsPath)
+	if err != nil { return err }
+	defer os.Remove(fragmentsPath)
+	defer in.Close()
+	out, err := os.OpenFile(filepath.Join(path, t.OnDemandName()), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+	if err != nil { return err }
+	defer out.Close()
+	_, err = out.Write(append(init, index...))
+	if err != nil { return err }
+	_, err = io.Copy(out, in)
+	t.initSize = len(init)
+	t.indexSize = len(index)
+	return err
+}
+
+/* Produce a single file per track (on-demand profile) instead of one file per chunk */
+func (t *Track) SetOnDemand(onDemand bool) {
+	t.onDemand = onDemand
+}
+
+/* Append a chunk found while indexing a source, its samples will be extracted on request */
+func (t *Track) appendIndexedChunk(start int64, duration int64, size int) {
+	t.chunksStart = append(t.chunksStart, start)
+	t.chunksDuration = append(t.chunksDuration, duration)
+	t.chunksSize = append(t.chunksSize, size)
+	t.chunksName = append(t.chunksName, "chunk_" + t.RepresentationId() + "_" + strconv.FormatInt(t.currentDuration, 10) + ".mp4")
+	t.currentDuration += duration
+}
+
+/* Return position of an indexed chunk from its file name, -1 if not found */
+func (t *Track) FindChunk(name string) int {
+	for i := 0; i < len(t.chunksName) && i < len(t.chunksStart); i++ {
+		if t.chunksName[i] == name {
+			return i
+		}
+	}
+	return -1
+}
+
 /* Initialise build for the track */
 func (t *Track) InitialiseBuild(path string) error {
 	t.builder = Builder{}
-	t.chunksDepth = 30
+	t.liveWindow = DEFAULT_LIVE_WINDOW
 	/* Initialise builder */
 	t.builder.Initialise()
+	t.applyCodecParameters()
 	/* Create destination directory if it does not exist */
 	if !utils.FileExist(path) {
 		os.MkdirAll(path, os.ModeDir|os.ModePerm)
@@ -303,15 +464,21 @@ func (t *Track) InitialiseBuild(path string) error {
 	return nil
 }
 
+/* Return track type name used in file names and representation ids */
+func (t *Track) typeName() string {
+	if t.isAudio {
+		return "audio"
+	} else if t.isText {
+		return "text"
+	} else if t.trickSource != nil {
+		return "trick"
+	}
+	return "video"
+}
+
 /* Build the init chunk for the track */
 func (t *Track) BuildInit(path string) error {
-	var typename string
-	if (t.isAudio) {
-		typename = "audio"
-	} else {
-		typename = "video"
-	}
-	return t.buildInitChunk(filepath.Join(path, "init_" + typename + strconv.Itoa(t.index) + ".mp4"))
+	return t.buildInitChunk(filepath.Join(path, "init_" + t.RepresentationId() + ".mp4"))
 }
 
 /* Build a chunk for the track */
@@ -320,17 +487,19 @@ func (t *Track) BuildChunk(path string) (float64, error) {
 	if (len(t.samples) <= 0) {
 		return 0, nil
 	}
-	var typename string
-	/* Set string type name */
-	if (t.isAudio) {
-		typename = "audio"
+	var duration int64
+	/* Clear samples are encrypted when a content key is set */
+	err := t.encryptSamples()
+	if err != nil { return 0, err }
+	if t.onDemand {
+		/* Append one fragment to the track file */
+		duration, err = t.buildOnDemandFragment(filepath.Join(path, t.fragmentsName()))
 	} else {
-		typename = "video"
+		/* Generate chunk file name */
+		filename := "chunk_" + t.RepresentationId() + "_" + strconv.FormatInt(t.currentDuration, 10) + ".mp4"
+		/* Generate one chunk */
+		duration, err = t.buildSampleChunk(t.samples, filepath.Join(path, filename))
 	}
-	/* Generate chunk file name */
-	filename := "chunk_" + typename + strconv.Itoa(t.index) + "_" + strconv.FormatInt(t.currentDuration, 10) + ".mp4"
-	/* Generate one chunk */
-	duration, err := t.buildSampleChunk(t.samples, filepath.Join(path, filename))
 	/* Append duration to list for manifest generation */
 	t.chunksDuration = append(t.chunksDuration, duration)
 	/* Increment current duration for next chunk filename */
@@ -346,7 +515,7 @@ func (t *Track) buildVideoManifestAdaptation() string {
 	}
 	res := `
       <SegmentTemplate
-        timescale="` + strconv.Itoa(t.timescale) + `"
+        timescale="` + strconv.Itoa(t.timescale) + `"` + t.presentationTimeOffset() + `
         initialization="init_$RepresentationID$.mp4"
         media="chunk_$RepresentationID$_$Time$.mp4"
         startNumber="1">
@@ -367,15 +536,48 @@ func (t *Track) buildVideoManifestAdaptation() string {
 	return res
 }
 
+/* Build segment base part of an on-demand representation */
+func (t *Track) buildOnDemandSegmentBase() string {
+	indexEnd := t.initSize + t.indexSize - 1
+	return `
+        <BaseURL>` + t.OnDemandName() + `</BaseURL>
+        <SegmentBase
+          timescale="` + strconv.Itoa(t.timescale) + `"
+          indexRange="` + strconv.Itoa(t.initSize) + `-` + strconv.Itoa(indexEnd) + `">
+          <Initialization range="0-` + strconv.Itoa(t.initSize - 1) + `" />
+        </SegmentBase>`
+}
+
 /* Build video representation part of the manifest */
 func (t *Track) buildVideoManifestRepresentation() string {
 	res := `
       <Representation
-        id="video` + strconv.Itoa(t.index) + `"
+        id="` + t.RepresentationId() + `"
         bandwidth="` + strconv.Itoa(t.bandwidth) + `"
         codecs="` + t.codec + `"
         width="` + strconv.Itoa(t.width) + `"
-        height="` + strconv.Itoa(t.height) + `" />`
+        height="` + strconv.Itoa(t.height) + `"`
+	/* Key frames of a trick mode track are not played at the source frame rate */
+	if t.FrameRate() != "" && t.trickSource == nil {
+		res += `
+        frameRate="` + t.FrameRate() + `"`
+	}
+	if t.SampleAspectRatio() != "" {
+		res += `
+        sar="` + t.SampleAspectRatio() + `"`
+	}
+	/* Key frames can be decoded independently */
+	if t.trickSource != nil {
+		res += `
+        maxPlayoutRate="` + strconv.Itoa(t.maxPlayoutRate()) + `"
+        codingDependency="false"`
+	}
+	if t.onDemand {
+		res += `>` + t.buildOnDemandSegmentBase() + `
+      </Representation>`
+	} else {
+		res += ` />`
+	}
 	return res
 }
 
@@ -387,7 +589,7 @@ func (t *Track) buildAudioManifestAdaptation() string {
 	}
 	res := `
       <SegmentTemplate
-        timescale="` + strconv.Itoa(t.timescale) + `"
+        timescale="` + strconv.Itoa(t.timescale) + `"` + t.presentationTimeOffset() + `
         initialization="init_$RepresentationID$.mp4"
         media="chunk_$RepresentationID$_$Time$.mp4"
         startNumber="1">
@@ -408,22 +610,306 @@ func (t *Track) buildAudioManifestAdaptation() string {
 	return res
 }
 
+/* Build text representation part of the manifest */
+func (t *Track) buildTextManifestRepresentation() string {
+	res := `
+      <Representation
+        id="` + t.RepresentationId() + `"
+        bandwidth="` + strconv.Itoa(t.bandwidth) + `"
+        codecs="` + t.codec + `"`
+	if t.onDemand {
+		res += `>` + t.buildOnDemandSegmentBase() + `
+      </Representation>`
+	} else {
+		res += ` />`
+	}
+	return res
+}
+
 /* Build audio representation part of the manifest */
 func (t *Track) buildAudioManifestRepresentation() string {
 	res := `
       <Representation
-        id="audio` + strconv.Itoa(t.index) + `"
+        id="` + t.RepresentationId() + `"
         bandwidth="` + strconv.Itoa(t.bandwidth) + `"
         codecs="` + t.codec + `"
-        audioSamplingRate="` + strconv.Itoa(t.sampleRate) + `">
+        audioSamplingRate="` + strconv.Itoa(t.sampleRate) + `">`
+	if t.onDemand {
+		res += t.buildOnDemandSegmentBase()
+	}
+	if t.isDolby() {
+		res += `
+        <AudioChannelConfiguration
+          schemeIdUri="tag:dolby.com,2014:dash:audio_channel_configuration:2011"
+          value="` + dolbyChannelMask(t.fourcc, t.extradata) + `">
+        </AudioChannelConfiguration>`
+	} else {
+		res += `
         <AudioChannelConfiguration
           schemeIdUri="urn:mpeg:dash:23003:3:audio_channel_configuration:2011"
-          value="2">
-        </AudioChannelConfiguration>
+          value="` + strconv.Itoa(t.channelCount()) + `">
+        </AudioChannelConfiguration>`
+	}
+	res += `
       </Representation>`
 	return res
 }
 
+/* Build HLS media playlist of the track, referencing the generated init and chunks */
+func (t *Track) BuildHLSPlaylist(isLive bool) string {
+	target := int64(0)
+	for i := 0; i < len(t.chunksDuration); i++ {
+		if t.chunksDuration[i] > target {
+			target = t.chunksDuration[i]
+		}
+	}
+	res := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:` + strconv.FormatInt((target + int64(t.timescale) - 1) / int64(t.timescale), 10) + `
+#EXT-X-MEDIA-SEQUENCE:` + strconv.Itoa(t.mediaSequence) + `
+#EXT-X-INDEPENDENT-SEGMENTS`
+	if t.trickSource != nil {
+		res += `
+#EXT-X-I-FRAMES-ONLY`
+	}
+	if !isLive {
+		res += `
+#EXT-X-PLAYLIST-TYPE:VOD`
+	}
+	if t.onDemand {
+		return res + t.buildOnDemandHLSEntries()
+	}
+	res += `
+#EXT-X-MAP:URI="init_` + t.RepresentationId() + `.mp4"`
+	/* Build each chunk entry */
+	for i := 0; i < len(t.chunksDuration) && i < len(t.chunksName); i++ {
+		res += `
+#EXTINF:` + strconv.FormatFloat(float64(t.chunksDuration[i]) / float64(t.timescale), 'f', 6, 64) + `,
+` + t.chunksName[i]
+	}
+	if !isLive {
+		res += `
+#EXT-X-ENDLIST`
+	}
+	return res + "\n"
+}
+
+/* Build HLS entries of an on-demand track as byte ranges of its single file */
+func (t *Track) buildOnDemandHLSEntries() string {
+	res := `
+#EXT-X-MAP:URI="` + t.OnDemandName() + `",BYTERANGE="` + strconv.Itoa(t.initSize) + `@0"`
+	offset := t.initSize + t.indexSize
+	for i := 0; i < len(t.chunksDuration) && i < len(t.chunksSize); i++ {
+		res += `
+#EXTINF:` + strconv.FormatFloat(float64(t.chunksDuration[i]) / float64(t.timescale), 'f', 6, 64) + `,
+#EXT-X-BYTERANGE:` + strconv.Itoa(t.chunksSize[i]) + `@` + strconv.Itoa(offset) + `
+` + t.OnDemandName()
+		offset += t.chunksSize[i]
+	}
+	return res + `
+#EXT-X-ENDLIST
+`
+}
+
+/* Convert avcC extradata to SPS and PPS with Annex B start codes */
+func avccToAnnexB(extradata []byte) []byte {
+	var res []byte
+	if len(extradata) < 6 {
+		return nil
+	}
+	offset := 6
+	count := int(extradata[5] & 0x1F)
+	/* SPS list then PPS list, each entry prefixed by its size */
+	for list := 0; list < 2; list++ {
+		for i := 0; i < count && offset + 2 <= len(extradata); i++ {
+			size := (int(extradata[offset]) << 8) | int(extradata[offset + 1])
+			offset += 2
+			if offset + size > len(extradata) {
+				return res
+			}
+			res = append(res, 0x0, 0x0, 0x0, 0x1)
+			res = append(res, extradata[offset:offset + size]...)
+			offset += size
+		}
+		if offset >= len(extradata) {
+			break
+		}
+		count = int(extradata[offset])
+		offset += 1
+	}
+	return res
+}
+
+/* Return Smooth FourCC of the track */
+func (t *Track) smoothFourCC() string {
+	if t.isDolby() {
+		return strings.ToUpper(t.fourcc)
+	} else if t.isAudio {
+		return "AACL"
+	} else if t.isHEVC() {
+		return strings.ToUpper(t.fourcc)
+	}
+	return "H264"
+}
+
+/* Return Smooth codec private data of the track : Annex B parameter sets for video, ASC for audio */
+func (t *Track) smoothCodecPrivateData() string {
+	if t.isAudio {
+		return strings.ToUpper(hex.EncodeToString(t.extradata))
+	} else if t.isHEVC() {
+		return strings.ToUpper(hex.EncodeToString(hvccToAnnexB(t.extradata)))
+	}
+	return strings.ToUpper(hex.EncodeToString(avccToAnnexB(t.extradata)))
+}
+
+/* Build Smooth QualityLevel element of the track, position is its index in the StreamIndex */
+func (t *Track) BuildSmoothQualityLevel(position int) string {
+	res := `
+    <QualityLevel
+      Index="` + strconv.Itoa(position) + `"
+      Bitrate="` + strconv.Itoa(t.bandwidth) + `"
+      FourCC="` + t.smoothFourCC() + `"
+      CodecPrivateData="` + t.smoothCodecPrivateData() + `"`
+	if t.isAudio {
+		res += `
+      SamplingRate="` + strconv.Itoa(t.sampleRate) + `"
+      Channels="` + strconv.Itoa(t.channelCount()) + `"
+      BitsPerSample="16"
+      PacketSize="4"`
+		if t.isDolby() {
+			res += `
+      AudioTag="65534"`
+		} else {
+			res += `
+      AudioTag="255"`
+		}
+	} else {
+		res += `
+      MaxWidth="` + strconv.Itoa(t.width) + `"
+      MaxHeight="` + strconv.Itoa(t.height) + `"`
+	}
+	res += `>
+      <CustomAttributes>
+        <Attribute Name="RepresentationID" Value="` + t.RepresentationId() + `" />
+      </CustomAttributes>
+    </QualityLevel>`
+	return res
+}
+
+/* Build Smooth chunk elements of the track */
+func (t *Track) BuildSmoothChunks() string {
+	res := ""
+	start := t.currentDuration
+	for i := 0; i < len(t.chunksDuration); i++ {
+		start -= t.chunksDuration[i]
+	}
+	for i, duration := range t.chunksDuration {
+		if i == 0 {
+			res += `
+    <c t="` + strconv.FormatInt(start, 10) + `" d="` + strconv.FormatInt(duration, 10) + `" />`
+		} else {
+			res += `
+    <c d="` + strconv.FormatInt(duration, 10) + `" />`
+		}
+	}
+	return res
+}
+
+/* Return number of chunks referenced in manifests */
+func (t *Track) ChunksCount() int {
+	return len(t.chunksDuration)
+}
+
+/* Return track timescale */
+func (t *Track) Timescale() int {
+	return t.timescale
+}
+
+/* Return duration of chunks referenced in manifests, in seconds */
+func (t *Track) WindowDuration() float64 {
+	duration := int64(0)
+	for i := 0; i < len(t.chunksDuration); i++ {
+		duration += t.chunksDuration[i]
+	}
+	return float64(duration) / float64(t.timescale)
+}
+
+/* Return base64 PlayReady object used as Smooth protection header, empty if not encrypted with PlayReady */
+func (t *Track) SmoothProtectionHeader() string {
+	if t.encryptInfos == nil {
+		return ""
+	}
+	for i := 0; i < len(t.encryptInfos.pssList); i++ {
+		if strings.ToUpper(t.encryptInfos.pssList[i].systemId) == "9A04F07998404286AB92E65BE0885F95" {
+			return base64.StdEncoding.EncodeToString(t.encryptInfos.pssList[i].privateData)
+		}
+	}
+	return ""
+}
+
+/* Format an hexadecimal identifier of 16 bytes as an UUID */
+func formatUUID(id string) string {
+	id = strings.ToLower(id)
+	if len(id) != 32 {
+		return id
+	}
+	return id[0:8] + "-" + id[8:12] + "-" + id[12:16] + "-" + id[16:20] + "-" + id[20:32]
+}
+
+/*
+ Build ContentProtection descriptors of an adaptation set : the Common Encryption
+ one with the default key id, then one per DRM system with its pssh atom.
+ */
+func (t *Track) BuildContentProtection() string {
+	if t.encryptInfos == nil {
+		return ""
+	}
+	scheme := t.encryptInfos.scheme
+	if scheme == "" {
+		scheme = ENCRYPTION_SCHEME_CENC
+	}
+	res := `
+      <ContentProtection
+        schemeIdUri="urn:mpeg:dash:mp4protection:2011"
+        value="` + scheme + `"
+        cenc:default_KID="` + formatUUID(t.encryptInfos.keyId) + `" />`
+	for i := 0; i < len(t.encryptInfos.pssList); i++ {
+		systemId := strings.ToUpper(t.encryptInfos.pssList[i].systemId)
+		pssh, err := buildPSSH(t.encryptInfos.pssList[i])
+		if err != nil {
+			continue
+		}
+		res += `
+      <ContentProtection
+        schemeIdUri="urn:uuid:` + formatUUID(systemId) + `"`
+		if systemId == "9A04F07998404286AB92E65BE0885F95" {
+			res += `
+        value="MSPR 2.0">
+        <cenc:pssh>` + base64.StdEncoding.EncodeToString(pssh) + `</cenc:pssh>
+        <mspr:pro>` + base64.StdEncoding.EncodeToString(t.encryptInfos.pssList[i].privateData) + `</mspr:pro>`
+		} else if systemId == CLEARKEY_SYSTEM_ID {
+			res += `
+        value="ClearKey1.0">
+        <cenc:pssh>` + base64.StdEncoding.EncodeToString(pssh) + `</cenc:pssh>`
+			if t.encryptInfos.licenseUrl != "" {
+				res += `
+        <clearkey:Laurl Lic_type="EME-1.0">` + utils.XMLEscape(t.encryptInfos.licenseUrl) + `</clearkey:Laurl>
+        <dashif:laurl>` + utils.XMLEscape(t.encryptInfos.licenseUrl) + `</dashif:laurl>`
+			}
+		} else if systemId == "EDEF8BA979D64ACEA3C827DCD51D21ED" {
+			res += `
+        value="Widevine">
+        <cenc:pssh>` + base64.StdEncoding.EncodeToString(pssh) + `</cenc:pssh>`
+		} else {
+			res += `>
+        <cenc:pssh>` + base64.StdEncoding.EncodeToString(pssh) + `</cenc:pssh>`
+		}
+		res += `
+      </ContentProtection>`
+	}
+	return res
+}
+
 /* Compute bandwidth for a track */
 func (t *Track) computeBandwidth() {
 	if t.bandwidth > 0 {
@@ -448,19 +934,165 @@ func (t *Track) computeBandwidth() {
 	}
 }
 
+/* Return audio sample entry name, AAC if not set by demuxer */
+func (t *Track) audioFourCC() string {
+	if t.fourcc == "" {
+		return "mp4a"
+	}
+	return t.fourcc
+}
+
+/* Return if the track is Dolby AC-3 or E-AC-3 audio */
+func (t *Track) isDolby() bool {
+	return t.isAudio && (t.fourcc == "ac-3" || t.fourcc == "ec-3")
+}
+
+/* Return number of audio channels (LFE included), stereo if unknown */
+func (t *Track) channelCount() int {
+	if t.channels <= 0 {
+		return 2
+	}
+	return t.channels
+}
+
+/* Return parsed AudioSpecificConfig of an AAC track, nil if not available */
+func (t *Track) audioConfig() *aacConfig {
+	if !t.isAudio || t.isDolby() {
+		return nil
+	}
+	config, err := parseAudioSpecificConfig(t.extradata)
+	if err != nil {
+		return nil
+	}
+	return config
+}
+
+/* Return parsed SPS of a H.264 track, nil if not available */
+func (t *Track) h264SPS() *h264SPSInfos {
+	if t.isAudio || t.isText || t.isHEVC() {
+		return nil
+	}
+	nal := avccSPS(t.extradata)
+	/* Parameter sets of MPEG-TS sources are in Annex B format */
+	if isAnnexB(t.extradata) {
+		for _, unit := range splitAnnexB(t.extradata) {
+			if len(unit) > 0 && unit[0] & 0x1F == 7 {
+				nal = unit
+				break
+			}
+		}
+	}
+	sps, err := parseH264SPS(nal)
+	if err != nil {
+		return nil
+	}
+	return sps
+}
+
+/* Fill size, aspect ratio, frame rate, sample rate and channels from codec parameters */
+func (t *Track) applyCodecParameters() {
+	if config := t.audioConfig(); config != nil {
+		if config.outputSampleRate > 0 {
+			t.sampleRate = config.outputSampleRate
+		}
+		/* Channels of configuration 0 are declared in a program config element */
+		if config.channels > 0 {
+			t.channels = config.channels
+		}
+	} else if sps := t.h264SPS(); sps != nil {
+		t.width = sps.width
+		t.height = sps.height
+		t.sarNum = sps.sarNum
+		t.sarDen = sps.sarDen
+		t.frameRateNum = sps.frameRateNum
+		t.frameRateDen = sps.frameRateDen
+	}
+}
+
+/* Return sample aspect ratio (ex: 1:1), empty if unknown */
+func (t *Track) SampleAspectRatio() string {
+	if t.sarNum <= 0 || t.sarDen <= 0 {
+		return ""
+	}
+	return strconv.Itoa(t.sarNum) + ":" + strconv.Itoa(t.sarDen)
+}
+
+/* Return picture aspect ratio (ex: 16:9), empty if unknown */
+func (t *Track) PictureAspectRatio() string {
+	if t.width <= 0 || t.height <= 0 {
+		return ""
+	}
+	sarNum, sarDen := t.sarNum, t.sarDen
+	if sarNum <= 0 || sarDen <= 0 {
+		sarNum, sarDen = 1, 1
+	}
+	num, den := reduceRatio(t.width * sarNum, t.height * sarDen)
+	return strconv.Itoa(num) + ":" + strconv.Itoa(den)
+}
+
+/* Return frame rate as used in DASH manifests (ex: 25 or 30000/1001), empty if unknown */
+func (t *Track) FrameRate() string {
+	if t.frameRateNum <= 0 || t.frameRateDen <= 0 {
+		return ""
+	} else if t.frameRateDen == 1 {
+		return strconv.Itoa(t.frameRateNum)
+	}
+	return strconv.Itoa(t.frameRateNum) + "/" + strconv.Itoa(t.frameRateDen)
+}
+
+/* Return display width, taking sample aspect ratio into account */
+func (t *Track) displayWidth() int {
+	if t.sarNum <= 0 || t.sarDen <= 0 {
+		return t.width
+	}
+	return t.width * t.sarNum / t.sarDen
+}
+
 /* Compute codec name from extradata for audio */
 func (t *Track) extractAudioCodec() {
-	t.codec = "mp4a.40.2"
+	if t.isDolby() {
+		t.codec = t.fourcc
+		return
+	}
+	/* Audio object type : 2 for AAC LC, 5 for HE-AAC, 29 for HE-AACv2 */
+	if config := t.audioConfig(); config != nil && config.objectType > 0 {
+		t.codec = "mp4a.40." + strconv.Itoa(config.objectType)
+	} else {
+		t.codec = "mp4a.40.2"
+	}
+}
+
+/* Return video sample entry name, AVC if not set by demuxer */
+func (t *Track) videoFourCC() string {
+	if t.fourcc == "" {
+		return "avc1"
+	}
+	return t.fourcc
+}
+
+/* Return if the track is HEVC video */
+func (t *Track) isHEVC() bool {
+	return !t.isAudio && (t.fourcc == "hvc1" || t.fourcc == "hev1")
 }
 
 /* Compute codec name from extradata for video */
 func (t *Track) extractVideoCodec() {
+	if t.isHEVC() {
+		t.codec = hevcCodecString(t.fourcc, t.extradata)
+		return
+	}
 	t.codec = "avc1." + strings.ToUpper(hex.EncodeToString(t.extradata[1:2]) + hex.EncodeToString(t.extradata[2:3]) + hex.EncodeToString(t.extradata[3:4]))
 }
 
 /* Compute codec name from extradata */
 func (t *Track) extractCodec() {
-	if t.isAudio {
+	if t.isText {
+		if t.fourcc == TEXT_FORMAT_STPP {
+			t.codec = "stpp.ttml.im1t"
+		} else {
+			t.codec = TEXT_FORMAT_WVTT
+		}
+	} else if t.isAudio {
 		t.extractAudioCodec()
 	} else {
 		t.extractVideoCodec()
@@ -475,7 +1107,10 @@ func (t *Track) ComputePrivateInfos() {
 
 /* Build track adaptation part of the manifest */
 func (t *Track) BuildAdaptationSet() string {
-	if t.isAudio {
+	/* On-demand representations carry their own segment base */
+	if t.onDemand {
+		return ""
+	} else if t.isAudio {
 		return t.buildAudioManifestAdaptation()
 	} else {
 		return t.buildVideoManifestAdaptation()
@@ -484,7 +1119,9 @@ func (t *Track) BuildAdaptationSet() string {
 
 /* Build track representation part of the manifest */
 func (t *Track) BuildRepresentation() string {
-	if t.isAudio {
+	if t.isText {
+		return t.buildTextManifestRepresentation()
+	} else if t.isAudio {
 		return t.buildAudioManifestRepresentation()
 	} else {
 		return t.buildVideoManifestRepresentation()
@@ -535,22 +1172,86 @@ func (t *Track) Clean() {
 
 /* Partially clean internal list in order to generate an up to date manifest */
 func (t *Track) CleanForLive() {
-	if len(t.chunksDuration) > t.chunksDepth {
-		t.chunksDuration = t.chunksDuration[len(t.chunksDuration) - (t.chunksDepth + 1):]
+	/* Keep the last chunks, as few as possible to cover the window */
+	window := int64(t.liveWindow * float64(t.timescale))
+	duration := int64(0)
+	for i := 0; i < len(t.chunksDuration); i++ {
+		duration += t.chunksDuration[i]
+	}
+	keep := len(t.chunksDuration)
+	for keep > 1 && duration - t.chunksDuration[len(t.chunksDuration) - keep] >= window {
+		duration -= t.chunksDuration[len(t.chunksDuration) - keep]
+		keep--
+	}
+	t.recordWindowChunks(keep)
+	if len(t.chunksDuration) > keep {
+		t.mediaSequence += len(t.chunksDuration) - keep
+		t.chunksDuration = t.chunksDuration[len(t.chunksDuration) - keep:]
 	}
-	if len(t.chunksSize) > t.chunksDepth {
-		t.chunksSize = t.chunksSize[len(t.chunksSize) - (t.chunksDepth + 1):]
+	if len(t.chunksSize) > keep {
+		t.chunksSize = t.chunksSize[len(t.chunksSize) - keep:]
 	}
-	if len(t.chunksName) > t.chunksDepth {
-		t.chunksName = t.chunksName[len(t.chunksName) - (t.chunksDepth + 1):]
+	if len(t.chunksName) > keep {
+		t.chunksName = t.chunksName[len(t.chunksName) - keep:]
 	}
 }
 
+/* Set duration in seconds of the chunks kept in live manifests */
+func (t *Track) SetLiveWindow(seconds float64) {
+	if seconds > 0 {
+		t.liveWindow = seconds
+	}
+}
+
+/* Return start time and duration of the samples waiting to be packaged, if any */
+func (t *Track) ChunkSpan() (int64, int64, bool) {
+	if len(t.samples) <= 0 {
+		return 0, 0, false
+	}
+	return t.samples[0].pts, t.computeChunkDuration(), true
+}
+
 /* Return if the track is audio or not */
 func (t *Track) IsAudio() bool {
 	return t.isAudio
 }
 
+/* Return track role (main, alternate, description...), empty if unknown */
+func (t *Track) Role() string {
+	return t.role
+}
+
+/* Return track label, empty if unknown */
+func (t *Track) Label() string {
+	return t.label
+}
+
+/* Return track description, codec and bandwidth are set by ComputePrivateInfos */
+func (t *Track) Describe() TrackDescription {
+	return TrackDescription{
+		Id: t.RepresentationId(),
+		Type: t.typeName(),
+		Codec: t.codec,
+		Bandwidth: t.bandwidth,
+		Language: t.language,
+		Role: t.role,
+		Label: t.label,
+	}
+}
+
+/* Return track representation id, also used in chunk file names */
+func (t *Track) RepresentationId() string {
+	if t.rendition != "" {
+		return t.typeName() + strconv.Itoa(t.index) + "_" + t.rendition
+	}
+	return t.typeName() + strconv.Itoa(t.index)
+}
+
+/* Return track codec name, computed by ComputePrivateInfos */
+func (t *Track) Codec() string {
+	return t.codec
+}
+
 /* Return track bandwidth */
 func (t *Track) Bandwidth() int {
 	return t.bandwidth
@@ -566,35 +1267,18 @@ func (t *Track) Height() int {
 	return t.height
 }
 
-/* Compute track buffer depth */
-func (t *Track) BufferDepth() float64 {
-	duration := int64(0)
-	for i := 0; i < len(t.chunksDuration); i++ {
-		if t.chunksDuration[i] > duration {
-			duration = t.chunksDuration[i]
-		}
-	}
-	return float64(duration) / float64(len(t.chunksDuration))
-}
-
 /* Clean track directory for unreferenced file in manifest */
 func (t *Track) CleanDirectory(path string) {
-	var name string
-	if t.isAudio {
-		name = "audio"
-	} else {
-		name = "video"
-	}
 	files, _ := ioutil.ReadDir(path)
 	for _, fi := range files {
-		if strings.Contains(fi.Name(), "chunk_" + name + strconv.Itoa(t.index)) {
+		if strings.Contains(fi.Name(), "chunk_" + t.RepresentationId() + "_") {
 			i := 0
 			for ; i < len(t.chunksName); i++ {
 				if fi.Name() == t.chunksName[i] {
 					break
 				}
 			}
-			if i == len(t.chunksName) {
+			if i == len(t.chunksName) && !t.isRecordedChunk(fi.Name()) {
 				os.Remove(filepath.Join(path, fi.Name()))
 			}
 		}
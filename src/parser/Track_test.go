@@ -0,0 +1,66 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+  "strings"
+  "encoding/hex"
+  "testing"
+)
+
+func TestHLSMediaPlaylist(t *testing.T) {
+  track := Track{
+    timescale: 1000,
+    chunksDuration: []int64{2000, 1500},
+    chunksName: []string{"chunk_0.mp4", "chunk_2000.mp4"},
+  }
+  want := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-MAP:URI="init_video0.mp4"
+#EXTINF:2.000000,
+chunk_0.mp4
+#EXTINF:1.500000,
+chunk_2000.mp4
+#EXT-X-ENDLIST
+`
+  if got := track.BuildHLSPlaylist(false); got != want {
+    t.Errorf("bad VOD media playlist. want\n%s\ngot\n%s", want, got)
+  }
+  /* Live playlists start at the first chunk of the window and have no end */
+  track.mediaSequence = 5
+  got := track.BuildHLSPlaylist(true)
+  if !strings.Contains(got, "#EXT-X-MEDIA-SEQUENCE:5\n") || strings.Contains(got, "#EXT-X-PLAYLIST-TYPE") || strings.Contains(got, "#EXT-X-ENDLIST") {
+    t.Errorf("bad live media playlist. got\n%s", got)
+  }
+}
+
+func TestAVCCToAnnexB(t *testing.T) {
+  extradata := []byte{
+    0x1, 0x64, 0x0, 0x1F, 0xFF, 0xE1,
+    0x0, 0x2, 0x67, 0x64,
+    0x1,
+    0x0, 0x3, 0x68, 0xEB, 0xE3,
+  }
+  want := "00000001676400000001" + "68EBE3"
+
+  got := strings.ToUpper(hex.EncodeToString(avccToAnnexB(extradata)))
+  if got != want {
+    t.Errorf("bad annex b conversion. want %q, got %q", want, got)
+  }
+}
@@ -0,0 +1,339 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"errors"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+/* Frame rate given to video encoders when the source one is unknown */
+const TRANSCODE_DEFAULT_FRAME_RATE = 25
+
+/* One video rendition of a ladder, bitrate is in kbit/s */
+type Rendition struct {
+	Height  int
+	Bitrate int
+}
+
+/* Packet produced by an encoder, video data may be in Annex B format */
+type encodedPacket struct {
+	data     []byte
+	keyFrame bool
+}
+
+/* Track encoded from the decoded frames of a source track */
+type renditionOutput struct {
+	track      *Track
+	encoder    *streamEncoder
+	pending    []int64
+	frames     int64
+	audioStart int64
+}
+
+/* Structure used to decode a source track once and encode it in each of its renditions */
+type Transcoder struct {
+	source  *Track
+	decoder *streamDecoder
+	outputs []*renditionOutput
+	eof     bool
+}
+
+/* Parse a ladder : comma separated <height>:<bitrate in kbit/s> (ex: 1080:5000,720p:3000k) */
+func ParseLadder(ladder string) ([]Rendition, error) {
+	var res []Rendition
+	for _, entry := range strings.Split(ladder, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		fields := strings.Split(entry, ":")
+		if len(fields) != 2 {
+			return nil, errors.New("Invalid ladder rendition '" + entry + "'")
+		}
+		height, err := strconv.Atoi(strings.TrimSuffix(fields[0], "p"))
+		if err != nil || height <= 0 || height % 2 != 0 {
+			return nil, errors.New("Invalid ladder height '" + fields[0] + "'")
+		}
+		bitrate, err := strconv.Atoi(strings.TrimSuffix(fields[1], "k"))
+		if err != nil || bitrate <= 0 {
+			return nil, errors.New("Invalid ladder bitrate '" + fields[1] + "'")
+		}
+		res = append(res, Rendition{height, bitrate})
+	}
+	return res, nil
+}
+
+/* Create a track holding the samples encoded from a track */
+func (t *Track) newRenditionTrack(name string, extradata []byte) *Track {
+	rendition := new(Track)
+	*rendition = *t
+	rendition.samples = nil
+	rendition.cues = nil
+	rendition.bandwidth = 0
+	rendition.fourcc = ""
+	rendition.encryptInfos = nil
+	rendition.extradata = extradata
+	rendition.transcodeSource = t
+	rendition.rendition = name
+	return rendition
+}
+
+/* Return if the track is encoded from another track */
+func (t *Track) IsRendition() bool {
+	return t.transcodeSource != nil
+}
+
+/* Add a H.264 rendition, its width keeps the display aspect ratio of the source */
+func (tr *Transcoder) addVideoOutput(r Rendition) error {
+	source := tr.source
+	width := (source.displayWidth() * r.Height / source.height + 1) &^ 1
+	fpsNum, fpsDen := source.frameRateNum, source.frameRateDen
+	if fpsNum <= 0 || fpsDen <= 0 {
+		fpsNum, fpsDen = TRANSCODE_DEFAULT_FRAME_RATE, 1
+	}
+	encoder, err := openVideoEncoder(width, r.Height, r.Bitrate * 1000, fpsNum, fpsDen)
+	if err != nil { return err }
+	extradata := encoder.extradata()
+	if isAnnexB(extradata) {
+		extradata, err = h264AnnexBToAVCC(extradata)
+		if err != nil {
+			encoder.close()
+			return err
+		}
+	}
+	track := source.newRenditionTrack(strconv.Itoa(r.Height) + "p", extradata)
+	track.width = width
+	track.height = r.Height
+	track.sarNum, track.sarDen = 1, 1
+	tr.outputs = append(tr.outputs, &renditionOutput{track: track, encoder: encoder})
+	return nil
+}
+
+/* Add an AAC rendition, bitrate is in kbit/s */
+func (tr *Transcoder) addAudioOutput(bitrate int) error {
+	source := tr.source
+	encoder, err := openAudioEncoder(source.sampleRate, source.channelCount(), bitrate * 1000)
+	if err != nil { return err }
+	track := source.newRenditionTrack(strconv.Itoa(bitrate) + "k", encoder.extradata())
+	track.channels = source.channelCount()
+	tr.outputs = append(tr.outputs, &renditionOutput{track: track, encoder: encoder})
+	return nil
+}
+
+/* Create transcoding of a track, nil if no rendition applies to it */
+func newTranscoder(source *Track, ladder []Rendition, audioBitrate int) (*Transcoder, error) {
+	source.applyCodecParameters()
+	decoder, err := openStreamDecoder(source)
+	if err != nil { return nil, err }
+	tr := &Transcoder{source: source, decoder: decoder}
+	if source.isAudio {
+		err = tr.addAudioOutput(audioBitrate)
+	} else {
+		for _, r := range ladder {
+			/* Renditions are never upscaled */
+			if r.Height > source.height {
+				continue
+			}
+			err = tr.addVideoOutput(r)
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err != nil || len(tr.outputs) == 0 {
+		tr.Close()
+		return nil, err
+	}
+	return tr, nil
+}
+
+/*
+ Create transcoding of the video tracks in each rendition of the ladder and of the
+ audio tracks in AAC (audioBitrate in kbit/s, 0 to keep only the source audio).
+ Encrypted tracks are left untouched.
+ */
+func NewTranscoders(tracks []*Track, ladder []Rendition, audioBitrate int) ([]*Transcoder, error) {
+	var res []*Transcoder
+	for _, t := range tracks {
+		if t.isText || t.trickSource != nil || t.transcodeSource != nil || t.sourceEncrypted() {
+			continue
+		}
+		if (t.isAudio && audioBitrate <= 0) || (!t.isAudio && len(ladder) == 0) {
+			continue
+		}
+		tr, err := newTranscoder(t, ladder, audioBitrate)
+		if err != nil {
+			for _, r := range res {
+				r.Close()
+			}
+			return nil, err
+		}
+		if tr != nil {
+			res = append(res, tr)
+		}
+	}
+	return res, nil
+}
+
+/* Return tracks of the renditions */
+func (tr *Transcoder) Tracks() []*Track {
+	var res []*Track
+	for _, out := range tr.outputs {
+		res = append(res, out.track)
+	}
+	return res
+}
+
+/* Append encoded packets as samples, video packets take the time of their source frame */
+func (out *renditionOutput) appendPackets(packets []encodedPacket) {
+	for _, p := range packets {
+		data := p.data
+		sample := new(Sample)
+		sample.keyFrame = p.keyFrame
+		if !out.track.isAudio {
+			/* Without B frames, packets are produced in the order of the frames */
+			if len(out.pending) > 0 {
+				sample.pts = out.pending[0]
+				out.pending = out.pending[1:]
+			}
+			if isAnnexB(data) {
+				data = annexBToLengthPrefixed(data)
+			}
+		}
+		sample.dts = sample.pts
+		sample.data = CArray(data)
+		sample.size = CInt(len(data))
+		runtime.SetFinalizer(sample, allocatedSampleFinalizer)
+		out.track.appendSample(sample)
+	}
+}
+
+/*
+ Audio packets follow each other from the start of the first source chunk, each
+ one lasting frameSize samples (1024 for AAC) whatever the chunk boundaries.
+ */
+func (out *renditionOutput) setAudioTimes(start int64, frameSize int64) {
+	t := out.track
+	if out.frames == 0 {
+		out.audioStart = start
+	}
+	for _, s := range t.samples {
+		s.pts = out.audioStart + out.frames * frameSize * int64(t.timescale) / int64(t.sampleRate)
+		s.dts = s.pts
+		out.frames++
+		s.duration = out.audioStart + out.frames * frameSize * int64(t.timescale) / int64(t.sampleRate) - s.pts
+	}
+}
+
+/*
+ Set durations of the video samples of a chunk so that it ends with the source one.
+ Samples past the end keep the duration of the previous one.
+ */
+func fitSamplesToChunk(samples []*Sample, end int64) {
+	for i, s := range samples {
+		next := end
+		if i + 1 < len(samples) {
+			next = samples[i + 1].pts
+		}
+		s.duration = next - s.pts
+		if s.duration <= 0 && i > 0 {
+			s.duration = samples[i - 1].duration
+		} else if s.duration <= 0 {
+			s.duration = 1
+		}
+	}
+}
+
+/* Encode the frame available in the decoder in every rendition */
+func (tr *Transcoder) encode(key bool) error {
+	for _, out := range tr.outputs {
+		var packets []encodedPacket
+		var err error
+		if tr.source.isAudio {
+			packets, err = out.encoder.encodeAudio(tr.decoder, false)
+		} else {
+			out.pending = append(out.pending, tr.decoder.framePts())
+			packets, err = out.encoder.encodeVideo(tr.decoder, out.frames, key)
+			out.frames++
+		}
+		if err != nil { return err }
+		out.appendPackets(packets)
+	}
+	return nil
+}
+
+/* Mark the samples waiting to be packaged as the last ones, encoders are drained on next update */
+func (tr *Transcoder) EndOfStream() {
+	tr.eof = true
+}
+
+/*
+ Decode the source samples waiting to be packaged and encode them in every
+ rendition. Must be called before the source chunk is built. Video chunks start
+ with a key frame : they are decoded independently and the first frame of each
+ one is encoded as a key frame, so that chunks of all renditions are aligned.
+ */
+func (tr *Transcoder) Update() error {
+	start, duration, ok := tr.source.ChunkSpan()
+	if !ok {
+		return nil
+	}
+	key := true
+	for _, s := range tr.source.samples {
+		/* Samples that can't be decoded are skipped */
+		if !tr.decoder.decode(s) {
+			continue
+		}
+		err := tr.encode(key)
+		if err != nil { return err }
+		key = false
+	}
+	if !tr.source.isAudio {
+		for tr.decoder.decode(nil) {
+			err := tr.encode(key)
+			if err != nil { return err }
+			key = false
+		}
+		tr.decoder.flush()
+	}
+	for _, out := range tr.outputs {
+		var packets []encodedPacket
+		var err error
+		if !tr.source.isAudio {
+			packets, err = out.encoder.encodeVideo(nil, 0, false)
+		} else if tr.eof {
+			packets, err = out.encoder.encodeAudio(nil, true)
+		}
+		if err != nil { return err }
+		out.appendPackets(packets)
+		if tr.source.isAudio {
+			out.setAudioTimes(start, int64(out.encoder.frameSize()))
+		} else {
+			fitSamplesToChunk(out.track.samples, start + duration)
+		}
+	}
+	return nil
+}
+
+/* Release decoder and encoders */
+func (tr *Transcoder) Close() {
+	tr.decoder.close()
+	for _, out := range tr.outputs {
+		out.encoder.close()
+	}
+}
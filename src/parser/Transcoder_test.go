@@ -0,0 +1,91 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+  "encoding/hex"
+  "testing"
+)
+
+func TestParseLadder(t *testing.T) {
+  ladder, err := ParseLadder("1080:5000, 720p:3000k,480:1200")
+  if err != nil {
+    t.Fatalf("can't parse ladder: %v", err)
+  }
+  if len(ladder) != 3 || ladder[1].Height != 720 || ladder[1].Bitrate != 3000 {
+    t.Errorf("bad ladder. got %v", ladder)
+  }
+  for _, invalid := range []string{"720", "721:3000", "720:fast"} {
+    if _, err := ParseLadder(invalid); err == nil {
+      t.Errorf("ladder %q should be rejected", invalid)
+    }
+  }
+}
+
+func TestRenditionSamples(t *testing.T) {
+  sps := []byte{
+    0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78, 0x02, 0x27, 0xe5, 0xff, 0xc0,
+    0x01, 0x00, 0x00, 0xc4, 0x00, 0x00, 0x0f, 0xa4, 0x00, 0x03, 0xa9, 0x83,
+  }
+  pps := []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0}
+  headers := append(append([]byte{0x0, 0x0, 0x0, 0x1}, sps...), append([]byte{0x0, 0x0, 0x1}, pps...)...)
+  avcc, err := h264AnnexBToAVCC(headers)
+  if err != nil {
+    t.Fatalf("can't build avcC: %v", err)
+  }
+  track := Track{extradata: avcc}
+  track.applyCodecParameters()
+  if track.width != 1920 || track.height != 1080 {
+    t.Errorf("bad size from avcC. want 1920x1080, got %dx%d", track.width, track.height)
+  }
+  if got := hex.EncodeToString(avccToAnnexB(avcc)); got != hex.EncodeToString(append(append([]byte{0x0, 0x0, 0x0, 0x1}, sps...), append([]byte{0x0, 0x0, 0x0, 0x1}, pps...)...)) {
+    t.Errorf("bad parameter sets in avcC. got %s", got)
+  }
+  if got := hex.EncodeToString(annexBToLengthPrefixed([]byte{0x0, 0x0, 0x1, 0x65, 0x88, 0x0, 0x0, 0x1, 0x6, 0x5})); got != "000000026588000000020605" {
+    t.Errorf("bad length prefixed sample. got %s", got)
+  }
+
+  /* Chunk [0, 100[ : last sample ends with the chunk */
+  samples := []*Sample{&Sample{pts: 0}, &Sample{pts: 40}, &Sample{pts: 80}}
+  fitSamplesToChunk(samples, 100)
+  for i, want := range []int64{40, 40, 20} {
+    if samples[i].duration != want {
+      t.Errorf("bad sample %d duration. want %d, got %d", i, want, samples[i].duration)
+    }
+  }
+  /* Sample past the end keeps the previous duration */
+  samples = []*Sample{&Sample{pts: 0}, &Sample{pts: 60}, &Sample{pts: 120}}
+  fitSamplesToChunk(samples, 100)
+  if samples[2].duration != 60 {
+    t.Errorf("bad last sample duration. want 60, got %d", samples[2].duration)
+  }
+
+  /* AAC frames keep their duration across chunks, 1024 samples at 44.1 kHz in a 90 kHz timescale */
+  out := renditionOutput{track: &Track{timescale: 90000, sampleRate: 44100}}
+  end := int64(180000)
+  for chunk, start := range []int64{180000, 360000} {
+    out.track.samples = []*Sample{&Sample{}, &Sample{}, &Sample{}}
+    out.setAudioTimes(start, 1024)
+    for i, s := range out.track.samples {
+      if s.pts != end || (s.duration != 2089 && s.duration != 2090) {
+        t.Errorf("bad AAC sample %d of chunk %d. got pts %d duration %d", i, chunk, s.pts, s.duration)
+      }
+      end = s.pts + s.duration
+    }
+  }
+  if end != 180000 + 6 * 1024 * 90000 / 44100 {
+    t.Errorf("bad AAC end time. got %d", end)
+  }
+}
@@ -0,0 +1,105 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"runtime"
+)
+
+/* Called by GC to free data of samples allocated with CArray */
+func allocatedSampleFinalizer(s *Sample) {
+	CFree(s.data)
+}
+
+/* Append a copy of a sample with another duration, data is not shared with the source */
+func (t *Track) appendSampleCopy(source *Sample, duration int64) {
+	sample := new(Sample)
+	sample.pts = source.pts
+	sample.dts = source.dts
+	sample.duration = duration
+	sample.keyFrame = source.keyFrame
+	sample.encrypt = source.encrypt
+	sample.data = CArray(source.GetData())
+	sample.size = source.size
+	runtime.SetFinalizer(sample, allocatedSampleFinalizer)
+	t.appendSample(sample)
+}
+
+/* Create a keyframe only track from a video track, its samples are taken from the source */
+func (t *Track) NewTrickModeTrack() *Track {
+	if t.isAudio || t.isText || t.trickSource != nil {
+		return nil
+	}
+	trick := new(Track)
+	*trick = *t
+	trick.samples = nil
+	trick.cues = nil
+	trick.trickSource = t
+	return trick
+}
+
+/* Return if the track is a trick mode track */
+func (t *Track) IsTrickMode() bool {
+	return t.trickSource != nil
+}
+
+/*
+ Copy key frames of the source samples waiting to be packaged. Each key frame lasts
+ until the next one so that chunks keep the duration of the source ones.
+ */
+func (t *Track) BuildTrickModeSamples() {
+	frames, keyFrames := t.copyKeyFrames()
+	t.trickFrames += frames
+	t.trickKeyFrames += keyFrames
+}
+
+/* Copy key frames of the source samples, return the number of frames and key frames */
+func (t *Track) copyKeyFrames() (int, int) {
+	var keyFrames []int
+	samples := t.trickSource.samples
+	for i := 0; i < len(samples); i++ {
+		if samples[i].keyFrame {
+			keyFrames = append(keyFrames, i)
+		}
+	}
+	for k, first := range keyFrames {
+		last := len(samples)
+		if k + 1 < len(keyFrames) {
+			last = keyFrames[k + 1]
+		}
+		/* First key frame also covers samples preceding it */
+		if k == 0 {
+			first = 0
+		}
+		duration := int64(0)
+		for i := first; i < last; i++ {
+			duration += samples[i].duration
+		}
+		t.appendSampleCopy(samples[keyFrames[k]], duration)
+	}
+	return len(samples), len(keyFrames)
+}
+
+/* Return maximum playout rate of a trick mode track : average number of frames per key frame */
+func (t *Track) maxPlayoutRate() int {
+	if t.trickKeyFrames <= 0 {
+		return 1
+	}
+	rate := (t.trickFrames + t.trickKeyFrames / 2) / t.trickKeyFrames
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
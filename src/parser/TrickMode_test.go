@@ -0,0 +1,56 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+  "strings"
+  "testing"
+)
+
+func TestTrickModeSamples(t *testing.T) {
+  source := Track{index: 0, width: 1280, height: 720}
+  keyFrames := []bool{false, true, false, false, true, false}
+  for i, key := range keyFrames {
+    source.appendSample(&Sample{pts: int64(i * 10), dts: int64(i * 10), duration: 10, keyFrame: key})
+  }
+  trick := source.NewTrickModeTrack()
+  if trick == nil || trick.RepresentationId() != "trick0" {
+    t.Fatalf("bad trick mode track")
+  }
+
+  trick.BuildTrickModeSamples()
+  if len(trick.samples) != 2 {
+    t.Fatalf("bad sample count. want 2, got %d", len(trick.samples))
+  }
+  /* First key frame covers the samples preceding it */
+  if trick.samples[0].pts != 10 || trick.samples[0].duration != 40 {
+    t.Errorf("bad first sample. want 10/40, got %d/%d", trick.samples[0].pts, trick.samples[0].duration)
+  }
+  if trick.samples[1].pts != 40 || trick.samples[1].duration != 20 {
+    t.Errorf("bad second sample. want 40/20, got %d/%d", trick.samples[1].pts, trick.samples[1].duration)
+  }
+  if trick.maxPlayoutRate() != 3 {
+    t.Errorf("bad max playout rate. want 3, got %d", trick.maxPlayoutRate())
+  }
+  /* Key frames are not played at the source frame rate */
+  source.frameRateNum, source.frameRateDen = 25, 1
+  trick.frameRateNum, trick.frameRateDen = 25, 1
+  if !strings.Contains(source.buildVideoManifestRepresentation(), `frameRate="25"`) {
+    t.Errorf("source representation should have a frame rate")
+  }
+  if representation := trick.buildVideoManifestRepresentation(); strings.Contains(representation, "frameRate") {
+    t.Errorf("trick mode representation should not have a frame rate:\n%s", representation)
+  }
+}
@@ -15,10 +15,14 @@
 package parser
 
 /*
-#cgo LDFLAGS: -lavformat -lavutil -lavcodec
+#cgo LDFLAGS: -lavformat -lavutil -lavcodec -lswscale
 #include <libavformat/avformat.h>
 #include <libavutil/opt.h>
+#include <libavutil/time.h>
 #include <libavcodec/avcodec.h>
+#include <libavutil/channel_layout.h>
+#include <libavutil/audio_fifo.h>
+#include <libswscale/swscale.h>
 #include <string.h>
 #include <stdlib.h>
 
@@ -29,6 +33,26 @@ AVStream* get_stream(AVStream **streams, int pos)
   return streams[pos];
 }
 
+typedef struct {
+  int64_t deadline;
+} read_deadline;
+
+int read_interrupt(void *opaque)
+{
+  read_deadline *d = opaque;
+  return d->deadline > 0 && av_gettime() > d->deadline;
+}
+
+AVFormatContext *alloc_interruptible_context(read_deadline *d)
+{
+  AVFormatContext *ctx = avformat_alloc_context();
+  if (ctx) {
+    ctx->interrupt_callback.callback = read_interrupt;
+    ctx->interrupt_callback.opaque = d;
+  }
+  return ctx;
+}
+
 int64_t rescale_to_generic_timebase(int64_t val, AVRational timebase)
 {
   return av_rescale_q(val, timebase, TIMEBASE_Q);
@@ -48,6 +72,257 @@ int64_t rescale_to_timebase(int64_t val, int in_tb, int out_tb)
   return av_rescale_q(val, in_r, out_r);
 }
 
+int64_t rescale_from_generic_timebase(int64_t val, AVRational timebase)
+{
+  return av_rescale_q(val, TIMEBASE_Q, timebase);
+}
+
+int64_t packet_timestamp(AVPacket *pkt)
+{
+  if (pkt->dts != AV_NOPTS_VALUE)
+    return pkt->dts;
+  return pkt->pts;
+}
+
+AVCodecContext *open_decoder(int codec_id, void *extradata, int size)
+{
+  AVCodec *codec = avcodec_find_decoder(codec_id);
+  AVCodecContext *ctx;
+
+  if (codec == NULL)
+    return NULL;
+  ctx = avcodec_alloc_context3(codec);
+  if (ctx == NULL)
+    return NULL;
+  ctx->thread_count = 1;
+  if (size > 0) {
+    ctx->extradata = av_mallocz(size + FF_INPUT_BUFFER_PADDING_SIZE);
+    memcpy(ctx->extradata, extradata, size);
+    ctx->extradata_size = size;
+  }
+  if (avcodec_open2(ctx, codec, NULL) < 0) {
+    av_free(ctx->extradata);
+    av_free(ctx);
+    return NULL;
+  }
+  return ctx;
+}
+
+void close_decoder(AVCodecContext *ctx)
+{
+  avcodec_close(ctx);
+  av_free(ctx->extradata);
+  av_free(ctx);
+}
+
+int decode_video_frame(AVCodecContext *ctx, AVFrame *frame, void *data, int size)
+{
+  AVPacket pkt;
+  int got = 0;
+
+  av_init_packet(&pkt);
+  pkt.data = av_mallocz(size + FF_INPUT_BUFFER_PADDING_SIZE);
+  memcpy(pkt.data, data, size);
+  pkt.size = size;
+  pkt.flags = AV_PKT_FLAG_KEY;
+  if (avcodec_decode_video2(ctx, frame, &got, &pkt) < 0)
+    got = 0;
+  av_free(pkt.data);
+  // Frame may be delayed by the decoder, drain it
+  if (!got) {
+    av_init_packet(&pkt);
+    pkt.data = NULL;
+    pkt.size = 0;
+    if (avcodec_decode_video2(ctx, frame, &got, &pkt) < 0)
+      got = 0;
+  }
+  avcodec_flush_buffers(ctx);
+  return got;
+}
+
+int decode_packet(AVCodecContext *ctx, AVFrame *frame, void *data, int size, int64_t pts)
+{
+  AVPacket pkt;
+  int got = 0;
+  int res;
+
+  // Without data, frames delayed by the decoder are drained
+  av_init_packet(&pkt);
+  pkt.data = NULL;
+  pkt.size = 0;
+  if (size > 0) {
+    pkt.data = av_mallocz(size + FF_INPUT_BUFFER_PADDING_SIZE);
+    memcpy(pkt.data, data, size);
+    pkt.size = size;
+    pkt.pts = pts;
+  }
+  if (ctx->codec_type == AVMEDIA_TYPE_AUDIO)
+    res = avcodec_decode_audio4(ctx, frame, &got, &pkt);
+  else
+    res = avcodec_decode_video2(ctx, frame, &got, &pkt);
+  av_free(pkt.data);
+  if (res < 0)
+    return res;
+  return got;
+}
+
+AVCodecContext *open_video_encoder(int width, int height, int bitrate, int fps_num, int fps_den)
+{
+  AVCodec *codec = avcodec_find_encoder_by_name("libx264");
+  AVCodecContext *ctx;
+
+  if (codec == NULL)
+    return NULL;
+  ctx = avcodec_alloc_context3(codec);
+  if (ctx == NULL)
+    return NULL;
+  ctx->width = width;
+  ctx->height = height;
+  ctx->pix_fmt = AV_PIX_FMT_YUV420P;
+  ctx->sample_aspect_ratio.num = 1;
+  ctx->sample_aspect_ratio.den = 1;
+  ctx->time_base.num = fps_den;
+  ctx->time_base.den = fps_num;
+  ctx->bit_rate = bitrate;
+  ctx->rc_max_rate = bitrate;
+  ctx->rc_buffer_size = bitrate * 2;
+  // Key frames are forced at chunk boundaries, packets are produced without delay
+  ctx->gop_size = 10 * fps_num / fps_den;
+  ctx->max_b_frames = 0;
+  ctx->flags |= CODEC_FLAG_GLOBAL_HEADER;
+  av_opt_set(ctx->priv_data, "preset", "veryfast", 0);
+  av_opt_set(ctx->priv_data, "tune", "zerolatency", 0);
+  av_opt_set_int(ctx->priv_data, "forced-idr", 1, 0);
+  if (avcodec_open2(ctx, codec, NULL) < 0) {
+    av_free(ctx);
+    return NULL;
+  }
+  return ctx;
+}
+
+AVCodecContext *open_audio_encoder(int sample_rate, int channels, int bitrate)
+{
+  AVCodec *codec = avcodec_find_encoder(AV_CODEC_ID_AAC);
+  AVCodecContext *ctx;
+
+  if (codec == NULL)
+    return NULL;
+  ctx = avcodec_alloc_context3(codec);
+  if (ctx == NULL)
+    return NULL;
+  ctx->sample_fmt = AV_SAMPLE_FMT_FLTP;
+  ctx->sample_rate = sample_rate;
+  ctx->channels = channels;
+  ctx->channel_layout = av_get_default_channel_layout(channels);
+  ctx->time_base.num = 1;
+  ctx->time_base.den = sample_rate;
+  ctx->bit_rate = bitrate;
+  ctx->flags |= CODEC_FLAG_GLOBAL_HEADER;
+  // Native AAC encoder is flagged as experimental in older releases
+  ctx->strict_std_compliance = FF_COMPLIANCE_EXPERIMENTAL;
+  if (avcodec_open2(ctx, codec, NULL) < 0) {
+    av_free(ctx);
+    return NULL;
+  }
+  return ctx;
+}
+
+void close_encoder(AVCodecContext *ctx)
+{
+  avcodec_close(ctx);
+  av_free(ctx);
+}
+
+AVFrame *alloc_video_frame(int width, int height)
+{
+  AVFrame *frame = av_frame_alloc();
+
+  frame->format = AV_PIX_FMT_YUV420P;
+  frame->width = width;
+  frame->height = height;
+  av_frame_get_buffer(frame, 32);
+  return frame;
+}
+
+AVFrame *alloc_audio_frame(AVCodecContext *ctx)
+{
+  AVFrame *frame = av_frame_alloc();
+
+  frame->format = ctx->sample_fmt;
+  frame->channel_layout = ctx->channel_layout;
+  frame->sample_rate = ctx->sample_rate;
+  frame->nb_samples = ctx->frame_size;
+  av_frame_get_buffer(frame, 0);
+  return frame;
+}
+
+// Return -1 on error, 0 if the encoder kept the frame, 1 if a packet is available
+int encode_video_frame(AVCodecContext *ctx, struct SwsContext **scaler, AVFrame *src, AVFrame *dst, AVPacket *pkt, int64_t pts, int key)
+{
+  int got = 0;
+
+  av_init_packet(pkt);
+  pkt->data = NULL;
+  pkt->size = 0;
+  // Without frame, packets delayed by the encoder are drained
+  if (src == NULL) {
+    if (avcodec_encode_video2(ctx, pkt, NULL, &got) < 0)
+      return -1;
+    return got;
+  }
+  *scaler = sws_getCachedContext(*scaler, src->width, src->height, src->format,
+                                 dst->width, dst->height, dst->format, SWS_BICUBIC, NULL, NULL, NULL);
+  if (*scaler == NULL)
+    return -1;
+  sws_scale(*scaler, (const uint8_t * const *)src->data, src->linesize, 0, src->height, dst->data, dst->linesize);
+  dst->pts = pts;
+  dst->pict_type = key ? AV_PICTURE_TYPE_I : AV_PICTURE_TYPE_NONE;
+  if (avcodec_encode_video2(ctx, pkt, dst, &got) < 0)
+    return -1;
+  return got;
+}
+
+int write_audio_fifo(AVAudioFifo *fifo, AVFrame *frame)
+{
+  return av_audio_fifo_write(fifo, (void **)frame->extended_data, frame->nb_samples);
+}
+
+// Return -1 when nothing is left to encode, 0 if the encoder kept the frame, 1 if a packet is available
+int encode_audio_frame(AVCodecContext *ctx, AVAudioFifo *fifo, AVFrame *dst, AVPacket *pkt, int flush)
+{
+  int size = av_audio_fifo_size(fifo);
+  int got = 0;
+
+  av_init_packet(pkt);
+  pkt->data = NULL;
+  pkt->size = 0;
+  if (size < ctx->frame_size && !flush)
+    return -1;
+  // Drain packets delayed by the encoder once every sample is encoded
+  if (size == 0) {
+    if (avcodec_encode_audio2(ctx, pkt, NULL, &got) < 0 || !got)
+      return -1;
+    return got;
+  }
+  if (size > ctx->frame_size)
+    size = ctx->frame_size;
+  // Last frame is padded with silence
+  av_samples_set_silence(dst->extended_data, 0, ctx->frame_size, ctx->channels, ctx->sample_fmt);
+  av_audio_fifo_read(fifo, (void **)dst->extended_data, size);
+  dst->pts = AV_NOPTS_VALUE;
+  if (avcodec_encode_audio2(ctx, pkt, dst, &got) < 0)
+    return -1;
+  return got;
+}
+
+void copy_plane(void *dst, int dst_stride, uint8_t *src, int src_stride, int width, int height)
+{
+  int y;
+
+  for (y = 0; y < height; y++)
+    memcpy((uint8_t *)dst + y * dst_stride, src + y * src_stride, width);
+}
+
 char *convert_byte_slice(void *buffer, int size)
 {
   char *res = malloc(size);
@@ -57,14 +332,29 @@ char *convert_byte_slice(void *buffer, int size)
 */
 import "C"
 import "fmt"
+import "image"
+import "math"
 import "errors"
 import "unsafe"
 import "runtime"
 
+/* Maximum number of packets read to find codec configurations only given in band */
+const FFMPEG_CONFIG_PACKETS = 1000
+
 /* Structure used to reference FFMPEG C AVFormatContext structure */
 type FFMPEGDemuxer struct {
-	context   *C.AVFormatContext
-	pkt       C.AVPacket
+	context     *C.AVFormatContext
+	pkt         C.AVPacket
+	proto       string
+	url         string
+	options     map[string]string
+	readTimeout float64
+	headers     string
+	deadline    *C.read_deadline
+	err         error
+	annexB      map[int]bool
+	adts        map[int]bool
+	queued      []C.AVPacket
 }
 
 /* Structure used to store a Sample for chunk generation */
@@ -78,6 +368,213 @@ type Sample struct {
 	encrypt  *SampleEncryption
 }
 
+/* Structure used to decode key frames of a video track */
+type videoDecoder struct {
+	context *C.AVCodecContext
+	frame   *C.AVFrame
+}
+
+/* Open a decoder for a video track from its extradata */
+func openVideoDecoder(t *Track) (*videoDecoder, error) {
+	var extradata unsafe.Pointer
+	codecId := C.int(C.AV_CODEC_ID_H264)
+	if t.isHEVC() {
+		codecId = C.AV_CODEC_ID_HEVC
+	}
+	if len(t.extradata) > 0 {
+		extradata = unsafe.Pointer(&t.extradata[0])
+	}
+	context := C.open_decoder(codecId, extradata, C.int(len(t.extradata)))
+	if context == nil {
+		return nil, fmt.Errorf("Could not open decoder for track %d", t.index)
+	}
+	return &videoDecoder{context, C.av_frame_alloc()}, nil
+}
+
+/* Decode a key frame sample, only planar YUV 4:2:0 pictures are supported */
+func (d *videoDecoder) decode(s *Sample) (*image.YCbCr, error) {
+	if C.decode_video_frame(d.context, d.frame, s.data, s.size) == 0 {
+		return nil, errors.New("Could not decode video frame")
+	}
+	if d.frame.format != C.AV_PIX_FMT_YUV420P && d.frame.format != C.AV_PIX_FMT_YUVJ420P {
+		return nil, fmt.Errorf("Unsupported pixel format %d", d.frame.format)
+	}
+	width := int(d.frame.width)
+	height := int(d.frame.height)
+	img := image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420)
+	C.copy_plane(unsafe.Pointer(&img.Y[0]), C.int(img.YStride), d.frame.data[0], d.frame.linesize[0], C.int(width), C.int(height))
+	C.copy_plane(unsafe.Pointer(&img.Cb[0]), C.int(img.CStride), d.frame.data[1], d.frame.linesize[1], C.int((width + 1) / 2), C.int((height + 1) / 2))
+	C.copy_plane(unsafe.Pointer(&img.Cr[0]), C.int(img.CStride), d.frame.data[2], d.frame.linesize[2], C.int((width + 1) / 2), C.int((height + 1) / 2))
+	return img, nil
+}
+
+/* Release decoder */
+func (d *videoDecoder) close() {
+	C.av_frame_free(&d.frame)
+	C.close_decoder(d.context)
+}
+
+/* Structure used to decode every sample of a track for transcoding */
+type streamDecoder struct {
+	context *C.AVCodecContext
+	frame   *C.AVFrame
+}
+
+/* Structure used to encode decoded frames in a rendition */
+type streamEncoder struct {
+	context *C.AVCodecContext
+	scaler  *C.struct_SwsContext
+	frame   *C.AVFrame
+	fifo    *C.AVAudioFifo
+	pkt     C.AVPacket
+}
+
+/* Open a decoder for every sample of a track, Dolby decoders don't need extradata */
+func openStreamDecoder(t *Track) (*streamDecoder, error) {
+	var extradata unsafe.Pointer
+	size := 0
+	codecId := C.int(C.AV_CODEC_ID_H264)
+	if t.fourcc == "ac-3" {
+		codecId = C.AV_CODEC_ID_AC3
+	} else if t.fourcc == "ec-3" {
+		codecId = C.AV_CODEC_ID_EAC3
+	} else {
+		if t.isAudio {
+			codecId = C.AV_CODEC_ID_AAC
+		} else if t.isHEVC() {
+			codecId = C.AV_CODEC_ID_HEVC
+		}
+		size = len(t.extradata)
+		if size > 0 {
+			extradata = unsafe.Pointer(&t.extradata[0])
+		}
+	}
+	context := C.open_decoder(codecId, extradata, C.int(size))
+	if context == nil {
+		return nil, fmt.Errorf("Could not open decoder for track %d", t.index)
+	}
+	return &streamDecoder{context, C.av_frame_alloc()}, nil
+}
+
+/* Decode a sample, nil drains frames delayed by the decoder. Return if a frame is available */
+func (d *streamDecoder) decode(s *Sample) bool {
+	if s == nil {
+		return C.decode_packet(d.context, d.frame, nil, 0, 0) > 0
+	}
+	return C.decode_packet(d.context, d.frame, s.data, s.size, C.int64_t(s.pts)) > 0
+}
+
+/* Return time of the decoded frame, in the timescale of the track */
+func (d *streamDecoder) framePts() int64 {
+	return int64(d.frame.pkt_pts)
+}
+
+/* Reset decoder state, next sample must be a key frame */
+func (d *streamDecoder) flush() {
+	C.avcodec_flush_buffers(d.context)
+}
+
+/* Release decoder */
+func (d *streamDecoder) close() {
+	C.av_frame_free(&d.frame)
+	C.close_decoder(d.context)
+}
+
+/* Open a H.264 encoder, bitrate is in bit/s */
+func openVideoEncoder(width int, height int, bitrate int, fpsNum int, fpsDen int) (*streamEncoder, error) {
+	context := C.open_video_encoder(C.int(width), C.int(height), C.int(bitrate), C.int(fpsNum), C.int(fpsDen))
+	if context == nil {
+		return nil, errors.New("Could not open H.264 encoder (libx264)")
+	}
+	return &streamEncoder{context: context, frame: C.alloc_video_frame(C.int(width), C.int(height))}, nil
+}
+
+/* Open an AAC encoder, bitrate is in bit/s */
+func openAudioEncoder(sampleRate int, channels int, bitrate int) (*streamEncoder, error) {
+	context := C.open_audio_encoder(C.int(sampleRate), C.int(channels), C.int(bitrate))
+	if context == nil {
+		return nil, errors.New("Could not open AAC encoder")
+	}
+	e := &streamEncoder{context: context, frame: C.alloc_audio_frame(context)}
+	e.fifo = C.av_audio_fifo_alloc(context.sample_fmt, context.channels, context.frame_size)
+	return e, nil
+}
+
+/* Return codec configuration of the encoder (SPS and PPS, AudioSpecificConfig) */
+func (e *streamEncoder) extradata() []byte {
+	return C.GoBytes(unsafe.Pointer(e.context.extradata), e.context.extradata_size)
+}
+
+/* Return number of samples of each audio frame */
+func (e *streamEncoder) frameSize() int {
+	return int(e.context.frame_size)
+}
+
+/* Copy the packet produced by the encoder */
+func (e *streamEncoder) takePacket() encodedPacket {
+	p := encodedPacket{C.GoBytes(unsafe.Pointer(e.pkt.data), e.pkt.size), e.pkt.flags & C.AV_PKT_FLAG_KEY != 0}
+	C.av_free_packet(&e.pkt)
+	return p
+}
+
+/* Scale and encode the frame of a decoder, nil drains packets delayed by the encoder */
+func (e *streamEncoder) encodeVideo(d *streamDecoder, pts int64, key bool) ([]encodedPacket, error) {
+	var res []encodedPacket
+	if d == nil {
+		for C.encode_video_frame(e.context, &e.scaler, nil, e.frame, &e.pkt, 0, 0) > 0 {
+			res = append(res, e.takePacket())
+		}
+		return res, nil
+	}
+	forceKey := C.int(0)
+	if key {
+		forceKey = 1
+	}
+	got := C.encode_video_frame(e.context, &e.scaler, d.frame, e.frame, &e.pkt, C.int64_t(pts), forceKey)
+	if got < 0 {
+		return nil, errors.New("Could not encode video frame")
+	} else if got > 0 {
+		res = append(res, e.takePacket())
+	}
+	return res, nil
+}
+
+/*
+ Encode the frame of a decoder, samples are buffered until a whole frame can be
+ encoded. With flush, samples left are padded and the encoder is drained.
+ */
+func (e *streamEncoder) encodeAudio(d *streamDecoder, flush bool) ([]encodedPacket, error) {
+	var res []encodedPacket
+	if d != nil {
+		if d.frame.format != C.AV_SAMPLE_FMT_FLTP || d.frame.channels != e.context.channels || d.frame.sample_rate != e.context.sample_rate {
+			return nil, fmt.Errorf("Unsupported decoded audio format %d (%d channels, %d Hz)", d.frame.format, d.frame.channels, d.frame.sample_rate)
+		}
+		C.write_audio_fifo(e.fifo, d.frame)
+	}
+	doFlush := C.int(0)
+	if flush {
+		doFlush = 1
+	}
+	for got := C.encode_audio_frame(e.context, e.fifo, e.frame, &e.pkt, doFlush); got >= 0; got = C.encode_audio_frame(e.context, e.fifo, e.frame, &e.pkt, doFlush) {
+		if got > 0 {
+			res = append(res, e.takePacket())
+		}
+	}
+	return res, nil
+}
+
+/* Release encoder */
+func (e *streamEncoder) close() {
+	C.av_frame_free(&e.frame)
+	if e.fifo != nil {
+		C.av_audio_fifo_free(e.fifo)
+	}
+	if e.scaler != nil {
+		C.sws_freeContext(e.scaler)
+	}
+	C.close_encoder(e.context)
+}
+
 /* Called when starting the program, initialise FFMPEG demuxers */
 func FFMPEGInitialise() error {
 	_, err := C.av_register_all()
@@ -110,6 +607,13 @@ func (s *Sample) GetData() []byte {
 	return C.GoBytes(s.data, s.size)
 }
 
+/* Replace sample data by data of the same size */
+func (s *Sample) setData(data []byte) {
+	if len(data) > 0 {
+		C.memcpy(s.data, unsafe.Pointer(&data[0]), C.size_t(len(data)))
+	}
+}
+
 /* Find a track using its index */
 func findTrack(tracks []*Track, index int) *Track {
 	for i := 0; i < len(tracks); i++ {
@@ -120,8 +624,15 @@ func findTrack(tracks []*Track, index int) *Track {
 	return nil
 }
 
-/* Open FFMPEG specific demuxer */
+/* Open FFMPEG specific demuxer, network streams and remote files are opened with their options by GetTracks */
 func (d *FFMPEGDemuxer) Open(path string) error {
+	if d.proto != "" {
+		d.url = d.proto + "://" + path
+		if d.options == nil {
+			d.SetInputOptions(nil, 0)
+		}
+		return nil
+	}
 	res, err := C.avformat_open_input(&(d.context), C.CString(path), nil, nil)
 	if err != nil {
 		return err
@@ -133,6 +644,67 @@ func (d *FFMPEGDemuxer) Open(path string) error {
 	}
 }
 
+/* Give up a blocking read or open of a network stream after its read timeout */
+func (d *FFMPEGDemuxer) resetDeadline() {
+	if d.deadline != nil {
+		d.deadline.deadline = C.av_gettime() + C.int64_t(d.readTimeout * 1000000)
+	}
+}
+
+/* Open a network stream or remote file with its input options and probe its streams */
+func (d *FFMPEGDemuxer) openStream() error {
+	var options *C.AVDictionary
+	d.deadline = (*C.read_deadline)(C.malloc(C.size_t(unsafe.Sizeof(C.read_deadline{}))))
+	d.resetDeadline()
+	d.context = C.alloc_interruptible_context(d.deadline)
+	/* A headers input option overrides headers of the source */
+	if d.headers != "" {
+		cname, cvalue := C.CString("headers"), C.CString(d.headers)
+		C.av_dict_set(&options, cname, cvalue, 0)
+		C.free(unsafe.Pointer(cname))
+		C.free(unsafe.Pointer(cvalue))
+	}
+	for name, value := range d.options {
+		cname, cvalue := C.CString(name), C.CString(value)
+		C.av_dict_set(&options, cname, cvalue, 0)
+		C.free(unsafe.Pointer(cname))
+		C.free(unsafe.Pointer(cvalue))
+	}
+	url := C.CString(d.url)
+	defer C.free(unsafe.Pointer(url))
+	res := C.avformat_open_input(&(d.context), url, nil, &options)
+	C.av_dict_free(&options)
+	if res < 0 {
+		return errors.New("Could not open stream " + d.url)
+	}
+	/* Codec parameters of MPEG-TS streams are only known from their first packets */
+	d.resetDeadline()
+	if C.avformat_find_stream_info(d.context, nil) < 0 {
+		return errors.New("Could not find streams of " + d.url)
+	}
+	return nil
+}
+
+/* Read next packet, the reason why a network stream stopped is kept */
+func (d *FFMPEGDemuxer) readFrame() C.int {
+	/* Packets read while looking for codec configurations come first */
+	if len(d.queued) > 0 {
+		d.pkt = d.queued[0]
+		d.queued = d.queued[1:]
+		return 0
+	}
+	d.resetDeadline()
+	res := C.av_read_frame(d.context, &d.pkt)
+	if res < 0 && IsStreamProtocol(d.proto) && d.err == nil {
+		if d.deadline.deadline > 0 && C.av_gettime() > d.deadline.deadline {
+			d.err = fmt.Errorf("No data received from %s for %.0f seconds", d.url, d.readTimeout)
+		} else {
+			d.err = fmt.Errorf("Stream %s ended (error %d)", d.url, int(res))
+		}
+	}
+	return res
+}
+
 /* Find the first Video track for use as chunk size reference */
 func (d *FFMPEGDemuxer) findMainIndex() int {
 	var stream *C.AVStream
@@ -150,8 +722,114 @@ func packetFinalizer(s *Sample) {
 	C.av_free(unsafe.Pointer(s.data))
 }
 
+/* Append a subtitle packet to a text track as a cue */
+func (d *FFMPEGDemuxer) appendCuePacket(track *Track, stream *C.AVStream) {
+	duration := C.int64_t(d.pkt.duration)
+	if duration <= 0 {
+		duration = C.int64_t(d.pkt.convergence_duration)
+	}
+	start := int64(C.rescale_to_generic_timebase(C.packet_timestamp(&d.pkt), stream.time_base))
+	end := start + int64(C.rescale_to_generic_timebase(duration, stream.time_base))
+	data := C.GoBytes(unsafe.Pointer(d.pkt.data), d.pkt.size)
+	track.appendCue(start, end, subtitleText(track.subtitleSource, data))
+}
+
+/*
+ Return data of the current packet, NAL units of Annex B streams are prefixed by
+ their size and ADTS headers are removed.
+ */
+func (d *FFMPEGDemuxer) packetData() []byte {
+	index := int(d.pkt.stream_index)
+	data := C.GoBytes(unsafe.Pointer(d.pkt.data), d.pkt.size)
+	if d.annexB[index] {
+		data = annexBToLengthPrefixed(data)
+	} else if d.adts[index] {
+		data = data[adtsHeaderSize(data):]
+	}
+	return data
+}
+
+/* Return size of the current packet once converted by packetData */
+func (d *FFMPEGDemuxer) packetSize() int {
+	index := int(d.pkt.stream_index)
+	if d.annexB[index] || d.adts[index] {
+		return len(d.packetData())
+	}
+	return int(d.pkt.size)
+}
+
+/* Free packets read in advance */
+func (d *FFMPEGDemuxer) clearQueue() {
+	for i := range d.queued {
+		C.av_free_packet(&d.queued[i])
+	}
+	d.queued = nil
+}
+
+/* Replace Annex B parameter sets of a video track by avcC or hvcC, its samples get their NAL unit sizes */
+func (d *FFMPEGDemuxer) setAnnexBConfig(track *Track, index int, data []byte) error {
+	var err error
+	if track.isHEVC() {
+		track.extradata, err = hevcAnnexBToHVCC(data)
+		/* Parameter sets are also repeated in band */
+		track.fourcc = "hev1"
+	} else {
+		track.extradata, err = h264AnnexBToAVCC(data)
+	}
+	d.annexB[index] = true
+	return err
+}
+
+/*
+ Read packets until every track has its codec configuration, when it is only
+ given in band (ADTS AAC, video without parameter sets in its headers). Packets
+ read are kept for extraction.
+ */
+func (d *FFMPEGDemuxer) readInBandConfigs(tracks []*Track) error {
+	var err error
+	pending := 0
+	for _, track := range tracks {
+		if !track.isText && len(track.extradata) == 0 {
+			pending++
+		}
+	}
+	for pending > 0 && len(d.queued) < FFMPEG_CONFIG_PACKETS {
+		d.resetDeadline()
+		if C.av_read_frame(d.context, &d.pkt) < 0 {
+			break
+		}
+		C.av_dup_packet(&d.pkt)
+		d.queued = append(d.queued, d.pkt)
+		index := int(d.pkt.stream_index)
+		track := findTrack(tracks, index)
+		if track == nil || track.isText || len(track.extradata) > 0 {
+			continue
+		}
+		data := C.GoBytes(unsafe.Pointer(d.pkt.data), d.pkt.size)
+		if track.isAudio {
+			track.extradata, err = adtsToASC(data)
+		} else if (d.pkt.flags) & 0x1 > 0 && isAnnexB(data) {
+			/* Parameter sets are sent with key frames */
+			err = d.setAnnexBConfig(track, index, data)
+		} else {
+			continue
+		}
+		if err != nil { return err }
+		pending--
+	}
+	if pending > 0 {
+		return errors.New("Codec configuration of some tracks not found in " + d.url)
+	}
+	return nil
+}
+
 /* Append a sample to a track */
 func (d *FFMPEGDemuxer) AppendSample(track *Track, stream *C.AVStream) {
+	/* Text tracks samples are built from cues on the chunk timeline */
+	if track.isText {
+		d.appendCuePacket(track, stream)
+		return
+	}
 	sample := new(Sample)
 	/* Copy packet metadata in sample */
 	sample.pts = int64(C.rescale_to_generic_timebase(d.pkt.pts, stream.time_base))
@@ -159,9 +837,12 @@ func (d *FFMPEGDemuxer) AppendSample(track *Track, stream *C.AVStream) {
 	sample.duration = int64(C.rescale_to_generic_timebase(C.int64_t(d.pkt.duration), stream.time_base))
 	sample.keyFrame = (d.pkt.flags) & 0x1 > 0
 	/* Copy packet data in sample */
-	sample.size = d.pkt.size
-	sample.data = unsafe.Pointer(C.av_malloc(C.size_t(d.pkt.size)))
-	C.memcpy(sample.data, unsafe.Pointer(d.pkt.data), C.size_t(d.pkt.size))
+	data := d.packetData()
+	sample.size = C.int(len(data))
+	sample.data = unsafe.Pointer(C.av_malloc(C.size_t(len(data))))
+	if len(data) > 0 {
+		C.memcpy(sample.data, unsafe.Pointer(&data[0]), C.size_t(len(data)))
+	}
 	/* Set finalizer to free memory when GC is called */
 	runtime.SetFinalizer(sample, packetFinalizer)
 	/* Append sample to track */
@@ -177,12 +858,14 @@ func (d *FFMPEGDemuxer) ExtractChunk(tracks *[]*Track, isLive bool) bool {
 	var stream *C.AVStream
 	/* Find first video track to use as reference for chunk size */
 	mainIndex := d.findMainIndex()
-	/* Append last extracted chunk */
-	d.AppendSample(findTrack(*tracks, int(d.pkt.stream_index)), C.get_stream(d.context.streams, C.int(d.pkt.stream_index)))
+	/* Append last extracted chunk, packets of streams without track are dropped */
+	if track = findTrack(*tracks, int(d.pkt.stream_index)); track != nil {
+		d.AppendSample(track, C.get_stream(d.context.streams, C.int(d.pkt.stream_index)))
+	}
 	C.av_free_packet(&d.pkt)
 	/* Read frames until reference track sample uis a key frame */
-	res := C.av_read_frame(d.context, &d.pkt)
-	for ; res >= 0; res = C.av_read_frame(d.context, &d.pkt) {
+	res := d.readFrame()
+	for ; res >= 0; res = d.readFrame() {
 		/* Retrieve track corresponding to packet, if we have one*/
 		track = findTrack(*tracks, int(d.pkt.stream_index))
 		stream = C.get_stream(d.context.streams, C.int(d.pkt.stream_index))
@@ -200,53 +883,261 @@ func (d *FFMPEGDemuxer) ExtractChunk(tracks *[]*Track, isLive bool) bool {
 	return res >= 0
 }
 
+/*
+ Read the whole input once to compute chunks boundaries of each track, without
+ keeping any sample. Boundaries are the same as the ones produced by ExtractChunk.
+ Cues of text tracks are kept, their chunks are the ones of the reference track.
+ Trick mode tracks get the chunks of their source, sized with its key frames only.
+ */
+func (d *FFMPEGDemuxer) BuildIndex(tracks *[]*Track) error {
+	var track *Track
+	var stream *C.AVStream
+	starts := make(map[int]int64)
+	durations := make(map[int]int64)
+	sizes := make(map[int]int)
+	keySizes := make(map[int]int)
+	counts := make(map[int]int)
+	tricks := make(map[int]*Track)
+	for _, t := range *tracks {
+		if t.trickSource != nil {
+			tricks[t.trickSource.index] = t
+		}
+	}
+	/* Close current chunk of every track */
+	closeChunks := func() {
+		for _, t := range *tracks {
+			if t.trickSource == nil && counts[t.index] > 0 {
+				t.appendIndexedChunk(starts[t.index], durations[t.index], sizes[t.index])
+				if trick := tricks[t.index]; trick != nil {
+					trick.appendIndexedChunk(starts[t.index], durations[t.index], keySizes[t.index])
+				}
+				counts[t.index] = 0
+			}
+		}
+	}
+	mainIndex := d.findMainIndex()
+	/* First packet has already been read when retrieving tracks */
+	res := C.int(0)
+	for ; res >= 0; res = d.readFrame() {
+		track = findTrack(*tracks, int(d.pkt.stream_index))
+		if track != nil && track.isText {
+			d.appendCuePacket(track, C.get_stream(d.context.streams, C.int(d.pkt.stream_index)))
+		} else if track != nil {
+			stream = C.get_stream(d.context.streams, C.int(d.pkt.stream_index))
+			/* A key frame on reference track starts a new chunk */
+			if track.index == mainIndex && ((d.pkt.flags) & 0x1 > 0) && counts[track.index] > 0 {
+				closeChunks()
+			}
+			if counts[track.index] == 0 {
+				starts[track.index] = int64(C.rescale_to_generic_timebase(C.packet_timestamp(&d.pkt), stream.time_base))
+				durations[track.index] = 0
+				sizes[track.index] = 0
+				keySizes[track.index] = 0
+			}
+			durations[track.index] += int64(C.rescale_to_generic_timebase(C.int64_t(d.pkt.duration), stream.time_base))
+			sizes[track.index] += d.packetSize()
+			counts[track.index] += 1
+			if trick := tricks[track.index]; trick != nil {
+				trick.trickFrames += 1
+				if (d.pkt.flags) & 0x1 > 0 {
+					trick.trickKeyFrames += 1
+					keySizes[track.index] += d.packetSize()
+				}
+			}
+		}
+		C.av_free_packet(&d.pkt)
+	}
+	closeChunks()
+	/* Text chunks follow the main track, or the first other track when there is no video */
+	reference := findTrack(*tracks, mainIndex)
+	for i := 0; i < len(*tracks) && (reference == nil || reference.isText); i++ {
+		reference = (*tracks)[i]
+	}
+	for _, t := range *tracks {
+		if t.isText && reference != nil && !reference.isText {
+			t.indexTextChunks(reference)
+		}
+	}
+	return nil
+}
+
+/* Seek input and extract samples of one indexed chunk for a track */
+func (d *FFMPEGDemuxer) ExtractIndexedChunk(track *Track, chunk int) error {
+	if chunk < 0 || chunk >= len(track.chunksStart) {
+		return fmt.Errorf("Chunk %d is not indexed for track %d", chunk, track.index)
+	}
+	/* Text samples are built from the cues read when indexing */
+	if track.isText {
+		track.buildIndexedTextSamples(chunk)
+		return nil
+	}
+	/* Trick mode samples are copied from the same chunk of the source */
+	if track.trickSource != nil {
+		err := d.ExtractIndexedChunk(track.trickSource, chunk)
+		if err == nil {
+			track.copyKeyFrames()
+		}
+		track.trickSource.Clean()
+		return err
+	}
+	stream := C.get_stream(d.context.streams, C.int(track.index))
+	start := track.chunksStart[chunk]
+	end := int64(math.MaxInt64)
+	if chunk + 1 < len(track.chunksStart) {
+		end = track.chunksStart[chunk + 1]
+	}
+	/* Seek on the track stream, before the first sample of the chunk */
+	ts := C.rescale_from_generic_timebase(C.int64_t(start), stream.time_base)
+	d.clearQueue()
+	d.resetDeadline()
+	if C.av_seek_frame(d.context, C.int(track.index), ts, C.AVSEEK_FLAG_BACKWARD) < 0 {
+		return fmt.Errorf("Could not seek to chunk %d of track %d", chunk, track.index)
+	}
+	/* Keep samples of the track until the beginning of next chunk */
+	for res := d.readFrame(); res >= 0; res = d.readFrame() {
+		if int(d.pkt.stream_index) == track.index {
+			dts := int64(C.rescale_to_generic_timebase(C.packet_timestamp(&d.pkt), stream.time_base))
+			if dts >= end {
+				C.av_free_packet(&d.pkt)
+				break
+			}
+			if dts >= start {
+				d.AppendSample(track, stream)
+			}
+		}
+		C.av_free_packet(&d.pkt)
+	}
+	if len(track.samples) == 0 {
+		return fmt.Errorf("No sample found for chunk %d of track %d", chunk, track.index)
+	}
+	return nil
+}
+
+/* Return a stream metadata value, empty if not set */
+func streamMetadata(stream *C.AVStream, key string) string {
+	ckey := C.CString(key)
+	defer C.free(unsafe.Pointer(ckey))
+	entry := C.av_dict_get(stream.metadata, ckey, nil, 0)
+	if entry == nil {
+		return ""
+	}
+	return C.GoString(entry.value)
+}
+
 /* Retrieve tracks from previously opened file using FFMPEG */
 func (d *FFMPEGDemuxer) GetTracks(tracks *[]*Track) error {
 	var track *Track
 	var stream *C.AVStream
+	var found []*Track
+	if d.context == nil && d.url != "" {
+		err := d.openStream()
+		if err != nil { return err }
+	}
+	d.annexB = make(map[int]bool)
+	d.adts = make(map[int]bool)
 	/* Iterate over streams found by ffmpeg */
 	for i := 0; i < int(d.context.nb_streams); i++ {
 		/* Little hack to retrieve the stream due to pointer arithmetic */
 		stream = C.get_stream(d.context.streams, C.int(i))
 		if stream.codec.codec_type == C.AVMEDIA_TYPE_VIDEO {
-			/* Test if video is H264 */
-			if stream.codec.codec_id != C.AV_CODEC_ID_H264 {
-				return fmt.Errorf("Video track is not encoded in H264 (codec_id=%d)", stream.codec.codec_id)
+			/* Test if video is H264 or HEVC */
+			if stream.codec.codec_id != C.AV_CODEC_ID_H264 && stream.codec.codec_id != C.AV_CODEC_ID_HEVC {
+				return fmt.Errorf("Video track is not encoded in H264 or HEVC (codec_id=%d)", stream.codec.codec_id)
 			}
 			/* Set video specific info in track structure */
 			track = new(Track)
+			if stream.codec.codec_id == C.AV_CODEC_ID_HEVC {
+				track.fourcc = "hvc1"
+			}
 			track.width = int(stream.codec.width)
 			track.height = int(stream.codec.height)
 			track.bitsPerSample = int(stream.codec.bits_per_coded_sample)
 			// track.colorTableId = int(stream.codec.color_table_id)
 			track.isAudio = false
 		} else if stream.codec.codec_type == C.AVMEDIA_TYPE_AUDIO {
-			/* Test if audio is AAC */
-			if stream.codec.codec_id != C.AV_CODEC_ID_AAC  {
-				return fmt.Errorf("Audio track is not encoded in AAC (codec_id=%d)", stream.codec.codec_id)
+			/* Test if audio is AAC, AC-3 or E-AC-3 */
+			if stream.codec.codec_id != C.AV_CODEC_ID_AAC && stream.codec.codec_id != C.AV_CODEC_ID_AC3 && stream.codec.codec_id != C.AV_CODEC_ID_EAC3 {
+				return fmt.Errorf("Audio track is not encoded in AAC, AC-3 or E-AC-3 (codec_id=%d)", stream.codec.codec_id)
 			}
 			/* Set audio specific info in track structure */
 			track = new(Track)
 			track.sampleRate = int(stream.codec.sample_rate)
+			track.channels = int(stream.codec.channels)
 			track.isAudio = true
+		} else if stream.codec.codec_type == C.AVMEDIA_TYPE_SUBTITLE {
+			/* Only text based subtitles can be converted */
+			source := ""
+			switch stream.codec.codec_id {
+			case C.AV_CODEC_ID_SUBRIP, C.AV_CODEC_ID_TEXT, C.AV_CODEC_ID_WEBVTT:
+				source = SUBTITLE_SOURCE_TEXT
+			case C.AV_CODEC_ID_MOV_TEXT:
+				source = SUBTITLE_SOURCE_TX3G
+			case C.AV_CODEC_ID_ASS, C.AV_CODEC_ID_SSA:
+				source = SUBTITLE_SOURCE_ASS
+			default:
+				/* Bitmap subtitles (PGS, DVB...) are ignored */
+				continue
+			}
+			track = new(Track)
+			track.isText = true
+			track.subtitleSource = source
+			track.fourcc = TEXT_FORMAT_WVTT
 		} else {
 			continue
 		}
+		/* Language and label are stored in stream metadata */
+		track.language = streamMetadata(stream, "language")
+		track.label = streamMetadata(stream, "title")
+		if stream.disposition & C.AV_DISPOSITION_VISUAL_IMPAIRED != 0 {
+			track.role = "description"
+		} else if stream.disposition & C.AV_DISPOSITION_DEFAULT != 0 {
+			track.role = "main"
+		}
 		/* Set common properties in track structure */
 		track.SetTimeFields()
 		track.duration = int(C.rescale_to_generic_timebase(stream.duration, stream.time_base))
 		track.globalTimescale = 90000
 		track.timescale = 90000
-		track.extradata = C.GoBytes(unsafe.Pointer(stream.codec.extradata), stream.codec.extradata_size)
+		if !track.isText {
+			track.extradata = C.GoBytes(unsafe.Pointer(stream.codec.extradata), stream.codec.extradata_size)
+		}
+		/* Dolby configuration boxes are built from codec parameters */
+		if stream.codec.codec_id == C.AV_CODEC_ID_AC3 || stream.codec.codec_id == C.AV_CODEC_ID_EAC3 {
+			lfe := (stream.codec.channel_layout & C.AV_CH_LOW_FREQUENCY) != 0
+			if stream.codec.codec_id == C.AV_CODEC_ID_AC3 {
+				track.fourcc = "ac-3"
+				track.extradata = buildAC3Config(track.sampleRate, track.channels, lfe, int(stream.codec.bit_rate))
+			} else {
+				track.fourcc = "ec-3"
+				track.extradata = buildEAC3Config(track.sampleRate, track.channels, lfe, int(stream.codec.bit_rate))
+			}
+		}
+		/* Parameter sets of MPEG-TS sources are in Annex B, H.264 and HEVC samples too */
+		if !track.isAudio && !track.isText && isAnnexB(track.extradata) {
+			err := d.setAnnexBConfig(track, int(stream.index), track.extradata)
+			if err != nil { return err }
+		}
+		/* AAC of MPEG-TS sources is in ADTS, without AudioSpecificConfig */
+		if stream.codec.codec_id == C.AV_CODEC_ID_AAC && len(track.extradata) == 0 {
+			d.adts[int(stream.index)] = true
+		}
 		track.index = int(stream.index)
 		/* Append track to slice */
 		*tracks = append(*tracks, track)
+		found = append(found, track)
 	}
-	C.av_read_frame(d.context, &d.pkt)
+	err := d.readInBandConfigs(found)
+	if err != nil { return err }
+	d.readFrame()
 	return nil
 }
 
 /* Close demuxer and free FFMPEG specific data */
 func (d *FFMPEGDemuxer) Close() {
+	d.clearQueue()
 	C.avformat_close_input(&d.context);
+	if d.deadline != nil {
+		C.free(unsafe.Pointer(d.deadline))
+		d.deadline = nil
+	}
 }
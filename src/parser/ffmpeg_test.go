@@ -0,0 +1,100 @@
+// Copyright 2015 CANAL+ Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+  "os"
+  "testing"
+  "io/ioutil"
+  "path/filepath"
+)
+
+func TestIndexedChunks(t *testing.T) {
+  dir, err := ioutil.TempDir("", "dashme")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "movie.ts")
+  if err := ioutil.WriteFile(path, testTransportStream(), 0644); err != nil {
+    t.Fatal(err)
+  }
+  openTracks := func() (*FFMPEGDemuxer, []*Track) {
+    var tracks []*Track
+    d := new(FFMPEGDemuxer)
+    if err := d.Open(path); err != nil {
+      t.Fatalf("got error in Open %q", err)
+    }
+    if err := d.GetTracks(&tracks); err != nil {
+      t.Fatalf("got error in GetTracks %q", err)
+    }
+    return d, tracks
+  }
+
+  /* First sample and sample count of each chunk of a full build */
+  type chunk struct {
+    start int64
+    count int
+  }
+  full := make(map[int][]chunk)
+  d, tracks := openTracks()
+  defer d.Close()
+  for more := true; more; {
+    more = d.ExtractChunk(&tracks, false)
+    for _, track := range tracks {
+      if len(track.samples) > 0 {
+        full[track.index] = append(full[track.index], chunk{track.samples[0].dts, len(track.samples)})
+      }
+      track.Clean()
+    }
+  }
+
+  indexed, tracks := openTracks()
+  defer indexed.Close()
+  for _, track := range tracks {
+    if trick := track.NewTrickModeTrack(); trick != nil {
+      tracks = append(tracks, trick)
+    }
+  }
+  if err := indexed.BuildIndex(&tracks); err != nil {
+    t.Fatalf("got error in BuildIndex %q", err)
+  }
+  if len(tracks) != 3 {
+    t.Fatalf("bad track count. want 3, got %d", len(tracks))
+  }
+  /* Chunks are extracted in any order, as requested by players */
+  for _, track := range tracks {
+    want := full[track.index]
+    if len(track.chunksStart) != len(want) || len(want) == 0 {
+      t.Errorf("bad chunk count of %s. want %d, got %d", track.RepresentationId(), len(want), len(track.chunksStart))
+      continue
+    }
+    for k := len(want) - 1; k >= 0; k-- {
+      if track.FindChunk(track.chunksName[k]) != k {
+        t.Errorf("chunk %s not found", track.chunksName[k])
+      }
+      err := indexed.ExtractIndexedChunk(track, k)
+      /* Trick mode chunks only keep the key frame */
+      count := want[k].count
+      if track.IsTrickMode() {
+        count = 1
+      }
+      if err != nil || len(track.samples) != count || track.samples[0].dts != want[k].start {
+        t.Errorf("chunk %d of %s differs from a full build. want %d samples from %d, got %d (%v)", k, track.RepresentationId(), count, want[k].start, len(track.samples), err)
+      }
+      track.Clean()
+    }
+  }
+}
@@ -22,6 +22,7 @@ import (
 	"strings"
 	"strconv"
 	"runtime"
+	"encoding/xml"
 	"path/filepath"
 	"encoding/binary"
 )
@@ -40,6 +41,13 @@ func RemoveExtension(filename string) string {
 	return filename[0:len(filename)-len(extension)]
 }
 
+/* Escape a string to be used as XML text or attribute value */
+func XMLEscape(value string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(value))
+	return buf.String()
+}
+
 /* parse an URL and extract information according to a pattern */
 func ParseURL(pattern string, path string, params *map[string]string) bool {
 	var i int